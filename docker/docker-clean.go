@@ -0,0 +1,111 @@
+package docker
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// Kinds of CleanItem
+const (
+	CleanContainer = "container"
+	CleanImage     = "image"
+	CleanCompose   = "compose"
+)
+
+// stateFiles are the files in WorkPath created by docker runner
+var stateFiles = []string{".cid", ".exec.cid", ".digests", ".services.log"}
+
+// exists checks the container or image exists
+func (r *Runner) exists(kind, name string) bool {
+	return r.docker("inspect", "--type", kind, name) == nil
+}
+
+// builtImages returns the images built or committed by the target
+func (r *Runner) builtImages() (images []string) {
+	if r.Build != "" {
+		images = append(images, r.Image)
+		images = append(images, r.Tags...)
+	}
+	return append(images, r.Commits...)
+}
+
+// composeName names the services for display
+func (r *Runner) composeName() string {
+	if r.Compose.ProjectName != "" {
+		return r.Compose.ProjectName
+	}
+	if len(r.Compose.Files) > 1 {
+		return strings.Join(r.Compose.Files, ",")
+	}
+	if r.Compose.File != "" {
+		return r.Compose.File
+	}
+	return r.Task.Name()
+}
+
+// composeCreated checks if any container of services is created
+func (r *Runner) composeCreated() bool {
+	var out bytes.Buffer
+	x := r.composeExec("ps", "-a", "-q").Mute()
+	x.Cmd.Stdout = &out
+	return x.Run(nil) == nil && len(strings.TrimSpace(out.String())) > 0
+}
+
+// CleanItems implements CleanRunner
+func (r *Runner) CleanItems() (items []*hm.CleanItem) {
+	if r.Compose != nil && r.composeCreated() {
+		items = append(items, &hm.CleanItem{
+			Kind: CleanCompose,
+			Name: r.composeName(),
+			Remove: func() error {
+				return r.composeExec("down").Mute().Run(nil)
+			},
+		})
+	}
+	for _, cid := range []string{r.cid(), r.persistentCid()} {
+		cid := strings.TrimSpace(cid)
+		if cid == "" || !r.exists(CleanContainer, cid) {
+			continue
+		}
+		name := cid
+		if len(name) > 12 {
+			name = name[:12]
+		}
+		items = append(items, &hm.CleanItem{
+			Kind: CleanContainer,
+			Name: name,
+			Remove: func() error {
+				return r.docker("rm", "-f", cid)
+			},
+		})
+	}
+	for _, image := range r.builtImages() {
+		if !r.exists(CleanImage, image) {
+			continue
+		}
+		image := image
+		items = append(items, &hm.CleanItem{
+			Kind: CleanImage,
+			Name: image,
+			Remove: func() error {
+				return r.docker("rmi", image)
+			},
+		})
+	}
+	files := make([]string, 0, len(stateFiles)+1)
+	for _, suffix := range stateFiles {
+		files = append(files, r.Task.WorkFile(suffix))
+	}
+	files = append(files, filepath.Join(r.Task.WorkPath(), r.Task.Target.LocalName()+"docker-compose.log"))
+	for _, fn := range files {
+		if _, err := os.Stat(fn); err != nil {
+			continue
+		}
+		items = append(items, r.Task.Plan.FileCleanItem(fn))
+	}
+	return
+}
@@ -0,0 +1,237 @@
+package docker
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultComposeWaitTimeout is the default timeout waiting for services
+	DefaultComposeWaitTimeout = time.Minute
+	// DefaultComposeWaitInterval is the default interval between readiness checks
+	DefaultComposeWaitInterval = time.Second
+	// ComposeCommand is the standalone docker-compose command
+	ComposeCommand = "docker-compose"
+)
+
+var (
+	composeCmdOnce sync.Once
+	composeCmd     string
+	composeCmdArgs []string
+)
+
+// composeCommand returns the command line prefix to invoke docker-compose,
+// the compose v2 plugin "docker compose" is used if docker-compose is absent
+func composeCommand() (string, []string) {
+	composeCmdOnce.Do(func() {
+		composeCmd = ComposeCommand
+		if _, err := exec.LookPath(ComposeCommand); err != nil {
+			composeCmd, composeCmdArgs = "docker", []string{"compose"}
+		}
+	})
+	return composeCmd, append([]string{}, composeCmdArgs...)
+}
+
+// ComposeWait defines the readiness checks after docker-compose up
+type ComposeWait struct {
+	Timeout        string             `map:"timeout"`
+	Interval       string             `map:"interval"`
+	Health         bool               `map:"health"`
+	HealthServices []string           `map:"health"`
+	TCP            []string           `map:"tcp"`
+	Exec           []*ComposeWaitExec `map:"exec"`
+
+	timeout  time.Duration
+	interval time.Duration
+}
+
+// ComposeWaitExec is a command which must succeed inside a service container
+type ComposeWaitExec struct {
+	Service string   `map:"service"`
+	Command []string `map:"command"`
+	Script  string   `map:"command"`
+}
+
+func (w *ComposeWait) parse() (err error) {
+	w.timeout, w.interval = DefaultComposeWaitTimeout, DefaultComposeWaitInterval
+	if w.Timeout != "" {
+		if w.timeout, err = time.ParseDuration(w.Timeout); err != nil {
+			return fmt.Errorf("invalid compose.wait.timeout %s: %v", w.Timeout, err)
+		}
+	}
+	if w.Interval != "" {
+		if w.interval, err = time.ParseDuration(w.Interval); err != nil {
+			return fmt.Errorf("invalid compose.wait.interval %s: %v", w.Interval, err)
+		}
+	}
+	for _, ex := range w.Exec {
+		if ex.Service == "" {
+			return fmt.Errorf("compose.wait.exec requires service")
+		}
+		if len(ex.Command) == 0 && ex.Script == "" {
+			return fmt.Errorf("compose.wait.exec requires command for service %s", ex.Service)
+		}
+	}
+	return nil
+}
+
+// args builds the command line to execute inside the service container
+func (ex *ComposeWaitExec) args() []string {
+	args := []string{"exec", "-T", ex.Service}
+	if len(ex.Command) > 1 || ex.Script == "" {
+		return append(args, ex.Command...)
+	}
+	return append(args, "/bin/sh", "-c", ex.Script)
+}
+
+// composeWait blocks until all readiness checks pass or timeout
+func (r *Runner) composeWait(sigCh <-chan os.Signal) error {
+	w := r.Compose.Wait
+	deadline := time.Now().Add(w.timeout)
+	for {
+		notReady := r.composeNotReady()
+		if notReady == "" {
+			r.logf("docker-compose services ready")
+			return nil
+		}
+		r.logf("docker-compose services not ready: %s", notReady)
+		if time.Now().After(deadline) {
+			err := fmt.Errorf("docker-compose services not ready in %v: %s", w.timeout, notReady)
+			r.appendComposeLogs()
+			return err
+		}
+		select {
+		case sig := <-sigCh:
+			r.appendComposeLogs()
+			return fmt.Errorf("waiting for docker-compose services interrupted by %v", sig)
+		case <-time.After(w.interval):
+		}
+	}
+}
+
+// composeNotReady runs readiness checks and describes the first failure,
+// empty string means all checks pass
+func (r *Runner) composeNotReady() string {
+	w := r.Compose.Wait
+	if w.Health || len(w.HealthServices) > 0 {
+		if msg := r.composeHealth(w.HealthServices); msg != "" {
+			return msg
+		}
+	}
+	for _, addr := range w.TCP {
+		conn, err := net.DialTimeout("tcp", addr, w.interval)
+		if err != nil {
+			return fmt.Sprintf("tcp %s: %v", addr, err)
+		}
+		conn.Close()
+	}
+	for _, ex := range w.Exec {
+		if err := r.composeExec(ex.args()...).Mute().Run(nil); err != nil {
+			return fmt.Sprintf("exec %s %v: %v", ex.Service, ex.args()[3:], err)
+		}
+	}
+	return ""
+}
+
+// composeHealth checks containers of services are healthy, or running if
+// no healthcheck is defined
+func (r *Runner) composeHealth(services []string) string {
+	var out bytes.Buffer
+	x := r.composeExec(append([]string{"ps", "-q"}, services...)...).Mute()
+	x.Cmd.Stdout = &out
+	if err := x.Run(nil); err != nil {
+		return fmt.Sprintf("compose ps: %v", err)
+	}
+	cids := strings.Fields(out.String())
+	if len(cids) == 0 {
+		return "no containers"
+	}
+	for _, cid := range cids {
+		out.Reset()
+		err := r.dockerPiped(nil, &out, nil, "inspect", "-f",
+			"{{.Name}} {{.State.Status}} {{if .State.Health}}{{.State.Health.Status}}{{end}}", cid)
+		if err != nil {
+			return fmt.Sprintf("inspect %s: %v", cid, err)
+		}
+		tokens := strings.Fields(out.String())
+		if len(tokens) < 2 {
+			return fmt.Sprintf("inspect %s: unexpected output", cid)
+		}
+		if len(tokens) > 2 {
+			if tokens[2] != "healthy" {
+				return fmt.Sprintf("%s is %s", strings.TrimPrefix(tokens[0], "/"), tokens[2])
+			}
+		} else if tokens[1] != "running" {
+			return fmt.Sprintf("%s is %s", strings.TrimPrefix(tokens[0], "/"), tokens[1])
+		}
+	}
+	return ""
+}
+
+// appendComposeLogs appends logs of services to the task log
+func (r *Runner) appendComposeLogs() {
+	args := append([]string{"logs", "--no-color"}, r.Compose.Services...)
+	r.composeExec(args...).MuteTask().Append().Run(nil)
+}
+
+func (r *Runner) servicesLogFile() string {
+	return r.Task.WorkFile(".services.log")
+}
+
+// followComposeLogs streams logs of services into services log file
+// while the background task lives
+func (r *Runner) followComposeLogs() {
+	out, err := os.OpenFile(r.servicesLogFile(),
+		os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		r.logf("docker-compose logs error: %v", err)
+		return
+	}
+	args := append([]string{"logs", "-f", "--no-color"}, r.Compose.Services...)
+	cmd := r.composeExec(args...).Cmd
+	w := r.Task.Plan.MaskWriter(out)
+	cmd.Stdout, cmd.Stderr = w, w
+	if err = cmd.Start(); err != nil {
+		r.logf("docker-compose logs error: %v", err)
+		out.Close()
+		return
+	}
+	r.composeLogs = cmd
+	done := make(chan struct{})
+	r.composeLogsDone = done
+	go func() {
+		cmd.Wait()
+		w.Close()
+		out.Close()
+		close(done)
+	}()
+}
+
+// dumpComposeLogs stops following and writes complete logs of services
+// into services log file
+func (r *Runner) dumpComposeLogs() {
+	if r.composeLogs != nil {
+		r.composeLogs.Process.Kill()
+		// the log file is truncated below, wait until the follower closes it
+		<-r.composeLogsDone
+		r.composeLogs, r.composeLogsDone = nil, nil
+	}
+	args := append([]string{"logs", "--no-color"}, r.Compose.Services...)
+	r.composeExec(args...).
+		MuteTask().
+		LogTo(filepath.Base(r.servicesLogFile())).
+		Run(nil)
+}
+
+// checkDuration validates durations in compose.wait
+func checkDuration(val string) error {
+	_, err := time.ParseDuration(val)
+	return err
+}
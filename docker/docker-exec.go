@@ -0,0 +1,164 @@
+package docker
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/evo-cloud/hmake/shell"
+)
+
+const (
+	// ExecSignatureLabel is the container label recording the signature of
+	// the target which the persistent exec container is created for
+	ExecSignatureLabel = "hmake.exec-signature"
+
+	// the entrypoint keeps the persistent container alive until stopped
+	persistentEntrypoint = "/bin/sh"
+	persistentScript     = "trap 'exit 0' INT TERM; while true; do sleep 3600 & wait $!; done"
+)
+
+// isPersistent indicates exec mode reuses a long-lived container
+func (r *Runner) isPersistent() bool {
+	if !r.Task.Target.Exec {
+		return false
+	}
+	settings, err := r.Task.Target.CommonSettings()
+	return err == nil && settings.ExecPersistent
+}
+
+func (r *Runner) persistentCidFile() string {
+	return r.Task.WorkFile(".exec.cid")
+}
+
+func (r *Runner) persistentCid() (cid string) {
+	data, err := ioutil.ReadFile(r.persistentCidFile())
+	if err == nil && data != nil {
+		cid = strings.TrimSpace(string(data))
+	}
+	return
+}
+
+// execSignature is the digest of runner signature, when it changes
+// the persistent container must be recreated
+func (r *Runner) execSignature() string {
+	return fmt.Sprintf("%x", sha1.Sum([]byte(r.Signature())))
+}
+
+// inspectPersistent returns whether the container is running and
+// the signature it was created with
+func (r *Runner) inspectPersistent(cid string) (running bool, signature string, err error) {
+	var out bytes.Buffer
+	err = r.dockerPiped(nil, &out, nil, "inspect", "-f",
+		`{{.State.Running}} {{index .Config.Labels "`+ExecSignatureLabel+`"}}`, cid)
+	if err != nil {
+		return
+	}
+	tokens := strings.Fields(out.String())
+	if len(tokens) > 0 {
+		running = tokens[0] == "true"
+	}
+	if len(tokens) > 1 {
+		signature = tokens[1]
+	}
+	return
+}
+
+func (r *Runner) startPersistent(signature string, sigCh <-chan os.Signal) error {
+	if err := r.checkProjectDir(); err != nil {
+		return err
+	}
+	os.Remove(r.persistentCidFile())
+	dockerCmd, passwd, err := r.createCmd(r.persistentCidFile(),
+		persistentEntrypoint, false,
+		"--label", ExecSignatureLabel+"="+signature)
+	if err != nil {
+		return err
+	}
+	dockerCmd.Add("-c", persistentScript)
+	if err = r.exec(dockerCmd.Args...).MuteOut().Run(sigCh); err != nil {
+		return err
+	}
+	cid := r.persistentCid()
+	r.logf("Persistent container %s created", cid)
+	if !r.NoPasswdPatch {
+		if err = passwd.patch(r, cid, sigCh); err != nil {
+			r.StopPersistent()
+			return err
+		}
+	}
+	if err = r.exec("start", cid).MuteOut().Run(sigCh); err != nil {
+		r.StopPersistent()
+	}
+	return err
+}
+
+// execPersistent runs the exec command inside the persistent container,
+// the container is (re)created when absent, stopped or out-of-date
+func (r *Runner) execPersistent(sigCh <-chan os.Signal) error {
+	signature := r.execSignature()
+	cid := r.persistentCid()
+	if cid != "" {
+		running, sig, err := r.inspectPersistent(cid)
+		if err != nil || !running || sig != signature {
+			r.logf("Recreate persistent container %s: running=%v, signature=%s, expected=%s, error=%v",
+				cid, running, sig, signature, err)
+			r.StopPersistent()
+			cid = ""
+		}
+	}
+	if cid == "" {
+		if err := r.startPersistent(signature, sigCh); err != nil {
+			return err
+		}
+		cid = r.persistentCid()
+	}
+
+	dockerCmd := shell.NewArgs("exec", "-i")
+	if isTerminal(os.Stdin) {
+		// unlike "docker create -t", "docker exec -t" fails without a TTY
+		dockerCmd.Add("-t")
+	}
+	for _, env := range r.Env {
+		dockerCmd.Add("-e", env)
+	}
+	for _, name := range r.Task.SecretNames() {
+		dockerCmd.Add("-e", name)
+	}
+	dockerCmd.Add(cid)
+	if args := r.Task.Target.Args; len(args) > 0 {
+		dockerCmd.Add(args...)
+	} else {
+		execShell, err := r.execShell()
+		if err != nil {
+			return err
+		}
+		dockerCmd.Add(execShell)
+	}
+	return r.exec(dockerCmd.Args...).Run(sigCh)
+}
+
+func isTerminal(f *os.File) bool {
+	st, err := f.Stat()
+	return err == nil && (st.Mode()&os.ModeCharDevice) != 0
+}
+
+// StopPersistent implements PersistentRunner
+func (r *Runner) StopPersistent() error {
+	cid := r.persistentCid()
+	if cid == "" {
+		return nil
+	}
+	r.logf("Removing persistent container %s", cid)
+	var err error
+	if _, _, e := r.inspectPersistent(cid); e == nil {
+		err = r.docker("rm", "-f", cid)
+	}
+	if err == nil {
+		os.Remove(r.persistentCidFile())
+	}
+	return err
+}
@@ -0,0 +1,196 @@
+package docker
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/evo-cloud/hmake/shell"
+)
+
+const (
+	// DefaultPushRetries is the default number of retries when push fails
+	DefaultPushRetries = 3
+	// pushBackoff is the initial interval before retrying push
+	pushBackoff = 2 * time.Second
+)
+
+// RegistryAuth defines the credentials to login registry before push
+// the credentials are never logged, nor part of the signature
+type RegistryAuth struct {
+	Registry     string `map:"registry"`
+	Username     string `map:"username"`
+	UsernameEnv  string `map:"username-env"`
+	PasswordEnv  string `map:"password-env"`
+	PasswordFile string `map:"password-file"`
+}
+
+// registryOf returns the registry server of the image,
+// empty string means the default registry (Docker Hub)
+func registryOf(image string) string {
+	pos := strings.Index(image, "/")
+	if pos < 0 {
+		return ""
+	}
+	host := image[:pos]
+	if strings.ContainsAny(host, ".:") || host == "localhost" {
+		return host
+	}
+	return ""
+}
+
+// repositoryOf strips tag or digest from image name
+func repositoryOf(image string) string {
+	if pos := strings.Index(image, "@"); pos >= 0 {
+		return image[:pos]
+	}
+	if pos := strings.LastIndex(image, ":"); pos > strings.LastIndex(image, "/") {
+		return image[:pos]
+	}
+	return image
+}
+
+func (a *RegistryAuth) server(images []string) string {
+	if a.Registry != "" || len(images) == 0 {
+		return a.Registry
+	}
+	return registryOf(images[0])
+}
+
+func (a *RegistryAuth) credentials(baseDir string) (username, password string, err error) {
+	username = a.Username
+	if a.UsernameEnv != "" {
+		username = os.Getenv(a.UsernameEnv)
+	}
+	if username == "" {
+		return "", "", fmt.Errorf("registry-auth: username missing")
+	}
+	switch {
+	case a.PasswordEnv != "":
+		password = os.Getenv(a.PasswordEnv)
+	case a.PasswordFile != "":
+		fn := a.PasswordFile
+		if !filepath.IsAbs(fn) {
+			fn = filepath.Join(baseDir, fn)
+		}
+		var data []byte
+		if data, err = ioutil.ReadFile(fn); err != nil {
+			// only the name of file is reported
+			return "", "", fmt.Errorf("registry-auth: read password-file %s failed", a.PasswordFile)
+		}
+		password = strings.TrimRight(string(data), "\r\n")
+	}
+	if password == "" {
+		return "", "", fmt.Errorf("registry-auth: password missing")
+	}
+	return
+}
+
+func (r *Runner) pushRetries() int {
+	if r.PushRetries != nil {
+		return *r.PushRetries
+	}
+	return DefaultPushRetries
+}
+
+func (r *Runner) login(sigCh <-chan os.Signal) error {
+	username, password, err := r.RegistryAuth.credentials(r.Task.Project().BaseDir)
+	if err != nil {
+		return err
+	}
+	cmd := shell.NewArgs("login", "--username", username, "--password-stdin")
+	if server := r.RegistryAuth.server(r.Push); server != "" {
+		cmd.Add(server)
+	}
+	var out bytes.Buffer
+	if err = r.dockerPiped(strings.NewReader(password), &out, sigCh, cmd.Args...); err != nil {
+		return fmt.Errorf("docker login failed: %v", err)
+	}
+	return nil
+}
+
+func (r *Runner) pushImage(img string, sigCh <-chan os.Signal) (err error) {
+	backoff := pushBackoff
+	for n := 0; ; n++ {
+		cmd := shell.NewArgs("push", img)
+		if err = r.exec(cmd.Args...).Run(sigCh); err == nil || n >= r.pushRetries() {
+			return
+		}
+		r.logf("docker push %s failed: %v, retry in %v", img, err, backoff)
+		fmt.Fprintf(r.Task, "push %s failed, retry in %v\n", img, backoff)
+		select {
+		case sig := <-sigCh:
+			return fmt.Errorf("push %s interrupted by %v", img, sig)
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (r *Runner) digestsFile() string {
+	return r.Task.WorkFile(".digests")
+}
+
+// repoDigest finds the digest of the pushed image from RepoDigests
+func (r *Runner) repoDigest(img string) (string, error) {
+	var out bytes.Buffer
+	err := r.dockerPiped(nil, &out, nil, "inspect", "-f", "{{json .RepoDigests}}", img)
+	if err != nil {
+		return "", err
+	}
+	var digests []string
+	if err = json.Unmarshal(out.Bytes(), &digests); err != nil {
+		return "", err
+	}
+	repo := repositoryOf(img)
+	for _, digest := range digests {
+		if repositoryOf(digest) == repo {
+			return digest, nil
+		}
+	}
+	return "", fmt.Errorf("digest of %s not found", img)
+}
+
+func (r *Runner) push(sigCh <-chan os.Signal) error {
+	os.Remove(r.digestsFile())
+	if r.RegistryAuth != nil {
+		if err := r.login(sigCh); err != nil {
+			return err
+		}
+	}
+	var digests bytes.Buffer
+	for _, img := range r.Push {
+		if err := r.pushImage(img, sigCh); err != nil {
+			return err
+		}
+		digest, err := r.repoDigest(img)
+		if err != nil {
+			return fmt.Errorf("verify pushed image %s failed: %v", img, err)
+		}
+		fmt.Fprintf(&digests, "%s %s\n", img, digest)
+	}
+	return ioutil.WriteFile(r.digestsFile(), digests.Bytes(), 0644)
+}
+
+// DryRun implements DryRunner
+func (r *Runner) DryRun() error {
+	if r.Image == "" || r.Task.Target.Exec || len(r.Push) == 0 {
+		return nil
+	}
+	if r.RegistryAuth != nil {
+		server := r.RegistryAuth.server(r.Push)
+		if server == "" {
+			server = "default registry"
+		}
+		fmt.Fprintf(r.Task, "would login %s\n", server)
+	}
+	for _, img := range r.Push {
+		fmt.Fprintf(r.Task, "would push %s\n", img)
+	}
+	return nil
+}
@@ -4,10 +4,14 @@ import (
 	"archive/tar"
 	"bufio"
 	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
+	"os/exec"
 	"os/user"
 	"path/filepath"
 	"sort"
@@ -23,8 +27,8 @@ import (
 const (
 	// ExecDriverName is name of exec-driver
 	ExecDriverName = "docker"
-	// DefaultSrcVolume is the default source path inside the container
-	DefaultSrcVolume = "/src"
+	// DefaultSrcDir is the default source path inside the container
+	DefaultSrcDir = "/src"
 	// SettingName is the name of section of settings
 	SettingName = "docker"
 	// Dockerfile is default name of Dockerfile
@@ -33,14 +37,17 @@ const (
 
 // ComposeConfig defines docker-compose parameters
 type ComposeConfig struct {
-	File          string   `map:"file"`
-	ProjectName   string   `map:"project-name"`
-	Services      []string `map:"services"`
-	Deps          *bool    `map:"deps"`
-	Recreate      *bool    `map:"recreate"`
-	ForceRecreate string   `map:"recreate"`
-	Build         *bool    `map:"build"`
-	RemoveOrphans bool     `map:"remove-orphans"`
+	File          string       `map:"file"`
+	Files         []string     `map:"file"`
+	Profiles      []string     `map:"profiles"`
+	ProjectName   string       `map:"project-name"`
+	Services      []string     `map:"services"`
+	Deps          *bool        `map:"deps"`
+	Recreate      *bool        `map:"recreate"`
+	ForceRecreate bool         `map:"force-recreate"`
+	Build         *bool        `map:"build"`
+	RemoveOrphans bool         `map:"remove-orphans"`
+	Wait          *ComposeWait `map:"wait"`
 }
 
 // Runner is a docker runner
@@ -52,6 +59,8 @@ type Runner struct {
 	BuildArgs         []string       `map:"build-args"`
 	Commits           []string       `map:"commit"`
 	Push              []string       `map:"push"`
+	PushRetries       *int           `map:"push-retries"`
+	RegistryAuth      *RegistryAuth  `map:"registry-auth"`
 	Tags              []string       `map:"tags"`
 	Labels            []string       `map:"labels"`
 	LabelFiles        []string       `map:"label-files"`
@@ -60,7 +69,7 @@ type Runner struct {
 	Cache             *bool          `map:"cache"`
 	ContentTrust      *bool          `map:"content-trust"`
 	Image             string         `map:"image"`
-	SrcVolume         string         `map:"src-volume"`
+	SrcDir            string         `map:"src-dir"`
 	ExposeDocker      bool           `map:"expose-docker"`
 	Env               []string       `map:"env"`
 	EnvFiles          []string       `map:"env-files"`
@@ -96,6 +105,9 @@ type Runner struct {
 	MemorySwappiness  *int           `map:"memory-swappiness"`
 	ShmSize           string         `map:"shm-size"`
 	ULimit            []string       `map:"ulimit"`
+	Save              string         `map:"save"`
+	SaveImages        []string       `map:"save-images"`
+	Load              []string       `map:"load"`
 	Compose           *ComposeConfig `map:"compose"`
 	ComposeFile       string         `map:"compose"`
 
@@ -105,6 +117,9 @@ type Runner struct {
 	projectDir  string
 	composeDir  string
 	composeArgs []string
+	composeLogs *exec.Cmd
+	// composeLogsDone is closed when following logs ends
+	composeLogsDone chan struct{}
 }
 
 func (r *Runner) logf(format string, args ...interface{}) {
@@ -151,7 +166,7 @@ func (r *Runner) exposeDockerEnv() {
 }
 
 func (r *Runner) cidFile() string {
-	return filepath.Join(r.Task.Plan.WorkPath, r.Task.Name()+".cid")
+	return r.Task.WorkFile(".cid")
 }
 
 func (r *Runner) cid() (cid string) {
@@ -164,8 +179,9 @@ func (r *Runner) cid() (cid string) {
 
 func (r *Runner) exec(args ...string) *shell.Executor {
 	x := shell.Exec(r.Task, "docker", args...)
-	// env are passed with -e, no need for docker client
-	x.Cmd.Env = os.Environ()
+	// env are passed with -e, no need for docker client,
+	// except secrets which are passed with names only
+	x.Cmd.Env = append(os.Environ(), r.Task.SecretEnv()...)
 	return x
 }
 
@@ -260,9 +276,21 @@ func (r *Runner) Run(sigCh <-chan os.Signal) (result hm.TaskResult, err error) {
 	if r.Compose != nil {
 		result = hm.Started
 		err = r.composeUp(sigCh)
+		if err == nil {
+			r.followComposeLogs()
+		}
+		if err == nil && r.Compose.Wait != nil {
+			err = r.composeWait(sigCh)
+		}
 	}
 
-	if r.Image != "" {
+	if err == nil && len(r.Load) > 0 {
+		err = r.load(sigCh)
+	}
+
+	if err == nil && r.Image != "" && r.isPersistent() {
+		err = r.execPersistent(sigCh)
+	} else if err == nil && r.Image != "" {
 		os.Remove(r.cidFile())
 		if r.Task.Target.Exec {
 			err = r.run(sigCh)
@@ -279,12 +307,24 @@ func (r *Runner) Run(sigCh <-chan os.Signal) (result hm.TaskResult, err error) {
 			if err == nil && len(r.Push) > 0 {
 				err = r.push(sigCh)
 			}
+			if err == nil && r.Save != "" {
+				err = r.save(sigCh)
+			}
 		}
 		r.removeContainer()
 	}
 
+	// without image, the images loaded or from compose are saved
+	if err == nil && r.Image == "" && r.Save != "" {
+		err = r.save(sigCh)
+	}
+
 	if err != nil {
 		result = hm.Failure
+		// background task not started is never stopped by the plan
+		if r.Compose != nil {
+			r.Stop()
+		}
 	}
 	return
 }
@@ -352,9 +392,59 @@ func (r *Runner) commit(sigCh <-chan os.Signal) error {
 	return nil
 }
 
-func (r *Runner) push(sigCh <-chan os.Signal) error {
-	for _, img := range r.Push {
-		cmd := shell.NewArgs("push", img)
+// projectFile translates the path relative to the target to full path
+func (r *Runner) projectFile(path string) string {
+	return filepath.Join(r.Task.Project().BaseDir, r.Task.Target.ProjectPath(path))
+}
+
+// savedImages returns images to be saved, defaults to the images produced
+func (r *Runner) savedImages() []string {
+	if len(r.SaveImages) > 0 {
+		return r.SaveImages
+	}
+	if len(r.Commits) > 0 {
+		return r.Commits
+	}
+	images := []string{r.Image}
+	if r.Build != "" {
+		images = append(images, r.Tags...)
+	}
+	return images
+}
+
+func (r *Runner) save(sigCh <-chan os.Signal) error {
+	fn := r.projectFile(r.Save)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	images := r.savedImages()
+	if !strings.HasSuffix(fn, ".gz") && !strings.HasSuffix(fn, ".tgz") {
+		cmd := shell.NewArgs("save", "-o", fn)
+		cmd.Add(images...)
+		return r.exec(cmd.Args...).Run(sigCh)
+	}
+	r.logf("docker save %v | gzip > %s", images, fn)
+	f, err := os.Create(fn)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(f)
+	err = r.dockerPiped(nil, zw, sigCh, append([]string{"save"}, images...)...)
+	if e := zw.Close(); err == nil {
+		err = e
+	}
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		os.Remove(fn)
+	}
+	return err
+}
+
+func (r *Runner) load(sigCh <-chan os.Signal) error {
+	for _, path := range r.Load {
+		cmd := shell.NewArgs("load", "-i", r.projectFile(path))
 		if err := r.exec(cmd.Args...).Run(sigCh); err != nil {
 			return err
 		}
@@ -362,44 +452,130 @@ func (r *Runner) push(sigCh <-chan os.Signal) error {
 	return nil
 }
 
+// loadDigests computes the content hash of tarballs to be loaded
+func (r *Runner) loadDigests() []string {
+	digests := make([]string, 0, len(r.Load))
+	for _, path := range r.Load {
+		digest := ""
+		if f, err := os.Open(r.projectFile(path)); err == nil {
+			h := sha256.New()
+			if _, err = io.Copy(h, f); err == nil {
+				digest = hex.EncodeToString(h.Sum(nil))
+			}
+			f.Close()
+		}
+		digests = append(digests, path+":"+digest)
+	}
+	return digests
+}
+
 func (r *Runner) run(sigCh <-chan os.Signal) error {
 	err := r.checkProjectDir()
 	if err != nil {
 		return err
 	}
 
-	workDir := filepath.Join(r.SrcVolume, r.Task.Target.WorkingDir())
-	dockerCmd := shell.NewArgs("create",
-		"-v", r.canonicalProjectDir()+":"+r.SrcVolume,
-		"-w", filepath.ToSlash(workDir),
-		"--cidfile", r.cidFile(),
-	)
-
 	execArgs := r.Task.Target.Args
-	dockerCmd.Add("--entrypoint")
+	var entrypoint string
 	if r.Task.Target.Exec {
 		if len(execArgs) > 0 {
-			dockerCmd.Add(execArgs[0])
+			entrypoint = execArgs[0]
 			execArgs = execArgs[1:]
-		} else {
-			settings, e := r.Task.Target.CommonSettings()
-			if e != nil {
-				return e
-			}
-			if settings.ExecShell == "" {
-				settings.ExecShell = "/bin/sh"
-			}
-			dockerCmd.Add(settings.ExecShell)
+		} else if entrypoint, err = r.execShell(); err != nil {
+			return err
 		}
 	} else {
-		dockerCmd.Add(filepath.ToSlash(filepath.Join(r.SrcVolume, hm.WorkFolder,
-			filepath.Base(shell.ScriptFile(r.Task)))))
+		entrypoint = filepath.ToSlash(filepath.Join(r.SrcDir, hm.WorkFolder,
+			filepath.Base(shell.ScriptFile(r.Task))))
 	}
 
-	// support console
+	console := r.console()
+	dockerCmd, passwd, err := r.createCmd(r.cidFile(), entrypoint, console)
+	if err != nil {
+		return err
+	}
+	dockerCmd.Add(execArgs...)
+
+	if !r.Task.Target.Exec {
+		script, e := shell.BuildScriptFile(r.Task)
+		if e != nil || script == "" {
+			return e
+		}
+	}
+
+	// create container
+	if err = r.exec(dockerCmd.Args...).MuteOut().Run(sigCh); err != nil {
+		return err
+	}
+
+	if !r.NoPasswdPatch {
+		if err = passwd.patch(r, r.cid(), sigCh); err != nil {
+			return err
+		}
+	}
+
+	dockerCmd = shell.NewArgs("start", "-a")
+	if console {
+		dockerCmd.Add("-i")
+	}
+	dockerCmd.Add(r.cid())
+
+	x := r.exec(dockerCmd.Args...)
+
+	if console {
+		// tty mode, CtrlC is handled by docker client
+		err = x.Run(sigCh)
+	} else {
+		// non-tty mode, CtrlC is not handled properly
+		ch := make(chan struct{})
+		sigRelay := make(chan os.Signal, 1)
+		go func() {
+			for {
+				select {
+				case <-ch:
+					return
+				case sig := <-sigCh:
+					r.signal(sig, sigRelay)
+				}
+			}
+		}()
+		err = x.Run(sigRelay)
+		close(ch)
+	}
+	return err
+}
+
+// execShell returns the shell used in exec mode when no command is specified
+func (r *Runner) execShell() (string, error) {
+	settings, err := r.Task.Target.CommonSettings()
+	if err != nil {
+		return "", err
+	}
+	if settings.ExecShell == "" {
+		settings.ExecShell = "/bin/sh"
+	}
+	return settings.ExecShell, nil
+}
+
+// console indicates the container should be attached to current console
+func (r *Runner) console() bool {
 	var shellTarget shell.Target
 	r.Task.Target.GetExt(&shellTarget)
-	console := r.Task.Target.Exec || shellTarget.Console
+	return r.Task.Target.Exec || shellTarget.Console
+}
+
+// createCmd builds the command line of "docker create" with the image as
+// the last argument, options in extra are inserted before image
+func (r *Runner) createCmd(cidFile, entrypoint string, console bool, extra ...string) (*shell.Args, *passwdPatcher, error) {
+	workDir := filepath.Join(r.SrcDir, r.Task.Target.WorkingDir())
+	dockerCmd := shell.NewArgs("create",
+		"-v", r.canonicalProjectDir()+":"+r.SrcDir,
+		"-w", filepath.ToSlash(workDir),
+		"--cidfile", cidFile,
+		"--entrypoint", entrypoint,
+	)
+
+	// support console
 	if console {
 		dockerCmd.Add("-it")
 	} else {
@@ -410,8 +586,8 @@ func (r *Runner) run(sigCh <-chan os.Signal) error {
 
 	// by default, use non-root user
 	if r.User == "" {
-		if e := passwd.current(); e != nil {
-			return e
+		if err := passwd.current(); err != nil {
+			return nil, nil, err
 		}
 		dockerCmd.Add("-u", passwd.user())
 		if len(r.Groups) == 0 {
@@ -422,8 +598,8 @@ func (r *Runner) run(sigCh <-chan os.Signal) error {
 			}
 		}
 	} else if r.User != "root" && r.User != "0" {
-		if e := passwd.parse(r.User); e != nil {
-			return e
+		if err := passwd.parse(r.User); err != nil {
+			return nil, nil, err
 		}
 		dockerCmd.Add("-u", passwd.user())
 	}
@@ -434,12 +610,16 @@ func (r *Runner) run(sigCh <-chan os.Signal) error {
 
 	for _, envFile := range r.EnvFiles {
 		dockerCmd.Add("--env-file",
-			filepath.Join(r.SrcVolume, r.Task.Target.WorkingDir(envFile)))
+			filepath.Join(r.SrcDir, r.Task.Target.WorkingDir(envFile)))
 	}
 
 	for _, env := range r.Env {
 		dockerCmd.Add("-e", env)
 	}
+	// values of secrets are passed through environment of docker client
+	for _, name := range r.Task.SecretNames() {
+		dockerCmd.Add("-e", name)
+	}
 
 	if r.Network != "" {
 		dockerCmd.Add("--net", r.Network)
@@ -526,61 +706,22 @@ func (r *Runner) run(sigCh <-chan os.Signal) error {
 		dockerCmd.Add("--memory-reservation", r.MemoryReservation)
 	}
 
+	dockerCmd.Add(extra...)
 	dockerCmd.Add(r.Image)
-	dockerCmd.Add(execArgs...)
-
-	if !r.Task.Target.Exec {
-		script, e := shell.BuildScriptFile(r.Task)
-		if e != nil || script == "" {
-			return e
-		}
-	}
-
-	// create container
-	if err = r.exec(dockerCmd.Args...).MuteOut().Run(sigCh); err != nil {
-		return err
-	}
-
-	if !r.NoPasswdPatch {
-		if err = passwd.patch(r, sigCh); err != nil {
-			return err
-		}
-	}
-
-	dockerCmd = shell.NewArgs("start", "-a")
-	if console {
-		dockerCmd.Add("-i")
-	}
-	dockerCmd.Add(r.cid())
-
-	x := r.exec(dockerCmd.Args...)
-
-	if console {
-		// tty mode, CtrlC is handled by docker client
-		err = x.Run(sigCh)
-	} else {
-		// non-tty mode, CtrlC is not handled properly
-		ch := make(chan struct{})
-		sigRelay := make(chan os.Signal, 1)
-		go func() {
-			for {
-				select {
-				case <-ch:
-					return
-				case sig := <-sigCh:
-					r.signal(sig, sigRelay)
-				}
-			}
-		}()
-		err = x.Run(sigRelay)
-		close(ch)
-	}
-	return err
+	return dockerCmd, &passwd, nil
 }
 
 func (r *Runner) parseCompose() error {
 	var args []string
-	if r.Compose.File != "" {
+	if r.Compose.File == "" && len(r.Compose.Files) == 1 {
+		r.Compose.File = r.Compose.Files[0]
+	}
+	if len(r.Compose.Files) > 1 {
+		// multiple files are relative to project root
+		for _, fn := range r.Compose.Files {
+			args = append(args, "-f", filepath.FromSlash(fn))
+		}
+	} else if r.Compose.File != "" {
 		fn := filepath.Join(r.Task.Project().BaseDir, r.Compose.File)
 		info, err := os.Stat(fn)
 		if err != nil {
@@ -596,6 +737,9 @@ func (r *Runner) parseCompose() error {
 	if r.Compose.ProjectName != "" {
 		args = append(args, "-p", r.Compose.ProjectName)
 	}
+	for _, profile := range r.Compose.Profiles {
+		args = append(args, "--profile", profile)
+	}
 
 	// save for future
 	r.composeArgs = args
@@ -604,8 +748,10 @@ func (r *Runner) parseCompose() error {
 }
 
 func (r *Runner) composeExec(args ...string) *shell.Executor {
-	x := shell.Exec(r.Task, "docker-compose", append(r.composeArgs, args...)...)
-	x.Cmd.Env = os.Environ()
+	command, cmdArgs := composeCommand()
+	cmdArgs = append(cmdArgs, r.composeArgs...)
+	x := shell.Exec(r.Task, command, append(cmdArgs, args...)...)
+	x.Cmd.Env = append(os.Environ(), r.Task.SecretEnv()...)
 	x.Cmd.Dir = filepath.Join(r.Task.Project().BaseDir, r.composeDir)
 	return x
 }
@@ -615,7 +761,7 @@ func (r *Runner) composeUp(sigCh <-chan os.Signal) error {
 	if r.Compose.Deps != nil && !*r.Compose.Deps {
 		args.Add("--no-deps")
 	}
-	if r.Compose.Recreate == nil && r.Compose.ForceRecreate == "force" {
+	if r.Compose.ForceRecreate {
 		args.Add("--force-recreate")
 	}
 	if r.Compose.Recreate != nil && !*r.Compose.Recreate {
@@ -650,6 +796,9 @@ func (r *Runner) Signature() string {
 	if err != nil {
 		panic(err)
 	}
+	// credentials and retries don't affect the result
+	delete(dict, "registry-auth")
+	delete(dict, "push-retries")
 	keys := make([]string, 0, len(dict))
 	for k, v := range dict {
 		keys = append(keys, k)
@@ -657,6 +806,9 @@ func (r *Runner) Signature() string {
 		case "commit", "push", "tags", "labels", "label-files",
 			"cap-add", "cap-drop", "devices":
 			dict[k] = sortStrs(v.([]string))
+		case "load":
+			// content of tarballs affects the signature
+			dict[k] = r.loadDigests()
 		case "env":
 			// environment variables need special handling
 			// skip environment variables which changes but
@@ -716,15 +868,23 @@ func (r *Runner) ValidateArtifacts() bool {
 		}
 		r.logf("docker artifact ok: %s", image)
 	}
+	if r.Save != "" {
+		if _, err := os.Stat(r.projectFile(r.Save)); err != nil {
+			r.logf("docker artifact invalid: %s: %v", r.Save, err)
+			return false
+		}
+		r.logf("docker artifact ok: %s", r.Save)
+	}
 	return true
 }
 
 // Stop implements BackgroundRunner
 func (r *Runner) Stop() error {
 	if r.Compose != nil {
+		r.dumpComposeLogs()
 		return r.composeExec("down").
 			MuteTask().
-			LogTo(r.Task.Name() + "docker-compose.log").
+			LogTo(r.Task.Target.LocalName() + "docker-compose.log").
 			Run(nil)
 	}
 	return nil
@@ -740,17 +900,28 @@ func Factory(task *hm.Task) (hm.Runner, error) {
 
 	if r.Compose == nil && r.ComposeFile != "" {
 		r.Compose = &ComposeConfig{File: r.ComposeFile}
+	}
+	if r.Compose != nil {
 		if err := r.parseCompose(); err != nil {
 			return nil, err
 		}
 	}
 
-	if r.Image == "" && r.Compose == nil {
+	if r.Image == "" && r.Compose == nil && len(r.Load) == 0 {
 		return nil, fmt.Errorf("missing property image")
 	}
+	if r.Save != "" && r.Image == "" && len(r.SaveImages) == 0 {
+		return nil, fmt.Errorf("missing property image or save-images for save")
+	}
 
-	if r.SrcVolume == "" {
-		r.SrcVolume = DefaultSrcVolume
+	if r.Compose != nil && r.Compose.Wait != nil {
+		if err := r.Compose.Wait.parse(); err != nil {
+			return nil, err
+		}
+	}
+
+	if r.SrcDir == "" {
+		r.SrcDir = DefaultSrcDir
 	}
 	if r.ExposeDocker {
 		r.exposeDocker()
@@ -758,14 +929,14 @@ func Factory(task *hm.Task) (hm.Runner, error) {
 	for name, value := range task.Plan.Env {
 		r.addEnv(name + "=" + value)
 	}
-	r.addEnv("HMAKE_PROJECT_DIR=" + r.SrcVolume)
+	r.addEnv(task.EnvVars()...)
+	r.addEnv("HMAKE_PROJECT_DIR=" + r.SrcDir)
 	r.addEnv("HMAKE_PROJECT_FILE=" +
-		filepath.ToSlash(filepath.Join(r.SrcVolume,
+		filepath.ToSlash(filepath.Join(r.SrcDir,
 			filepath.Base(task.Project().MasterFile.Source))))
 	r.addEnv("HMAKE_WORK_DIR=" +
-		filepath.Join(r.SrcVolume,
+		filepath.Join(r.SrcDir,
 			filepath.Base(task.Plan.WorkPath)))
-	r.addEnv(task.EnvVars()...)
 
 	r.projectDir = filepath.Clean(task.Project().BaseDir)
 	volHost := os.Getenv("HMAKE_DOCKER_VOL_HOST")
@@ -778,7 +949,7 @@ func Factory(task *hm.Task) (hm.Runner, error) {
 		}
 	}
 	r.addEnv("HMAKE_DOCKER_VOL_HOST=" + r.canonicalProjectDir())
-	r.addEnv("HMAKE_DOCKER_VOL_CNTR=" + r.SrcVolume)
+	r.addEnv("HMAKE_DOCKER_VOL_CNTR=" + r.SrcDir)
 	return r, nil
 }
 
@@ -807,7 +978,7 @@ func (p *passwdPatcher) addGroup(grp string) {
 	}
 }
 
-func (p *passwdPatcher) patch(r *Runner, sigCh <-chan os.Signal) (err error) {
+func (p *passwdPatcher) patch(r *Runner, cid string, sigCh <-chan os.Signal) (err error) {
 	if p.uid == 0 {
 		// no need
 		return
@@ -815,7 +986,7 @@ func (p *passwdPatcher) patch(r *Runner, sigCh <-chan os.Signal) (err error) {
 	uidStr := strconv.Itoa(p.uid)
 
 	var out bytes.Buffer
-	err = r.dockerPiped(nil, &out, sigCh, "cp", r.cid()+":/etc/passwd", "-")
+	err = r.dockerPiped(nil, &out, sigCh, "cp", cid+":/etc/passwd", "-")
 	if err != nil {
 		return
 	}
@@ -862,7 +1033,7 @@ func (p *passwdPatcher) patch(r *Runner, sigCh <-chan os.Signal) (err error) {
 	}
 	w.Close()
 
-	err = r.dockerPiped(bytes.NewBuffer(gen.Bytes()), nil, sigCh, "cp", "-", r.cid()+":/etc")
+	err = r.dockerPiped(bytes.NewBuffer(gen.Bytes()), nil, sigCh, "cp", "-", cid+":/etc")
 
 	return
 }
@@ -898,4 +1069,13 @@ func userID(name string) (uid, gid int, err error) {
 
 func init() {
 	hm.RegisterExecDriver(ExecDriverName, Factory)
+
+	schema := hm.SchemaOf(&Runner{}, &shell.Target{})
+	schema.Property("compose", "wait", "timeout").Check = checkDuration
+	schema.Property("compose", "wait", "interval").Check = checkDuration
+	hm.RegisterExecDriverSchema(ExecDriverName, schema)
+	hm.RegisterDeprecations(ExecDriverName,
+		hm.Deprecation{Path: []string{"src-volume"}, Replace: "src-dir"},
+		hm.Deprecation{Path: []string{"compose", "recreate"}, Value: "force", Replace: "force-recreate", NewValue: true},
+	)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+	"github.com/evo-cloud/hmake/server"
+)
+
+// selectChanged sets the changed files into the run request with
+// --changed-since or --changed-files
+func (c *makeCmd) selectChanged(p *hm.Project, req *server.RunRequest) (err error) {
+	switch {
+	case c.ChangedSince != "" && c.ChangedFiles != "":
+		return fmt.Errorf("--changed-since and --changed-files can't be used together")
+	case c.ChangedSince != "":
+		req.Changes, err = p.GitChangedFiles(c.ChangedSince)
+	case c.ChangedFiles != "":
+		req.Changes, err = hm.ReadChangedFiles(c.ChangedFiles)
+	default:
+		return nil
+	}
+	req.SelectChanged = err == nil
+	return
+}
+
+// showChangedSelection prints the targets selected by the changed files
+// with --dryrun, or if no targets are affected
+func (c *makeCmd) showChangedSelection(req *server.RunRequest, targets []string) {
+	if !req.SelectChanged || c.JSON || c.Quiet || (!c.DryRun && len(targets) > 0) {
+		return
+	}
+	out := term.NewPrinter(term.Std)
+	out.Styles(term.StyleLo).Printf("%d file(s) changed, ", len(req.Changes)).Pop()
+	if len(targets) == 0 {
+		out.Styles(term.StyleOK).Println("no targets affected").Pop()
+		return
+	}
+	out.Print("selected targets: ").Styles(term.StyleB).Println(strings.Join(targets, " ")).Pop()
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/codingbrain/clix.go/term"
+	"github.com/easeway/langx.go/errors"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// clean removes artifacts and state of the targets, or all targets
+// if none is specified, with --dryrun, the items are only listed
+func (c *makeCmd) clean(p *hm.Project, args []string) error {
+	errs := &errors.AggregatedError{}
+	names := p.Targets.CompleteNames(p.QualifyNames(args, errs), errs)
+	for _, name := range names {
+		if p.Targets[name] == nil {
+			errs.Add(fmt.Errorf("target %s not defined", name))
+		}
+	}
+	if err := errs.Aggregate(); err != nil {
+		return err
+	}
+
+	plan := p.Plan()
+	plan.DryRun = c.DryRun
+	plan.LockMode = c.Lock
+	items := plan.CleanItems(names, c.Dependents)
+
+	out := term.NewPrinter(term.Std)
+	if len(items) == 0 {
+		out.Styles(term.StyleOK).Println("nothing to clean").Pop()
+		return nil
+	}
+	return plan.Clean(items, func(item *hm.CleanItem, err error) {
+		switch {
+		case c.DryRun:
+			out.Print("would remove ")
+		case err != nil:
+			out.Styles(term.StyleErr).Print("failed to remove ").Pop()
+		default:
+			out.Styles(term.StyleOK).Print("removed ").Pop()
+		}
+		out.Styles(term.StyleLo).Printf("[%s] ", item.Task.Name()).Pop().
+			Print(item.Kind + " ").
+			Styles(term.StyleB).Println(item.Name).Pop()
+	})
+}
@@ -18,11 +18,73 @@ func (x *execFilterExt) RegisterExt(parser *flag.Parser) {
 
 func (x *execFilterExt) HandleParseEvent(event string, ctx *flag.ParseContext) {
 	if ctx.Option != nil &&
-		strings.HasPrefix(ctx.Option.Name, "exec") {
+		(ctx.Option.Name == "exec" || ctx.Option.Name == "exec-with") {
 		ctx.ParseEnd()
 	}
 }
 
+func findOption(def *flag.CliDef, arg string) *flag.Option {
+	for _, opt := range def.Cli.Options {
+		if strings.HasPrefix(arg, "--") {
+			name := strings.SplitN(arg[2:], "=", 2)[0]
+			if name == opt.Name || (opt.Type == "bool" && name == "no-"+opt.Name) {
+				return opt
+			}
+			continue
+		}
+		for _, alias := range opt.Alias {
+			if arg == "-"+alias {
+				return opt
+			}
+		}
+	}
+	return nil
+}
+
+// commandArgs moves the arguments after the first target which are not
+// options of hmake (including --help) after "--", so they are passed to
+// the command, e.g. "hmake deploy --env=prod --help"
+func commandArgs(def *flag.CliDef, args []string) []string {
+	var result, moved []string
+	target := false
+	for n := 0; n < len(args); n++ {
+		arg := args[n]
+		if arg == "--" {
+			result = append(result, args[n:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			target = true
+			result = append(result, arg)
+			continue
+		}
+		opt := findOption(def, arg)
+		if target && (opt == nil || arg == "--help" || arg == "-h") {
+			moved = append(moved, arg)
+			continue
+		}
+		result = append(result, arg)
+		if opt != nil && (opt.Name == "exec" || opt.Name == "exec-with") {
+			// the rest is the command to execute
+			result = append(result, args[n+1:]...)
+			break
+		}
+		if opt != nil && opt.Type != "bool" && !strings.HasPrefix(arg, "--") && n+1 < len(args) {
+			n++
+			result = append(result, args[n])
+		}
+	}
+	if len(moved) == 0 {
+		return result
+	}
+	for n, arg := range result {
+		if arg == "--" {
+			return append(append(append([]string{}, result[:n+1]...), moved...), result[n+1:]...)
+		}
+	}
+	return append(append(result, "--"), moved...)
+}
+
 func cliDef(cmd *makeCmd) *flag.CliDef {
 	d := &flag.CliDef{
 		Cli: &flag.Command{
@@ -54,7 +116,7 @@ func cliDef(cmd *makeCmd) *flag.CliDef {
 					Name:    "property",
 					Alias:   []string{"P"},
 					Desc:    "Define additional setting property",
-					Example: "--property docker.src-volume=/tmp/src -P docker.image=myimage",
+					Example: "--property docker.src-dir=/tmp/src -P docker.image=myimage",
 					Type:    "dict",
 					Tags:    map[string]interface{}{"help-var": "KEY=VAL"},
 				},
@@ -116,6 +178,22 @@ func cliDef(cmd *makeCmd) *flag.CliDef {
 					Example: "hmake --exec-with=vendor go version\n",
 					Type:    "string",
 				},
+				&flag.Option{
+					Name: "keep",
+					Desc: "Keep the container of exec target running and reuse it " +
+						"for later --exec, same as settings.exec-persistent.\n" +
+						"The container is recreated when the target changes.",
+					Example: "hmake --keep -x go version",
+					Type:    "bool",
+				},
+				&flag.Option{
+					Name: "exec-stop",
+					Desc: "Stop and remove the container kept by --keep " +
+						"for the exec target",
+					Example: "hmake --exec-stop\n" +
+						"hmake --exec-stop --exec-with=vendor",
+					Type: "bool",
+				},
 				&flag.Option{
 					Name:    "rcfile",
 					Desc:    "Load .hmakerc files inside project directories",
@@ -146,6 +224,22 @@ func cliDef(cmd *makeCmd) *flag.CliDef {
 					Desc:  "Display less information, suppress the output",
 					Type:  "bool",
 				},
+				&flag.Option{
+					Name: "output",
+					Desc: "How the output of targets is printed: stream (default) prints " +
+						"the output as it comes, grouped prints the output of each target " +
+						"as one block when it finishes, failed-only only prints the output of failed targets",
+					Example: "hmake --output=grouped",
+					Default: outputStream,
+					Tags:    map[string]interface{}{"help-var": "MODE"},
+				},
+				&flag.Option{
+					Name: "tui",
+					Desc: "Show the progress of targets in an interactive dashboard " +
+						"when running in a terminal, --no-tui prints the output of targets line by line",
+					Type:    "bool",
+					Default: true,
+				},
 				&flag.Option{
 					Name:    "banner",
 					Desc:    "Show banner",
@@ -180,6 +274,79 @@ func cliDef(cmd *makeCmd) *flag.CliDef {
 					Desc: "Print targets and exit",
 					Type: "bool",
 				},
+				&flag.Option{
+					Name:    "show-origin",
+					Desc:    "Show where the values come from with config get/list",
+					Example: "hmake config list --show-origin",
+					Type:    "bool",
+				},
+				&flag.Option{
+					Name:    "system",
+					Desc:    "Write the system-level configuration with config set",
+					Example: "hmake config set --system options.parallel 4",
+					Type:    "bool",
+				},
+				&flag.Option{
+					Name: "listen",
+					Desc: "Serve on the TCP address instead of the unix socket " +
+						"in .hmake with serve, requiring the token in .hmake/serve.token",
+					Example: "hmake serve --listen=localhost:8080",
+					Tags:    map[string]interface{}{"help-var": "ADDR"},
+				},
+				&flag.Option{
+					Name: "daemon",
+					Desc: "Run targets by hmake serve of the project if it's running, " +
+						"--no-daemon always runs locally",
+					Type:    "bool",
+					Default: true,
+				},
+				&flag.Option{
+					Name: "lock",
+					Desc: "Lock mode: project (default) allows only one hmake running " +
+						"in the project, target only locks targets being executed so " +
+						"plans without overlapping targets run concurrently, none disables locking",
+					Example: "hmake --lock=target test",
+					Tags:    map[string]interface{}{"help-var": "MODE"},
+				},
+				&flag.Option{
+					Name:    "dependents",
+					Desc:    "Also clean the targets depending on specified targets with clean",
+					Example: "hmake clean --dependents vendor",
+					Type:    "bool",
+				},
+				&flag.Option{
+					Name: "changed-since",
+					Desc: "Only run the targets affected by the files changed since the " +
+						"merge base of the git revision and HEAD, including uncommitted files",
+					Example: "hmake --changed-since=origin/master test",
+					Tags:    map[string]interface{}{"help-var": "REV"},
+				},
+				&flag.Option{
+					Name: "changed-files",
+					Desc: "Only run the targets affected by the files listed in FILE " +
+						"(one path relative to the project root per line, - for stdin)",
+					Example: "git diff --name-only --relative HEAD~ | hmake --changed-files=- test",
+					Tags:    map[string]interface{}{"help-var": "FILE"},
+				},
+				&flag.Option{
+					Name:    "wrapper",
+					Desc:    "Generate HyperMake in wrapper format with init",
+					Example: "hmake init --wrapper",
+					Type:    "bool",
+				},
+				&flag.Option{
+					Name: "template-dir",
+					Desc: "Load templates for init from DIR/TYPE (or DIR/TYPE-wrapper with --wrapper), " +
+						"all files in the directory are rendered with the detected project",
+					Example: "hmake init --template-dir=~/.hmake/templates",
+					Tags:    map[string]interface{}{"help-var": "DIR"},
+				},
+				&flag.Option{
+					Name:    "check",
+					Desc:    "Print the differences and fail if files are not formatted with fmt",
+					Example: "hmake fmt --check",
+					Type:    "bool",
+				},
 				&flag.Option{
 					Name: "dryrun",
 					Desc: "Show the execution of targets without doing anything",
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/codingbrain/clix.go/flag"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// completeCmd is the hidden entry point used by completion scripts, the
+// arguments are the words on command line after hmake, and the last one
+// is the word being completed. The candidates are printed line by line,
+// nothing is printed if the word should be completed as a file name
+const completeCmd = "__complete"
+
+// builtinCmds are the built-in commands
+var builtinCmds = []string{"clean", "completion", "config", "fmt", "init", "migrate", "serve", "validate"}
+
+// optionValues are the accepted values of options
+var optionValues = map[string][]string{
+	"output": {outputStream, outputGrouped, outputFailedOnly},
+	"lock":   {hm.LockProject, hm.LockTarget, hm.LockNone},
+}
+
+// completionScripts are the completion scripts for supported shells
+var completionScripts = map[string]string{
+	"bash": `# bash completion for hmake, generated by hmake completion bash
+_hmake() {
+    local line="${COMP_LINE:0:COMP_POINT}" words
+    read -r -a words <<< "$line"
+    [[ "$line" == *[[:space:]] ]] && words+=("")
+    local cur="${words[${#words[@]}-1]}" word="${COMP_WORDS[COMP_CWORD]}"
+    # the word in COMP_WORDS is split by COMP_WORDBREAKS, e.g. on = and :
+    [[ "$cur" == *"$word" ]] || word="$cur"
+    local prefix="${cur%"$word"}" IFS=$'\n'
+    COMPREPLY=($("$1" ` + completeCmd + ` "${words[@]:1}" 2>/dev/null))
+    COMPREPLY=("${COMPREPLY[@]#"$prefix"}")
+    if [[ ${#COMPREPLY[@]} -eq 1 && "${COMPREPLY[0]}" == *= ]] && type compopt &>/dev/null; then
+        compopt -o nospace
+    fi
+}
+complete -o default -F _hmake hmake
+`,
+	"zsh": `#compdef hmake
+# zsh completion for hmake, generated by hmake completion zsh
+_hmake() {
+    local -a candidates values
+    candidates=("${(@f)$(${words[1]} ` + completeCmd + ` "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    candidates=(${candidates:#})
+    if (( ${#candidates} == 0 )); then
+        _files
+        return
+    fi
+    values=(${(M)candidates:#*=})
+    candidates=(${candidates:#*=})
+    compadd -Q -S '' -a values
+    compadd -Q -a candidates
+}
+if [ "$funcstack[1]" = "_hmake" ]; then
+    _hmake "$@"
+else
+    compdef _hmake hmake
+fi
+`,
+	"fish": `# fish completion for hmake, generated by hmake completion fish
+function __hmake_complete
+    set -l tokens (commandline -opc)
+    set -l cur (commandline -ct)
+    set -l candidates ($tokens[1] ` + completeCmd + ` $tokens[2..-1] "$cur" 2>/dev/null)
+    if test (count $candidates) -eq 0
+        __fish_complete_path "$cur"
+    else
+        printf '%s\n' $candidates
+    end
+end
+complete -c hmake -f -a '(__hmake_complete)'
+`,
+}
+
+// completion prints the completion script for the shell
+func (c *makeCmd) completion(args []string) error {
+	shells := make([]string, 0, len(completionScripts))
+	for shell := range completionScripts {
+		shells = append(shells, shell)
+	}
+	sort.Strings(shells)
+	if len(args) != 1 {
+		return fmt.Errorf("usage: completion %s", strings.Join(shells, "|"))
+	}
+	script, ok := completionScripts[args[0]]
+	if !ok {
+		return fmt.Errorf("unsupported shell %s, use one of %s", args[0], strings.Join(shells, ", "))
+	}
+	fmt.Print(script)
+	return nil
+}
+
+// completer completes the words on command line, the project is loaded
+// when needed with the options in the words
+type completer struct {
+	cmd     *makeCmd
+	def     *flag.CliDef
+	project *hm.Project
+	loaded  bool
+}
+
+// complete prints the candidates of the last word in words
+func (c *makeCmd) complete(def *flag.CliDef, words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	comp := &completer{cmd: c, def: def}
+	for _, candidate := range comp.completeWord(words[:len(words)-1], words[len(words)-1]) {
+		fmt.Println(candidate)
+	}
+}
+
+func (c *completer) completeWord(words []string, cur string) []string {
+	if opt := findOption(c.def, "--rcfile"); opt != nil {
+		c.cmd.RcFile, _ = opt.Default.(bool)
+	}
+	c.cmd.Properties = make(map[string]interface{})
+	var args []string
+	for n := 0; n < len(words); n++ {
+		arg := words[n]
+		if arg == "--" {
+			args = append(args, words[n+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			args = append(args, arg)
+			continue
+		}
+		opt := findOption(c.def, arg)
+		if opt == nil {
+			// arguments of command
+			args = append(args, arg)
+			continue
+		}
+		val := ""
+		if pos := strings.Index(arg, "="); pos > 0 && strings.HasPrefix(arg, "--") {
+			val = arg[pos+1:]
+		} else if opt.Type != "bool" && !strings.HasPrefix(arg, "--") {
+			if n+1 == len(words) {
+				return prefixed(c.completeOptionValue(opt, cur), "", cur)
+			}
+			n++
+			val = words[n]
+		}
+		if opt.Name == "exec" || opt.Name == "exec-with" {
+			// the rest is the command to execute
+			return nil
+		}
+		c.useOption(opt, arg, val)
+	}
+
+	if pos := strings.Index(cur, "="); pos > 0 && strings.HasPrefix(cur, "--") {
+		opt := findOption(c.def, cur)
+		if opt == nil || opt.Type == "bool" {
+			return prefixed(c.completeArgValue(args, cur[2:pos]), cur[:pos+1], cur)
+		}
+		return prefixed(c.completeOptionValue(opt, cur[pos+1:]), cur[:pos+1], cur)
+	}
+	if strings.HasPrefix(cur, "-") {
+		return prefixed(append(c.completeArgNames(args), optionNames(c.def)...), "", cur)
+	}
+	return prefixed(c.completeArgs(args), "", cur)
+}
+
+// useOption keeps the options affecting how the project is loaded
+func (c *completer) useOption(opt *flag.Option, arg, val string) {
+	switch opt.Name {
+	case "chdir":
+		c.cmd.Chdir = val
+	case "file":
+		c.cmd.File = val
+	case "include":
+		c.cmd.Include = append(c.cmd.Include, val)
+	case "property":
+		if kv := strings.SplitN(val, "=", 2); len(kv) == 2 {
+			c.cmd.Properties[kv[0]] = kv[1]
+		}
+	case "rcfile":
+		c.cmd.RcFile = !strings.HasPrefix(arg, "--no-") && val != "false"
+	}
+}
+
+// loadProject loads the project for completion, Finalize is skipped
+// as the dependencies are not needed, and errors are ignored to complete
+// as much as possible
+func (c *completer) loadProject() *hm.Project {
+	if c.loaded {
+		return c.project
+	}
+	c.loaded = true
+	if c.cmd.Chdir != "" && os.Chdir(c.cmd.Chdir) != nil {
+		return nil
+	}
+	if c.cmd.File != "" {
+		hm.RootFile = c.cmd.File
+	}
+	p, err := hm.LocateProject()
+	if err != nil {
+		return nil
+	}
+	p.Resolve()
+	if c.cmd.config != nil {
+		c.cmd.loadSettings(p)
+	}
+	p.CollectTargets()
+	c.project = p
+	return p
+}
+
+func optionNames(def *flag.CliDef) (names []string) {
+	for _, opt := range def.Cli.Options {
+		switch {
+		case opt.Type == "bool":
+			names = append(names, "--"+opt.Name)
+			if val, _ := opt.Default.(bool); val {
+				names = append(names, "--no-"+opt.Name)
+			}
+		default:
+			names = append(names, "--"+opt.Name+"=")
+		}
+		for _, alias := range opt.Alias {
+			names = append(names, "-"+alias)
+		}
+	}
+	return
+}
+
+func (c *completer) completeOptionValue(opt *flag.Option, val string) []string {
+	if values, ok := optionValues[opt.Name]; ok {
+		return values
+	}
+	switch opt.Name {
+	case "rebuild-target", "skip", "exec-with":
+		if p := c.loadProject(); p != nil {
+			return append(p.TargetNames(), tagSelectors(p)...)
+		}
+	case "property":
+		if strings.Contains(val, "=") {
+			return nil
+		}
+		if p := c.loadProject(); p != nil {
+			keys := p.MasterFile.Settings.FlatKeys()
+			for n, key := range keys {
+				keys[n] = key + "="
+			}
+			return keys
+		}
+	}
+	return nil
+}
+
+// completeArgs completes targets, built-in commands, or positional
+// arguments of the command
+func (c *completer) completeArgs(args []string) []string {
+	p := c.loadProject()
+	if p == nil {
+		if len(args) == 0 {
+			return []string{"completion", "config"}
+		}
+		return c.completeBuiltinArgs(args)
+	}
+	if p.WrapperTarget() != nil {
+		return nil
+	}
+	if len(args) == 0 {
+		names := append(p.TargetNames(), tagSelectors(p)...)
+		for _, name := range builtinCmds {
+			if p.Targets[name] == nil && p.DisabledTargets[name] == nil {
+				names = append(names, name)
+			}
+		}
+		return names
+	}
+	if t := p.Targets[args[0]]; t != nil && t.Command {
+		return positionalChoices(t, args[1:])
+	}
+	if p.Targets[args[0]] == nil && p.DisabledTargets[args[0]] == nil {
+		for _, name := range builtinCmds {
+			if name == args[0] {
+				return c.completeBuiltinArgs(args)
+			}
+		}
+	}
+	typed := make(map[string]bool)
+	for _, arg := range args {
+		typed[arg] = true
+	}
+	var names []string
+	for _, name := range p.TargetNames() {
+		if !typed[name] && !p.Targets[name].Command {
+			names = append(names, name)
+		}
+	}
+	return append(names, tagSelectors(p)...)
+}
+
+func (c *completer) completeBuiltinArgs(args []string) []string {
+	switch args[0] {
+	case "completion":
+		if len(args) == 1 {
+			var shells []string
+			for shell := range completionScripts {
+				shells = append(shells, shell)
+			}
+			return shells
+		}
+	case "config":
+		if len(args) == 1 {
+			return []string{"get", "list", "set"}
+		}
+	case "init":
+		if len(args) == 1 {
+			return hm.ScaffoldTypes
+		}
+	case "clean":
+		if p := c.loadProject(); p != nil {
+			return append(p.TargetNames(), tagSelectors(p)...)
+		}
+	}
+	return nil
+}
+
+// tagSelectors returns the tags of targets as selectors like @lint
+func tagSelectors(p *hm.Project) []string {
+	tags := p.TagNames()
+	for n, tag := range tags {
+		tags[n] = hm.TagPrefix + tag
+	}
+	return tags
+}
+
+// commandTarget returns the command if the first argument selects one
+func (c *completer) commandTarget(args []string) *hm.Target {
+	if len(args) == 0 {
+		return nil
+	}
+	if p := c.loadProject(); p != nil && p.WrapperTarget() == nil {
+		if t := p.Targets[args[0]]; t != nil && t.Command {
+			return t
+		}
+	}
+	return nil
+}
+
+// completeArgNames completes arguments of the command as --name=value
+func (c *completer) completeArgNames(args []string) (names []string) {
+	t := c.commandTarget(args)
+	if t == nil {
+		return nil
+	}
+	for _, a := range t.ArgDefs {
+		if a.Type == hm.ArgTypeBool {
+			names = append(names, "--"+a.Name, "--no-"+a.Name)
+		} else {
+			names = append(names, "--"+a.Name+"=")
+		}
+	}
+	return
+}
+
+// completeArgValue completes the value of --name=value of the command
+func (c *completer) completeArgValue(args []string, name string) []string {
+	if t := c.commandTarget(args); t != nil {
+		for _, a := range t.ArgDefs {
+			if a.Name == name {
+				return choices(a)
+			}
+		}
+	}
+	return nil
+}
+
+// positionalChoices completes the next positional argument of the command
+// the same way as the arguments are assigned by Target.ParseArgs
+func positionalChoices(t *hm.Target, args []string) []string {
+	named := make(map[string]bool)
+	count := 0
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			count++
+			continue
+		}
+		name := strings.TrimPrefix(strings.SplitN(arg[2:], "=", 2)[0], "no-")
+		named[name] = true
+	}
+	for _, a := range t.ArgDefs {
+		if !a.Positional() || (named[a.Name] && !a.Variadic) {
+			continue
+		}
+		if a.Variadic || count == 0 {
+			return choices(a)
+		}
+		count--
+	}
+	return nil
+}
+
+func choices(a *hm.ArgDef) []string {
+	values := make([]string, len(a.Choices))
+	for n, c := range a.Choices {
+		values[n] = fmt.Sprint(c)
+	}
+	return values
+}
+
+// prefixed adds prefix to candidates, and returns the ones matching cur
+func prefixed(candidates []string, prefix, cur string) (matched []string) {
+	for _, candidate := range candidates {
+		if candidate = prefix + candidate; strings.HasPrefix(candidate, cur) {
+			matched = append(matched, candidate)
+		}
+	}
+	sort.Strings(matched)
+	return
+}
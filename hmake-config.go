@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/codingbrain/clix.go/flag"
+	"github.com/codingbrain/clix.go/term"
+	"github.com/easeway/langx.go/errors"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// configurableOption finds the command line option which can be
+// configured in section options of configuration files
+func configurableOption(def *flag.CliDef, name string) (*flag.Option, error) {
+	for _, opt := range def.Cli.Options {
+		if opt.Name != name {
+			continue
+		}
+		if opt.List || opt.Type == "dict" {
+			return nil, fmt.Errorf("option %s can't be configured", name)
+		}
+		return opt, nil
+	}
+	return nil, fmt.Errorf("unknown option %s", name)
+}
+
+// applyConfigOptions uses the configured values as defaults of options,
+// the invalid ones are skipped and reported
+func applyConfigOptions(def *flag.CliDef, config *hm.Config) error {
+	errs := &errors.AggregatedError{}
+	for name, val := range config.Options() {
+		opt, err := configurableOption(def, name)
+		if err != nil {
+			errs.Add(fmt.Errorf("%s.%s: %v", hm.ConfigOptions, name, err))
+			continue
+		}
+		opt.Default = val
+	}
+	return errs.Aggregate()
+}
+
+// configCmd shows or changes user-level and system-level configuration,
+// when in a project, the settings from project files and command line
+// are also shown as upper layers
+func (c *makeCmd) configCmd(p *hm.Project, args []string) error {
+	config := &hm.Config{Layers: append([]*hm.ConfigLayer{}, c.config.Layers...)}
+	if p != nil {
+		for _, f := range p.Files {
+			if len(f.Settings) > 0 {
+				config.AddLayer("project", f.Source, map[string]interface{}{hm.ConfigSettings: f.Settings})
+			}
+		}
+	}
+	if len(c.Properties) > 0 {
+		settings := make(hm.Settings)
+		if err := settings.MergeFlat(c.Properties); err != nil {
+			return err
+		}
+		config.AddLayer("command line", "", map[string]interface{}{hm.ConfigSettings: settings})
+	}
+
+	if len(args) == 0 {
+		return fmt.Errorf("config requires one of get, set, list")
+	}
+	switch args[0] {
+	case "list":
+		c.showConfig(config.List(), true)
+	case "get":
+		if len(args) != 2 {
+			return fmt.Errorf("usage: config get KEY")
+		}
+		entry := config.Get(args[1])
+		if entry == nil {
+			return fmt.Errorf("%s is not set", args[1])
+		}
+		c.showConfig([]*hm.ConfigEntry{entry}, false)
+	case "set":
+		if len(args) != 3 {
+			return fmt.Errorf("usage: config set KEY VALUE")
+		}
+		if name := strings.TrimPrefix(args[1], hm.ConfigOptions+"."); name != args[1] {
+			if _, err := configurableOption(cliDef(&makeCmd{}), name); err != nil {
+				return err
+			}
+		}
+		fn := hm.UserConfigFile
+		if c.System {
+			fn = hm.SystemConfigFile
+		}
+		return hm.SetConfigValue(fn, args[1], args[2])
+	default:
+		return fmt.Errorf("unknown config command %s, expect get, set or list", args[0])
+	}
+	return nil
+}
+
+// showConfig prints configuration values as KEY=VALUE,
+// or only the values if withKey is false
+func (c *makeCmd) showConfig(entries []*hm.ConfigEntry, withKey bool) {
+	if c.JSON {
+		encoded, _ := json.Marshal(entries)
+		fmt.Println(string(encoded))
+		return
+	}
+	out := term.NewPrinter(term.Std)
+	for _, entry := range entries {
+		if c.ShowOrigin {
+			out.Styles(term.StyleLo).Print(entry.Origin + "\t").Pop()
+		}
+		if withKey {
+			out.Styles(term.StyleHi).Print(entry.Key).Pop().Print("=")
+		}
+		out.Println(hm.FormatConfigValue(entry.Value))
+	}
+}
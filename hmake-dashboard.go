@@ -0,0 +1,554 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+	sh "github.com/evo-cloud/hmake/shell"
+)
+
+const (
+	// dashRefreshInterval is the interval to redraw the dashboard
+	dashRefreshInterval = 250 * time.Millisecond
+	// dashMaxLines is the number of output lines kept for each task
+	dashMaxLines = 500
+	// dashMaxNameLen truncates long target names in the table
+	dashMaxNameLen = 40
+)
+
+// states of tasks displayed in the dashboard, results are used
+// when the tasks finish
+const (
+	dashWaiting  = "waiting"
+	dashQueued   = "queued"
+	dashLocked   = "locked"
+	dashRunning  = "running"
+	dashAborting = "aborting"
+	dashStopped  = "stopped"
+)
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;?]*[A-Za-z]")
+
+type dashTask struct {
+	name     string
+	state    string
+	finished bool
+	result   hm.TaskResult
+	startAt  time.Time
+	finishAt time.Time
+	seq      int
+	detail   string
+	lines    []string
+	partial  string
+}
+
+// appendOutput keeps the last lines of output, only the last part of
+// a line overwritten by "\r" is kept
+func (t *dashTask) appendOutput(p []byte) {
+	text := ansiEscape.ReplaceAllString(t.partial+string(p), "")
+	text = strings.Replace(strings.Replace(text, "\r\n", "\n", -1), "\t", "    ", -1)
+	lines := strings.Split(text, "\n")
+	t.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		t.lines = append(t.lines, lastSegment(line))
+	}
+	if l := len(t.lines); l > dashMaxLines {
+		t.lines = append([]string{}, t.lines[l-dashMaxLines:]...)
+	}
+}
+
+// tail returns at most n last lines including the incomplete one
+func (t *dashTask) tail(n int) []string {
+	lines := t.lines
+	if t.partial != "" {
+		lines = append(lines[:len(lines):len(lines)], lastSegment(t.partial))
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return lines
+}
+
+func (t *dashTask) rank() int {
+	switch {
+	case t.finished:
+		return 4
+	case t.state == dashRunning || t.state == dashAborting:
+		return 0
+	case t.state == dashLocked:
+		return 1
+	case t.state == dashQueued:
+		return 2
+	}
+	return 3
+}
+
+func lastSegment(line string) string {
+	segs := strings.Split(line, "\r")
+	for i := len(segs) - 1; i > 0; i-- {
+		if segs[i] != "" {
+			return segs[i]
+		}
+	}
+	return segs[0]
+}
+
+// dashboard shows a live table of tasks and the output of the selected
+// task in full screen when running in a terminal, instead of printing
+// the interleaved output of tasks line by line
+type dashboard struct {
+	cmd     *makeCmd
+	plan    *hm.ExecPlan
+	abortCh chan<- os.Signal
+	history hm.History
+	startAt time.Time
+
+	lock    sync.Mutex
+	tasks   map[string]*dashTask
+	seq     int
+	focus   string
+	pinned  bool
+	message string
+	restore func()
+	stopped bool
+	stopCh  chan struct{}
+	doneCh  chan struct{}
+}
+
+// dashboardEnabled checks if the dashboard can be used, tasks attached
+// to the console need the terminal by themselves
+func (c *makeCmd) dashboardEnabled(plan *hm.ExecPlan) bool {
+	if !c.TUI || c.Output != outputStream || c.JSON || c.Quiet || c.Exec || !term.Std.IsTTY() {
+		return false
+	}
+	for _, t := range plan.Tasks {
+		var target sh.Target
+		t.Target.GetExt(&target)
+		if target.Console || t.Target.Exec {
+			return false
+		}
+	}
+	return true
+}
+
+// startDashboard takes over the terminal if the dashboard is enabled,
+// abortCh is signaled to abort all tasks the same as pressing Ctrl-C
+func (c *makeCmd) startDashboard(plan *hm.ExecPlan, abortCh chan<- os.Signal) *dashboard {
+	if !c.dashboardEnabled(plan) {
+		return nil
+	}
+	restore, err := rawInput(os.Stdin)
+	if err != nil {
+		return nil
+	}
+	d := &dashboard{
+		cmd:     c,
+		plan:    plan,
+		abortCh: abortCh,
+		history: plan.Project.History(),
+		startAt: time.Now(),
+		tasks:   make(map[string]*dashTask),
+		restore: restore,
+		stopCh:  make(chan struct{}),
+		doneCh:  make(chan struct{}),
+	}
+	for name := range plan.Tasks {
+		d.tasks[name] = &dashTask{name: name, state: dashWaiting}
+	}
+	// use alternate screen and hide cursor
+	os.Stdout.WriteString("\x1b[?1049h\x1b[?25l")
+	go d.readKeys()
+	go d.refresh()
+	return d
+}
+
+// stop restores the terminal, and prints the results of tasks
+// as they would be printed without the dashboard
+func (d *dashboard) stop() {
+	d.lock.Lock()
+	d.stopped = true
+	d.lock.Unlock()
+	close(d.stopCh)
+	<-d.doneCh
+	os.Stdout.WriteString("\x1b[?25h\x1b[?1049l")
+	d.restore()
+
+	c := d.cmd
+	c.Verbose = false
+	for _, t := range d.plan.FinishedTasks {
+		c.onEvent(&hm.EvtTaskFinish{Task: t})
+	}
+	for _, t := range d.plan.RunningTasks {
+		c.printTaskState(t, faceAbd, term.StyleErr, "")
+	}
+}
+
+func (d *dashboard) onEvent(event interface{}) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	switch e := event.(type) {
+	case *hm.EvtTaskActivated:
+		d.task(e.Task).state = dashQueued
+	case *hm.EvtTaskStart:
+		t := d.task(e.Task)
+		t.state, t.startAt, t.detail = dashRunning, e.Task.StartTime, ""
+		if focused := d.tasks[d.focus]; !d.pinned && (focused == nil || focused.finished) {
+			d.focus = t.name
+		}
+	case *hm.EvtTaskFinish:
+		t := d.task(e.Task)
+		d.seq++
+		t.finished, t.seq = true, d.seq
+		t.result, t.state, t.finishAt = e.Task.Result, strings.ToLower(e.Task.Result.String()), e.Task.FinishTime
+		if e.Task.Error != nil {
+			t.detail = e.Task.Error.Error()
+		}
+		// keep the output of the last finished task if nothing is running
+		if next := d.nextRunning(); !d.pinned && d.focus == t.name && next != "" {
+			d.focus = next
+		}
+	case *hm.EvtTaskOutput:
+		d.task(e.Task).appendOutput(e.Output)
+	case *hm.EvtTaskAbort:
+		d.task(e.Task).state = dashAborting
+	case *hm.EvtAbortRequested:
+		if e.Abandon {
+			d.message = "Running targets abandoned!"
+		} else if len(e.Tasks) > 0 {
+			d.message = "Aborting, press A or Ctrl-C again to terminate immediately."
+		}
+	case *hm.EvtTaskStop:
+		d.task(e.Task).state = dashStopped
+	case *hm.EvtTaskLockWait:
+		t := d.task(e.Task)
+		t.state, t.detail = dashLocked, "locked by another process"
+		if e.Holder != nil {
+			t.detail = fmt.Sprintf("locked by PID %d: %s", e.Holder.PID, e.Holder.Command)
+		}
+	}
+}
+
+// task must be called with d.lock locked
+func (d *dashboard) task(task *hm.Task) *dashTask {
+	t := d.tasks[task.Name()]
+	if t == nil {
+		t = &dashTask{name: task.Name()}
+		d.tasks[t.name] = t
+	}
+	return t
+}
+
+func (d *dashboard) nextRunning() string {
+	for _, t := range d.sortedTasks() {
+		if t.state == dashRunning {
+			return t.name
+		}
+	}
+	return ""
+}
+
+// sortedTasks lists running tasks first, then tasks to be run,
+// and the finished ones with the latest first
+func (d *dashboard) sortedTasks() []*dashTask {
+	tasks := make([]*dashTask, 0, len(d.tasks))
+	for _, t := range d.tasks {
+		tasks = append(tasks, t)
+	}
+	sort.Slice(tasks, func(i, j int) bool {
+		a, b := tasks[i], tasks[j]
+		if ra, rb := a.rank(), b.rank(); ra != rb {
+			return ra < rb
+		}
+		if a.finished {
+			return a.seq > b.seq
+		}
+		if a.rank() == 0 && !a.startAt.Equal(b.startAt) {
+			return a.startAt.Before(b.startAt)
+		}
+		return a.name < b.name
+	})
+	return tasks
+}
+
+func (d *dashboard) readKeys() {
+	buf := make([]byte, 16)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			return
+		}
+		d.lock.Lock()
+		if d.stopped {
+			d.lock.Unlock()
+			return
+		}
+		switch key := string(buf[:n]); key {
+		case "\x1b[A", "k":
+			d.moveFocus(-1)
+		case "\x1b[B", "j", "\t":
+			d.moveFocus(1)
+		case "a":
+			if t := d.tasks[d.focus]; t != nil && t.state == dashRunning {
+				d.plan.AbortTask(t.name)
+				d.message = "Aborting " + t.name
+			}
+		case "A":
+			select {
+			case d.abortCh <- os.Interrupt:
+			default:
+			}
+		}
+		d.render()
+		d.lock.Unlock()
+	}
+}
+
+// moveFocus must be called with d.lock locked
+func (d *dashboard) moveFocus(delta int) {
+	tasks := d.sortedTasks()
+	if len(tasks) == 0 {
+		return
+	}
+	pos := 0
+	for n, t := range tasks {
+		if t.name == d.focus {
+			pos = n + delta
+			break
+		}
+	}
+	if pos < 0 {
+		pos = 0
+	} else if pos >= len(tasks) {
+		pos = len(tasks) - 1
+	}
+	d.focus, d.pinned = tasks[pos].name, true
+}
+
+func (d *dashboard) refresh() {
+	ticker := time.NewTicker(dashRefreshInterval)
+	defer func() {
+		ticker.Stop()
+		close(d.doneCh)
+	}()
+	for {
+		d.lock.Lock()
+		d.render()
+		d.lock.Unlock()
+		select {
+		case <-d.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// estimate returns the expected time to complete the task
+func (d *dashboard) estimate(t *dashTask, now time.Time) (time.Duration, bool) {
+	est, ok := d.history[t.name]
+	if !ok || t.finished {
+		return 0, false
+	}
+	if t.state == dashRunning || t.state == dashAborting {
+		if est -= now.Sub(t.startAt); est < 0 {
+			est = 0
+		}
+	}
+	return est, true
+}
+
+// eta estimates the time to complete all tasks, assuming the known
+// durations of unfinished tasks are evenly distributed in parallel
+func (d *dashboard) eta(tasks []*dashTask, now time.Time) (time.Duration, bool) {
+	var total time.Duration
+	unfinished, known := 0, false
+	for _, t := range tasks {
+		if t.finished {
+			continue
+		}
+		unfinished++
+		if est, ok := d.estimate(t, now); ok {
+			total += est
+			known = true
+		}
+	}
+	parallel := d.plan.MaxConcurrency
+	if parallel == 0 {
+		parallel = runtime.NumCPU()
+	}
+	if parallel < 0 || parallel > unfinished {
+		parallel = unfinished
+	}
+	if !known || parallel == 0 {
+		return 0, false
+	}
+	return total / time.Duration(parallel), true
+}
+
+func fmtDuration(d time.Duration) string {
+	if d >= time.Minute {
+		return d.Truncate(time.Second).String()
+	}
+	return d.Round(100 * time.Millisecond).String()
+}
+
+// fit pads or truncates the plain text to the width
+func fit(text string, width int) string {
+	if width < 0 {
+		width = 0
+	}
+	runes := []rune(text)
+	if len(runes) > width {
+		if width <= 1 {
+			return string(runes[:width])
+		}
+		return string(runes[:width-1]) + "…"
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+func dashStateStyle(t *dashTask) string {
+	switch {
+	case t.state == dashRunning:
+		return "lightblue"
+	case t.state == dashAborting || t.state == dashLocked:
+		return term.StyleWarn
+	case t.finished && (t.result == hm.Failure || t.result == hm.Aborted):
+		return term.StyleErr
+	case t.finished && t.result == hm.Success:
+		return term.StyleOK
+	}
+	return term.StyleLo
+}
+
+// render must be called with d.lock locked
+func (d *dashboard) render() {
+	if d.stopped {
+		return
+	}
+	width, height, err := term.Size()
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	if height < 8 {
+		height = 8
+	}
+	now := time.Now()
+	tasks := d.sortedTasks()
+
+	var out bytes.Buffer
+	line := func(text string) {
+		out.WriteString(text + "\x1b[K\r\n")
+	}
+
+	counts := make(map[string]int)
+	for _, t := range tasks {
+		switch {
+		case t.finished && !t.result.IsOK():
+			counts["failed"]++
+		case t.finished:
+			counts["done"]++
+		case t.rank() == 0:
+			counts[dashRunning]++
+		default:
+			counts["pending"]++
+		}
+	}
+	header := fmt.Sprintf(" %d/%d done, %d running, %d pending, %d failed  elapsed %s",
+		counts["done"], len(tasks), counts[dashRunning], counts["pending"], counts["failed"],
+		fmtDuration(now.Sub(d.startAt)))
+	if eta, ok := d.eta(tasks, now); ok {
+		header += "  ETA ~" + fmtDuration(eta)
+	}
+	name := fit(d.plan.Project.Name, dashMaxNameLen)
+	name = strings.TrimSpace(name)
+	line(stylerPrint(name, term.StyleB, term.StyleHi) + fit(header, width-len([]rune(name))))
+
+	nameLen := 6
+	for _, t := range tasks {
+		if l := len([]rune(t.name)); l > nameLen {
+			nameLen = l
+		}
+	}
+	if nameLen > dashMaxNameLen {
+		nameLen = dashMaxNameLen
+	}
+	line(stylerPrint(fit(fmt.Sprintf("  %s %-9s %9s %9s  %s",
+		fit("TARGET", nameLen), "STATE", "ELAPSED", "ETA", "DETAIL"), width), term.StyleLo))
+
+	// the table takes at most half of the screen
+	rows := (height - 4) / 2
+	if rows > len(tasks) {
+		rows = len(tasks)
+	}
+	for n, t := range tasks {
+		if n >= rows {
+			break
+		}
+		if n == rows-1 && rows < len(tasks) {
+			line(stylerPrint(fmt.Sprintf("  ... %d more", len(tasks)-n), term.StyleLo))
+			break
+		}
+		elapsed, eta := "", ""
+		if t.finished {
+			elapsed = fmtDuration(t.finishAt.Sub(t.startAt))
+		} else if t.rank() == 0 {
+			elapsed = fmtDuration(now.Sub(t.startAt))
+		}
+		if est, ok := d.estimate(t, now); ok {
+			eta = "~" + fmtDuration(est)
+		}
+		marker := "  "
+		if t.name == d.focus {
+			marker = "> "
+		}
+		row := marker + fit(t.name, nameLen) + " "
+		rest := fmt.Sprintf(" %9s %9s  %s", elapsed, eta, t.detail)
+		restLen := width - len([]rune(row)) - 9
+		if restLen < 0 {
+			restLen = 0
+		}
+		if t.name == d.focus {
+			row = stylerPrint(row, term.StyleB, term.StyleHi)
+		}
+		line(row + stylerPrint(fmt.Sprintf("%-9s", t.state), dashStateStyle(t)) + fit(rest, restLen))
+	}
+
+	used := rows + 2
+	title := " no target selected "
+	focused := d.tasks[d.focus]
+	if focused != nil {
+		title = " " + focused.name + " (" + focused.state + ") "
+	}
+	line(stylerPrint("──"+fit(title, width-2), term.StyleB))
+	used++
+
+	logLines := height - used - 1
+	var lines []string
+	if focused != nil {
+		lines = focused.tail(logLines)
+	}
+	for n := 0; n < logLines; n++ {
+		if n < len(lines) {
+			line(fit(lines[n], width))
+		} else {
+			line("")
+		}
+	}
+
+	footer := "↑/↓ select  a abort target  A abort all"
+	if d.message != "" {
+		footer = d.message
+	}
+	out.WriteString(stylerPrint(fit(footer, width-1), term.StyleLo) + "\x1b[K")
+	os.Stdout.WriteString("\x1b[H" + out.String())
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// format rewrites project files (including the ones in sub-projects) in
+// canonical format, with --check, the differences are printed and it fails
+// if any file is not formatted, with --dryrun, formatted content is printed
+func (c *makeCmd) format(p *hm.Project) error {
+	out := term.NewPrinter(term.Std)
+	root := p.Root()
+	var unformatted []string
+	var formatProject func(proj *hm.Project) error
+	formatProject = func(proj *hm.Project) error {
+		for _, f := range proj.Files {
+			if f.Wrapper {
+				continue
+			}
+			fn := filepath.Join(proj.BaseDir, f.Source)
+			orig, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			content, err := hm.FormatFile(proj.BaseDir, f.Source)
+			if err != nil {
+				return err
+			}
+			if bytes.Equal(orig, content) {
+				continue
+			}
+			path := fn
+			if rel, err := filepath.Rel(root.BaseDir, fn); err == nil {
+				path = rel
+			}
+			unformatted = append(unformatted, path)
+			if c.Check {
+				fmt.Print(hm.UnifiedDiff(path, orig, content))
+				continue
+			}
+			if c.DryRun {
+				out.Styles(term.StyleB).Printf("# %s\n", path).Pop()
+				fmt.Print(string(content))
+				continue
+			}
+			if err = rewriteFile(fn, content); err != nil {
+				return err
+			}
+			out.Styles(term.StyleOK).Printf("formatted %s\n", path).Pop()
+		}
+		for _, name := range proj.SubProjectNames() {
+			if err := formatProject(proj.SubProjects[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := formatProject(p); err != nil {
+		return err
+	}
+	if c.Check && len(unformatted) > 0 {
+		return fmt.Errorf("%d file(s) not formatted: run hmake fmt", len(unformatted))
+	}
+	if len(unformatted) == 0 {
+		out.Styles(term.StyleOK).Println("all files are formatted").Pop()
+	}
+	return nil
+}
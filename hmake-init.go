@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// initProject generates HyperMake and the builder image for the project
+// in current directory, the type is detected if not specified,
+// with --dryrun, generated files are printed instead
+func (c *makeCmd) initProject(args []string) error {
+	if len(args) > 1 {
+		return fmt.Errorf("too many arguments, expect: init [TYPE]")
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	if _, err = os.Stat(filepath.Join(wd, hm.RootFile)); err == nil {
+		return fmt.Errorf("%s already exists", hm.RootFile)
+	}
+
+	typ := ""
+	if len(args) > 0 {
+		typ = args[0]
+	} else if typ = hm.DetectProjectType(wd); typ == "" {
+		markers := make([]string, 0, len(hm.ScaffoldTypes))
+		for _, name := range hm.ScaffoldTypes {
+			markers = append(markers, hm.ScaffoldProfiles[name].Marker)
+		}
+		return fmt.Errorf("unable to detect the type of project (none of %s found), specify one of: %s",
+			strings.Join(markers, ", "), strings.Join(hm.ScaffoldTypes, ", "))
+	}
+
+	files, err := hm.Scaffold(wd, typ, c.Wrapper, c.TemplateDir)
+	if err != nil {
+		return err
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	out := term.NewPrinter(term.Std)
+	for _, name := range names {
+		if c.DryRun {
+			out.Styles(term.StyleB).Printf("# %s\n", name).Pop()
+			fmt.Print(string(files[name]))
+			continue
+		}
+		fn := filepath.Join(wd, name)
+		if _, err = os.Stat(fn); err == nil {
+			out.Styles(term.StyleLo).Printf("skipped %s (already exists)\n", name).Pop()
+			continue
+		}
+		if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			return err
+		}
+		if err = ioutil.WriteFile(fn, files[name], 0644); err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		out.Styles(term.StyleOK).Printf("created %s", name).Pop().
+			Styles(term.StyleLo).Printf(" (%s)\n", typ).Pop()
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// migrate rewrites project files in legacy format into the latest format,
+// with --dryrun, migrated content is printed instead
+func (c *makeCmd) migrate(p *hm.Project) error {
+	out := term.NewPrinter(term.Std)
+	root := p.Root()
+	migrated := 0
+	var migrateProject func(proj *hm.Project) error
+	migrateProject = func(proj *hm.Project) error {
+		for _, f := range proj.Files {
+			if f.Wrapper {
+				continue
+			}
+			content, diags, err := hm.MigrateFile(proj.BaseDir, f.Source)
+			if err != nil {
+				return err
+			}
+			if content == nil {
+				continue
+			}
+			path := filepath.Join(proj.BaseDir, f.Source)
+			if rel, err := filepath.Rel(root.BaseDir, path); err == nil {
+				path = rel
+			}
+			migrated++
+			if c.DryRun {
+				out.Styles(term.StyleB).Printf("# %s\n", path).Pop()
+				fmt.Print(string(content))
+				continue
+			}
+			if err = rewriteFile(filepath.Join(proj.BaseDir, f.Source), content); err != nil {
+				return err
+			}
+			out.Styles(term.StyleOK).Printf("migrated %s", path).Pop().
+				Styles(term.StyleLo).Printf(" (%d change(s))\n", len(diags)).Pop()
+		}
+		for _, name := range proj.SubProjectNames() {
+			if err := migrateProject(proj.SubProjects[name]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := migrateProject(p); err != nil {
+		return err
+	}
+	if migrated == 0 {
+		out.Styles(term.StyleOK).Printf("all files are in %s\n", hm.Format).Pop()
+	}
+	return nil
+}
+
+// rewriteFile replaces the content of file and keeps the permissions
+func rewriteFile(fn string, content []byte) error {
+	info, err := os.Stat(fn)
+	if err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(fn, content, info.Mode()); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	return nil
+}
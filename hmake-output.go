@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// Modes of --output
+const (
+	// outputStream prints the output of tasks as it comes,
+	// prefixed by target names
+	outputStream = "stream"
+	// outputGrouped buffers the output of each task and prints it
+	// as a block when the task finishes
+	outputGrouped = "grouped"
+	// outputFailedOnly buffers the output the same as outputGrouped,
+	// but only prints the output of failed tasks
+	outputFailedOnly = "failed-only"
+)
+
+// CI environments supporting collapsible sections in logs
+const (
+	ciGitHub = "github"
+	ciGitLab = "gitlab"
+)
+
+var sectionNameUnsafe = regexp.MustCompile("[^a-zA-Z0-9_.-]")
+
+func checkOutputMode(mode string) error {
+	switch mode {
+	case outputStream, outputGrouped, outputFailedOnly:
+		return nil
+	}
+	return fmt.Errorf("unknown output mode %s, use one of %s, %s, %s",
+		mode, outputStream, outputGrouped, outputFailedOnly)
+}
+
+// detectCI returns the CI environment supporting collapsible sections
+func detectCI() string {
+	if os.Getenv("GITHUB_ACTIONS") == "true" {
+		return ciGitHub
+	}
+	if os.Getenv("GITLAB_CI") != "" {
+		return ciGitLab
+	}
+	return ""
+}
+
+// isBuffered indicates the output of tasks is printed when tasks finish
+func (c *makeCmd) isBuffered() bool {
+	return c.Output == outputGrouped || c.Output == outputFailedOnly
+}
+
+// bufferOutput keeps the output of task until the task finishes
+func (c *makeCmd) bufferOutput(task *hm.Task, p []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if s := c.tasks[task.Name()]; s != nil {
+		s.output = append(s.output, p...)
+	}
+}
+
+// printOutputGroup prints the buffered output of the task as one block
+// with a header, which is a collapsible section in CI logs
+func (c *makeCmd) printOutputGroup(task *hm.Task) {
+	c.lock.Lock()
+	var output []byte
+	if s := c.tasks[task.Name()]; s != nil {
+		output, s.output = s.output, nil
+	}
+	c.lock.Unlock()
+	if c.Output == outputFailedOnly && task.State == hm.Finished && task.Result.IsOK() {
+		return
+	}
+
+	title := task.Name() + " " + task.StartTime.Format(timeFmt)
+	section := "hmake_" + sectionNameUnsafe.ReplaceAllString(task.Name(), "_")
+	ci := detectCI()
+	switch ci {
+	case ciGitHub:
+		fmt.Println("::group::" + title)
+	case ciGitLab:
+		fmt.Printf("\x1b[0Ksection_start:%d:%s[collapsed=true]\r\x1b[0K%s\n",
+			task.StartTime.Unix(), section, title)
+	}
+
+	c.lock.Lock()
+	out := term.NewPrinter(term.Std)
+	if ci == "" {
+		// the same as the state printed when the task starts in stream mode
+		out.Styles(term.StyleB, "lightblue").Print(faces[faceGo]+" ").Pop().
+			Styles(term.StyleB, term.StyleHi).Print(task.Name()).Pop().
+			Styles(term.StyleLo).Println(" " + task.StartTime.Format(timeFmt)).Pop()
+	}
+	out.Write(output)
+	if l := len(output); l > 0 && output[l-1] != '\n' {
+		fmt.Println()
+	}
+	c.lock.Unlock()
+
+	switch ci {
+	case ciGitHub:
+		fmt.Println("::endgroup::")
+	case ciGitLab:
+		finishAt := task.FinishTime
+		if task.State != hm.Finished {
+			finishAt = task.StartTime
+		}
+		fmt.Printf("\x1b[0Ksection_end:%d:%s\r\x1b[0K\n", finishAt.Unix(), section)
+	}
+}
+
+// flushOutputs prints the output of tasks which never finish,
+// e.g. abandoned when aborted
+func (c *makeCmd) flushOutputs(tasks map[string]*hm.Task) {
+	if !c.isBuffered() || !c.Verbose {
+		return
+	}
+	for _, name := range sortedTaskNames(tasks) {
+		if s := c.tasks[name]; s != nil && len(s.output) > 0 {
+			c.printOutputGroup(tasks[name])
+		}
+	}
+}
+
+func sortedTaskNames(tasks map[string]*hm.Task) []string {
+	names := make([]string, 0, len(tasks))
+	for name := range tasks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
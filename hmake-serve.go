@@ -0,0 +1,281 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+	"github.com/evo-cloud/hmake/server"
+)
+
+// loadProject loads the project from current directory the same way
+// as the command line does
+func (c *makeCmd) loadProject() (*hm.Project, error) {
+	p, err := hm.LocateProject()
+	if err == nil {
+		err = p.Resolve()
+	}
+	if err == nil {
+		err = c.prepareProject(p)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// listen creates the listener on the address from --listen,
+// or the unix socket in the state folder of project by default
+func (c *makeCmd) listen(p *hm.Project) (net.Listener, string, error) {
+	if c.Listen != "" {
+		ln, err := net.Listen("tcp", c.Listen)
+		return ln, c.Listen, err
+	}
+	socket := p.SocketFile()
+	if _, err := server.Dial(socket); err == nil {
+		return nil, "", fmt.Errorf("hmake serve is already running on %s", socket)
+	}
+	// the socket is left by a process not exited normally
+	os.Remove(socket)
+	if err := os.MkdirAll(p.WorkPath(), 0755); err != nil {
+		return nil, "", err
+	}
+	ln, err := net.Listen("unix", socket)
+	return ln, "unix:" + socket, err
+}
+
+// writeToken generates the token required by hmake serve on TCP,
+// and saves it in the file only readable by current user
+func writeToken(fn string) (string, error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(data)
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return "", err
+	}
+	// never reuse the file as the permission may be changed
+	os.Remove(fn)
+	f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return "", err
+	}
+	_, err = f.WriteString(token)
+	if e := f.Close(); err == nil {
+		err = e
+	}
+	return token, err
+}
+
+// serve keeps the project loaded and serves the HTTP/JSON API until
+// interrupted, on TCP the token in .hmake/serve.token is required
+func (c *makeCmd) serve(p *hm.Project) error {
+	ln, addr, err := c.listen(p)
+	if err != nil {
+		return err
+	}
+	srv := server.NewServer(c.loadProject)
+	srv.Env["HMAKE_VERSION"] = Version()
+	if c.Listen != "" {
+		if srv.Token, err = writeToken(p.TokenFile()); err != nil {
+			ln.Close()
+			return err
+		}
+		defer os.Remove(p.TokenFile())
+		addr += " (token in " + filepath.Join(hm.WorkFolder, hm.TokenFileName) + ")"
+	}
+
+	stopped := make(chan struct{})
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	go func() {
+		<-ch
+		close(stopped)
+		// the unix socket is removed when the listener is closed
+		ln.Close()
+	}()
+
+	term.NewPrinter(term.Std).Print("Serving ").
+		Styles(term.StyleHi).Print(p.Name).Pop().
+		Print(" on ").Styles(term.StyleB).Println(addr).Pop()
+	err = http.Serve(ln, srv)
+	select {
+	case <-stopped:
+		return nil
+	default:
+		return err
+	}
+}
+
+// daemon connects to hmake serve of the project if it's running and
+// the options don't change how the project is loaded, built-in commands,
+// exec and showing targets or help are always local
+func (c *makeCmd) daemon(p *hm.Project, args []string) *server.Client {
+	if !c.Daemon || !c.RcFile || c.Keep || len(c.Include) > 0 || len(c.Properties) > 0 ||
+		c.Exec || c.ExecWith != "" || c.ExecStop || c.ShowTargets || wantsHelp(args) {
+		return nil
+	}
+	// targets are not collected yet, only the ones in the root project
+	// can take the names of built-in commands
+	for _, name := range builtinCmds {
+		if len(args) > 0 && args[0] == name && p.MasterFile.Targets[name] == nil {
+			return nil
+		}
+	}
+	if len(args) == 0 && p.WrapperTarget() == nil {
+		// targets are listed locally if no default targets
+		var settings hm.CommonSettings
+		if p.GetSettings(&settings); len(settings.DefaultTargets) == 0 {
+			return nil
+		}
+	}
+	client, err := server.Dial(p.SocketFile())
+	if err != nil {
+		return nil
+	}
+	return client
+}
+
+// runRequest creates the request of run from command line options
+func (c *makeCmd) runRequest(args []string) *server.RunRequest {
+	return &server.RunRequest{
+		Args:           args,
+		RebuildAll:     c.RebuildAll,
+		RebuildTargets: c.RebuildTargets,
+		Rebuild:        c.Rebuild,
+		Skip:           c.Skip,
+		Parallel:       c.Parallel,
+		DryRun:         c.DryRun,
+		DebugLog:       c.DebugLog,
+		LockMode:       c.Lock,
+	}
+}
+
+// runRemote starts the run in hmake serve and displays the events the
+// same way as running locally, Ctrl-C aborts the run. It returns false
+// if hmake serve loads the project differently, and it should run locally
+func (c *makeCmd) runRemote(client *server.Client, p *hm.Project, args []string) (bool, error) {
+	if err := checkOutputMode(c.Output); err != nil {
+		return true, err
+	}
+	req := c.runRequest(args)
+	req.Context = server.CurrentContext(p)
+	if err := c.selectChanged(p, req); err != nil {
+		return true, err
+	}
+	run, err := client.Start(req)
+	if _, mismatch := err.(*server.MismatchError); mismatch {
+		return false, nil
+	}
+	if err != nil {
+		return true, err
+	}
+	c.showChangedSelection(req, run.Targets)
+	padLen := 0
+	for _, name := range run.Targets {
+		if l := len(name); l > padLen {
+			padLen = l
+		}
+	}
+	c.initTasks(run.Targets, padLen)
+	if !c.Quiet {
+		c.Verbose = true
+	}
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, os.Interrupt)
+	defer func() {
+		signal.Stop(ch)
+		close(ch)
+	}()
+	go func() {
+		for range ch {
+			client.Abort(run.ID)
+		}
+	}()
+
+	plan := p.Plan()
+	tasks := make(map[string]*hm.Task)
+	var runErr error
+	err = client.Events(run.ID, func(e *server.Event) {
+		if e.Event == server.EventDone {
+			if e.Error != "" {
+				runErr = fmt.Errorf("%s", e.Error)
+			}
+			return
+		}
+		c.onEvent(c.remoteEvent(plan, tasks, e))
+	})
+	c.flushOutputs(tasks)
+	if err != nil {
+		return true, err
+	}
+	if c.Summary {
+		if info, e := client.Run(run.ID); e == nil {
+			c.printSummary(info.Summary)
+		}
+	}
+	if runErr != nil {
+		return true, runErr
+	}
+	term.NewPrinter(term.Std).Styles(term.StyleOK).Println(faces[faceGood])
+	return true, nil
+}
+
+// remoteEvent converts the event from hmake serve to the event of ExecPlan,
+// with tasks reconstructed in the local plan
+func (c *makeCmd) remoteEvent(plan *hm.ExecPlan, tasks map[string]*hm.Task, e *server.Event) interface{} {
+	if e.Event == server.EventAbortRequested {
+		return &hm.EvtAbortRequested{Tasks: make([]*hm.Task, e.Tasks), Abandon: e.Abandon}
+	}
+	task := tasks[e.Target]
+	if task == nil {
+		t := plan.Project.Targets[e.Target]
+		if t == nil {
+			// the project is changed after loaded
+			t = &hm.Target{Name: e.Target, Project: plan.Project}
+		}
+		if c.tasks[e.Target] == nil {
+			c.tasks[e.Target] = &taskState{
+				color:  colors[len(c.tasks)%len(colors)],
+				prefix: "[" + e.Target + "] ",
+			}
+		}
+		task = hm.NewTask(plan, t)
+		tasks[e.Target] = task
+	}
+	task.State, task.Result = e.State, e.Result
+	if e.StartAt != nil {
+		task.StartTime = *e.StartAt
+	}
+	if e.FinishAt != nil {
+		task.FinishTime = *e.FinishAt
+	}
+	if e.Error != "" {
+		task.Error = fmt.Errorf("%s", e.Error)
+	}
+	switch e.Event {
+	case server.EventStart:
+		return &hm.EvtTaskStart{Task: task}
+	case server.EventFinish:
+		return &hm.EvtTaskFinish{Task: task}
+	case server.EventOutput:
+		return &hm.EvtTaskOutput{Task: task, Output: e.Output}
+	case server.EventAbort:
+		return &hm.EvtTaskAbort{Task: task, Abandon: e.Abandon, Signal: os.Interrupt}
+	case server.EventStop:
+		return &hm.EvtTaskStop{Task: task}
+	case server.EventLockWait:
+		return &hm.EvtTaskLockWait{Task: task, Holder: e.Holder}
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/codingbrain/clix.go/term"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// validate reports problems found in project files
+func (c *makeCmd) validate(diags []*hm.Diagnostic, loadErr error) error {
+	if c.JSON {
+		if diags == nil {
+			diags = []*hm.Diagnostic{}
+		}
+		encoded, _ := json.Marshal(diags)
+		fmt.Println(string(encoded))
+	} else {
+		out := term.NewPrinter(term.Std)
+		for _, d := range diags {
+			if d.Deprecated {
+				out.Styles("yellow").Println(d.String()).Pop()
+			} else {
+				out.Styles(term.StyleErr).Println(d.String()).Pop()
+			}
+		}
+		if loadErr == nil && len(diags) == 0 {
+			out.Styles(term.StyleOK).Println("no problems found").Pop()
+		}
+	}
+	if loadErr != nil {
+		return loadErr
+	}
+	// deprecated properties still work and don't fail the validation
+	problems := 0
+	for _, d := range diags {
+		if !d.Deprecated {
+			problems++
+		}
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d problem(s) found", problems)
+	}
+	return nil
+}
@@ -44,10 +44,11 @@ const (
 	faceAbd
 	faceStop
 	faceGood
+	faceWait
 )
 
 var (
-	facesNormal = []string{"=>", "<<", ":)", ":]", ":(", "^C", "!!", "--", "OK"}
+	facesNormal = []string{"=>", "<<", ":)", ":]", ":(", "^C", "!!", "--", "OK", ".."}
 	facesEmoji  = []string{
 		emoji.Emoji(":zap:"),
 		emoji.Emoji(":relieved:"),
@@ -58,6 +59,7 @@ var (
 		emoji.Emoji(":bangbang:"),
 		emoji.Emoji(":recycle:"),
 		emoji.Emoji(":sunglasses:"),
+		emoji.Emoji(":hourglass:"),
 	}
 	faces = facesNormal
 )
@@ -65,6 +67,7 @@ var (
 type taskState struct {
 	color  string
 	prefix string
+	output []byte
 }
 
 type makeCmd struct {
@@ -79,6 +82,8 @@ type makeCmd struct {
 	Rebuild        bool
 	Exec           bool
 	ExecWith       string `n:"exec-with"`
+	ExecStop       bool   `n:"exec-stop"`
+	Keep           bool
 	Skip           []string
 	RcFile         bool
 	JSON           bool
@@ -91,9 +96,24 @@ type makeCmd struct {
 	DebugLog       bool `n:"debug-log"`
 	ShowSummary    bool `n:"show-summary"`
 	ShowTargets    bool `n:"targets"`
+	Listen         string
+	Daemon         bool
+	Lock           string
+	Dependents     bool
+	ChangedSince   string `n:"changed-since"`
+	ChangedFiles   string `n:"changed-files"`
+	Wrapper        bool
+	TemplateDir    string `n:"template-dir"`
+	Check          bool
+	TUI            bool `n:"tui"`
+	Output         string
+	ShowOrigin     bool `n:"show-origin"`
+	System         bool
 	DryRun         bool
 	Version        bool
 
+	config    *hm.Config
+	configErr error
 	settings  hm.CommonSettings
 	tasks     map[string]*taskState
 	noNewLine string // name of task printed the last output
@@ -129,6 +149,16 @@ func (c *makeCmd) Execute(args []string) (err error) {
 		return
 	}
 
+	// broken configuration is left out, so it can be fixed by config set
+	if c.configErr != nil && !c.noWarnings() {
+		term.NewPrinter(term.Err).Styles("yellow").Println("warning: configuration: " + c.configErr.Error()).Pop()
+	}
+
+	// scripts are generated without the project, so it works anywhere
+	if len(args) > 0 && args[0] == "completion" {
+		return c.completion(args[1:])
+	}
+
 	if c.File != "" {
 		hm.RootFile = c.File
 	}
@@ -139,15 +169,24 @@ func (c *makeCmd) Execute(args []string) (err error) {
 		}
 	}
 
-	if c.Banner && (!c.Exec && c.ExecWith == "") {
+	if c.Banner && (!c.Exec && c.ExecWith == "" && !c.ExecStop) {
 		c.showBanner()
 	}
 
 	var p *hm.Project
 	if p, err = hm.LocateProject(); err != nil {
 		if os.IsNotExist(err) {
+			if len(args) > 0 && args[0] == "config" {
+				return c.configCmd(nil, args[1:])
+			}
+			if len(args) > 0 && args[0] == "init" {
+				return c.initProject(args[1:])
+			}
 			return fmt.Errorf("Unable to find %s", hm.RootFile)
 		}
+		if p != nil {
+			return c.loadFailed(p, args, err)
+		}
 		return
 	}
 
@@ -157,28 +196,50 @@ func (c *makeCmd) Execute(args []string) (err error) {
 	}
 
 	if err = p.Resolve(); err != nil {
-		return
+		return c.loadFailed(p, args, err)
 	}
+	// hmake serve runs with the project loaded by itself
+	if client := c.daemon(p, args); client != nil {
+		if ran, err := c.runRemote(client, p, args); ran {
+			return err
+		}
+	}
+	err = c.prepareProject(p)
 
-	incErrs := &errors.AggregatedError{}
-	if c.RcFile {
-		incErrs.Add(p.LoadRcFiles())
+	diags := p.Validate()
+	if c.isBuiltin(p, args, "validate") {
+		return c.validate(diags, err)
 	}
-	for _, inc := range c.Include {
-		_, e := p.Load(inc)
-		incErrs.Add(e)
+	if c.isBuiltin(p, args, "config") {
+		if err != nil {
+			return
+		}
+		return c.configCmd(p, args[1:])
 	}
-	if err = incErrs.Aggregate(); err != nil {
-		return
+	if c.isBuiltin(p, args, "init") {
+		return c.initProject(args[1:])
 	}
-	if err = p.Finalize(); err != nil {
-		return
+	if c.isBuiltin(p, args, "migrate") {
+		if err != nil {
+			return
+		}
+		return c.migrate(p)
 	}
-
-	if c.Properties != nil {
-		if err = p.MergeSettingsFlat(c.Properties); err != nil {
+	if c.isBuiltin(p, args, "fmt") {
+		if err != nil {
 			return
 		}
+		return c.format(p)
+	}
+	c.warnDiagnostics(diags)
+	if err != nil {
+		return
+	}
+	if c.isBuiltin(p, args, "serve") {
+		return c.serve(p)
+	}
+	if c.isBuiltin(p, args, "clean") {
+		return c.clean(p, args[1:])
 	}
 
 	names := p.TargetNames()
@@ -188,34 +249,37 @@ func (c *makeCmd) Execute(args []string) (err error) {
 			padLen = l
 		}
 	}
+	for name := range p.DisabledTargets {
+		if l := len(name); l > padLen {
+			padLen = l
+		}
+	}
 	if c.ShowTargets {
 		c.showTargets(p, names, padLen)
 		return
 	}
 
-	c.tasks = make(map[string]*taskState)
-	for n, name := range names {
-		c.tasks[name] = &taskState{
-			color:  colors[n%len(colors)],
-			prefix: "[" + pad(name+"]", padLen+1) + " ",
-		}
-	}
-
-	if c.Emoji {
-		faces = facesEmoji
-	}
+	c.initTasks(names, padLen)
 
 	p.GetSettings(&c.settings)
 
+	if err = checkOutputMode(c.Output); err != nil {
+		return
+	}
+
 	if c.ExecWith != "" {
-		c.Exec = true
-	} else if c.Exec {
+		c.Exec = !c.ExecStop
+	} else if c.Exec || c.ExecStop {
 		c.ExecWith = c.settings.ExecTarget
 		if c.ExecWith == "" {
 			return fmt.Errorf("exec requires settings.exec-target or use --exec-with")
 		}
 	}
 
+	if c.ExecStop {
+		return c.stopExec(p)
+	}
+
 	// setup verbosity
 	if !c.Quiet && !c.Exec {
 		c.Verbose = true
@@ -229,55 +293,51 @@ func (c *makeCmd) Execute(args []string) (err error) {
 		}
 	}
 
-	plan := p.Plan()
-	plan.Env["HMAKE_VERSION"] = Version()
-	plan.OnEvent(c.onEvent)
-	errs := &errors.AggregatedError{}
-	plan.Rebuild(p.Targets.CompleteNames(c.RebuildTargets, errs)...)
-	plan.Skip(p.Targets.CompleteNames(c.Skip, errs)...)
-	var requires []string
-	if c.Exec {
-		requires = p.Targets.CompleteNames([]string{c.ExecWith}, errs)
-		if len(requires) > 0 {
-			t := p.Targets[requires[0]]
-			t.Args = args
-			t.Exec = true
-			plan.Rebuild(requires[0])
-		}
-	} else if t := p.WrapperTarget(); t != nil {
-		t.Args = args
-		requires = append(requires, t.Name)
-	} else if len(args) > 0 && p.IsCommand(args[0]) {
-		requires = []string{args[0]}
-		p.Targets[args[0]].Args = args[1:]
-	} else {
-		requires = p.Targets.CompleteNames(args, errs)
-	}
-	if len(requires) > 1 {
-		for _, name := range requires {
-			if t := p.Targets[name]; t != nil && t.Command {
-				errs.Add(fmt.Errorf("command %s should be the first target", t.Name))
+	if !c.Exec && p.WrapperTarget() == nil {
+		if len(args) > 0 && p.IsCommand(args[0]) {
+			t := p.Targets[args[0]]
+			t.Args = args[1:]
+			if t.WantsHelp() {
+				c.showCommandUsage(t)
+				return
 			}
+		} else if wantsHelp(args) {
+			c.showTargets(p, names, padLen)
+			return
 		}
 	}
-	if err = errs.Aggregate(); err != nil {
-		return
+
+	var plan *hm.ExecPlan
+	req := c.runRequest(args)
+	if !c.Exec {
+		if err = c.selectChanged(p, req); err != nil {
+			return
+		}
 	}
-	if c.Rebuild {
-		plan.Rebuild(requires...)
+	if c.Exec {
+		plan, err = req.ExecPlan(p, c.ExecWith)
+	} else {
+		plan, err = req.Plan(p)
 	}
-	plan.RebuildAll = c.RebuildAll
-	plan.MaxConcurrency = c.Parallel
-	plan.DebugLog = c.DebugLog
-	plan.DryRun = c.DryRun
-
-	if err = plan.Require(requires...); err != nil {
+	if err != nil {
 		return
 	}
+	plan.Env["HMAKE_VERSION"] = Version()
+	c.showChangedSelection(req, plan.RequiredTargets)
 
 	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, os.Interrupt)
+	dash := c.startDashboard(plan, ch)
+	if dash != nil {
+		plan.OnEvent(dash.onEvent)
+	} else {
+		plan.OnEvent(c.onEvent)
+	}
 	err = plan.Execute(ch)
+	if dash != nil {
+		dash.stop()
+	}
+	c.flushOutputs(plan.RunningTasks)
 	if (!c.Exec || c.Verbose) && c.Summary {
 		c.showSummary(p, plan)
 	}
@@ -292,6 +352,101 @@ func (c *makeCmd) Execute(args []string) (err error) {
 	return
 }
 
+// prepareProject loads additional files into the resolved project, and
+// applies the configuration and properties before finalizing
+func (c *makeCmd) prepareProject(p *hm.Project) error {
+	err := c.loadSettings(p)
+	if err == nil {
+		err = p.Finalize()
+	}
+	return err
+}
+
+// loadSettings loads additional files and merges settings from
+// configuration and command line into the project
+func (c *makeCmd) loadSettings(p *hm.Project) error {
+	incErrs := &errors.AggregatedError{}
+	if c.RcFile {
+		incErrs.Add(p.LoadRcFiles())
+	}
+	for _, inc := range c.Include {
+		_, e := p.Load(inc)
+		incErrs.Add(e)
+	}
+	err := incErrs.Aggregate()
+
+	// user-level and system-level settings are below project settings
+	if err == nil {
+		err = p.ApplyConfig(c.config)
+	}
+	// settings are merged before finalizing as conditions may refer to them
+	if err == nil && c.Properties != nil {
+		err = p.MergeSettingsFlat(c.Properties)
+	}
+	if err == nil && c.Keep {
+		p.MergeSettingsFlat(map[string]interface{}{"exec-persistent": true})
+	}
+	return err
+}
+
+// isBuiltin checks if the first argument selects a built-in command,
+// targets and commands defined in project take precedence
+func (c *makeCmd) isBuiltin(p *hm.Project, args []string, name string) bool {
+	return len(args) > 0 && args[0] == name &&
+		!c.Exec && c.ExecWith == "" && p.WrapperTarget() == nil &&
+		p.Targets[name] == nil && p.DisabledTargets[name] == nil
+}
+
+// loadFailed reports the problems found in project files before the
+// error, as the error from loading doesn't tell where the problem is
+func (c *makeCmd) loadFailed(p *hm.Project, args []string, err error) error {
+	diags := p.Validate()
+	if len(args) > 0 && args[0] == "validate" {
+		return c.validate(diags, err)
+	}
+	c.warnDiagnostics(diags)
+	return err
+}
+
+// noWarnings tells warnings must not be printed, as they mess up the
+// output of JSON, quiet mode and the command run by exec
+func (c *makeCmd) noWarnings() bool {
+	return c.JSON || c.Quiet || c.Exec || c.ExecWith != ""
+}
+
+func (c *makeCmd) warnDiagnostics(diags []*hm.Diagnostic) {
+	if c.noWarnings() {
+		return
+	}
+	out := term.NewPrinter(term.Err)
+	for _, d := range diags {
+		if d.Deprecated {
+			out.Styles("yellow").Println("deprecated: " + d.String()).Pop()
+		} else {
+			out.Styles("yellow").Println("warning: " + d.String()).Pop()
+		}
+	}
+}
+
+func (c *makeCmd) stopExec(p *hm.Project) error {
+	errs := &errors.AggregatedError{}
+	names := p.Targets.CompleteNames([]string{c.ExecWith}, errs)
+	if err := errs.Aggregate(); err != nil {
+		return err
+	}
+	plan := p.Plan()
+	for _, name := range names {
+		t := p.Targets[name]
+		if t == nil {
+			errs.Add(fmt.Errorf("target %s not defined", name))
+			continue
+		}
+		t.Exec = true
+		errs.Add(hm.NewTask(plan, t).StopPersistent())
+	}
+	return errs.Aggregate()
+}
+
 func (c *makeCmd) showBanner() {
 	out := term.NewPrinter(term.Std)
 	out.Styles("lightyellow", term.StyleB).Print("HyperMake").Pop().
@@ -300,15 +455,76 @@ func (c *makeCmd) showBanner() {
 		Println()
 }
 
+// tagList returns the tags as selectors, e.g. @lint @go
+func tagList(tags []string) string {
+	selectors := make([]string, len(tags))
+	for n, tag := range tags {
+		selectors[n] = hm.TagPrefix + tag
+	}
+	return strings.Join(selectors, " ")
+}
+
+// displayName returns the target name with the signature of command
+func displayName(t *hm.Target) string {
+	if sig := t.Signature(); sig != "" {
+		return t.Name + " " + sig
+	}
+	return t.Name
+}
+
+// initTasks prepares the display of tasks of the targets,
+// the names are padded to padLen
+func (c *makeCmd) initTasks(names []string, padLen int) {
+	c.tasks = make(map[string]*taskState)
+	for n, name := range names {
+		c.tasks[name] = &taskState{
+			color:  colors[n%len(colors)],
+			prefix: "[" + pad(name+"]", padLen+1) + " ",
+		}
+	}
+
+	if c.Emoji {
+		faces = facesEmoji
+	}
+}
+
+func wantsHelp(args []string) bool {
+	for _, arg := range args {
+		if arg == "--help" || arg == "-h" {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *makeCmd) showTargets(p *hm.Project, names []string, padLen int) {
 	if c.JSON {
-		data := make([]map[string]string, 0, len(p.Targets))
+		data := make([]map[string]interface{}, 0, len(p.Targets))
 		for _, name := range names {
 			t := p.Targets[name]
-			data = append(data, map[string]string{
+			info := map[string]interface{}{
 				"name":        t.Name,
 				"description": t.Desc,
-			})
+			}
+			if sig := t.Signature(); sig != "" {
+				info["signature"] = sig
+			}
+			if len(t.Tags) > 0 {
+				info["tags"] = t.Tags
+			}
+			data = append(data, info)
+		}
+		for _, name := range p.DisabledTargetNames() {
+			t := p.DisabledTargets[name]
+			info := map[string]interface{}{
+				"name":        t.Name,
+				"description": t.Desc,
+				"disabled":    t.Disabled,
+			}
+			if len(t.Tags) > 0 {
+				info["tags"] = t.Tags
+			}
+			data = append(data, info)
 		}
 		encoded, _ := json.Marshal(data)
 		fmt.Println(string(encoded))
@@ -316,6 +532,12 @@ func (c *makeCmd) showTargets(p *hm.Project, names []string, padLen int) {
 		settings := &hm.CommonSettings{}
 		p.GetSettings(settings)
 
+		for _, name := range names {
+			if l := len(displayName(p.Targets[name])); l > padLen {
+				padLen = l
+			}
+		}
+
 		out := term.NewPrinter(term.Std)
 		for _, name := range names {
 			t := p.Targets[name]
@@ -331,20 +553,72 @@ func (c *makeCmd) showTargets(p *hm.Project, names []string, padLen int) {
 			} else {
 				out.Print("   ")
 			}
-			out.Styles(term.StyleHi, term.StyleB).
-				Print(pad(name, padLen+2)).Pop().Println(t.Desc)
+			out.Styles(term.StyleHi, term.StyleB).Print(name).Pop()
+			sig := t.Signature()
+			if sig != "" {
+				out.Print(" " + sig)
+			}
+			out.Print(pad("", padLen+2-len(displayName(t)))).Print(t.Desc)
+			if len(t.Tags) > 0 {
+				if t.Desc != "" {
+					out.Print(" ")
+				}
+				out.Styles(term.StyleLo).Print(tagList(t.Tags)).Pop()
+			}
+			out.Println()
+		}
+		for _, name := range p.DisabledTargetNames() {
+			t := p.DisabledTargets[name]
+			out.Styles(term.StyleLo).
+				Print("   " + pad(name, padLen+2) + "(disabled: " + t.Disabled + ")").
+				Pop().Println()
 		}
 	}
 }
 
+// showCommandUsage prints the usage of command with declared arguments
+func (c *makeCmd) showCommandUsage(t *hm.Target) {
+	out := term.NewPrinter(term.Std)
+	out.Print("Usage: hmake ").Styles(term.StyleB).Print(t.Name).Pop()
+	if sig := t.Signature(); sig != "" {
+		out.Print(" " + sig)
+	}
+	out.Println()
+	if t.Desc != "" {
+		out.Println().Println(t.Desc)
+	}
+	if len(t.ArgDefs) == 0 {
+		return
+	}
+	padLen := 0
+	for _, a := range t.ArgDefs {
+		if l := len(a.Name); l > padLen {
+			padLen = l
+		}
+	}
+	out.Println().Println("Arguments:")
+	for _, a := range t.ArgDefs {
+		out.Print("  ").Styles(term.StyleHi).Print(pad(a.Name, padLen+2)).Pop().
+			Println(a.Help())
+	}
+	out.Println().Styles(term.StyleLo).
+		Println("Arguments are accepted by position or as --name=value").Pop()
+}
+
 func (c *makeCmd) onEvent(event interface{}) {
 	switch e := event.(type) {
 	case *hm.EvtTaskStart:
 		c.dumpEvent("start", e.Task)
-		c.printTaskState(e.Task, faceGo, "lightblue",
-			e.Task.StartTime.Format(timeFmt))
+		// printed with the output when the task finishes
+		if !c.Verbose || !c.isBuffered() {
+			c.printTaskState(e.Task, faceGo, "lightblue",
+				e.Task.StartTime.Format(timeFmt))
+		}
 	case *hm.EvtTaskFinish:
 		c.dumpEvent("finish", e.Task)
+		if c.Verbose && c.isBuffered() {
+			c.printOutputGroup(e.Task)
+		}
 		extra := e.Task.FinishTime.Format(timeFmt) +
 			" [+" + e.Task.Duration().String() + "]"
 		switch e.Task.Result {
@@ -362,7 +636,9 @@ func (c *makeCmd) onEvent(event interface{}) {
 		}
 	case *hm.EvtTaskOutput:
 		c.dumpTaskOutput(e.Task, e.Output)
-		if c.Verbose {
+		if c.Verbose && c.isBuffered() {
+			c.bufferOutput(e.Task, e.Output)
+		} else if c.Verbose {
 			c.printTaskOutput(e.Task, e.Output)
 		}
 	case *hm.EvtTaskAbort:
@@ -378,6 +654,13 @@ func (c *makeCmd) onEvent(event interface{}) {
 		}
 	case *hm.EvtTaskStop:
 		c.printTaskState(e.Task, faceStop, term.StyleLo, "")
+	case *hm.EvtTaskLockWait:
+		c.dumpEvent("lock-wait", e.Task)
+		holder := "another process"
+		if e.Holder != nil {
+			holder = fmt.Sprintf("PID %d: %s", e.Holder.PID, e.Holder.Command)
+		}
+		c.printTaskState(e.Task, faceWait, term.StyleWarn, "waiting for "+holder)
 	}
 }
 
@@ -592,10 +875,14 @@ func (c *makeCmd) showSummary(p *hm.Project, plan *hm.ExecPlan) (err error) {
 		}
 	}
 
+	return c.printSummary(sum)
+}
+
+func (c *makeCmd) printSummary(sum hm.ExecSummary) error {
 	if c.JSON {
 		encoded, _ := json.Marshal(sum)
 		fmt.Println(string(encoded))
-		return
+		return nil
 	}
 
 	sumData := make([]map[string]interface{}, len(sum))
@@ -640,5 +927,17 @@ func init() {
 }
 
 func main() {
-	cliDef(&makeCmd{}).Parse().Exec()
+	cmd := &makeCmd{}
+	def := cliDef(cmd)
+	errs := &errors.AggregatedError{}
+	config, err := hm.LoadConfig()
+	errs.Add(err)
+	errs.Add(applyConfigOptions(def, config))
+	cmd.config, cmd.configErr = config, errs.Aggregate()
+	if len(os.Args) > 1 && os.Args[1] == completeCmd {
+		cmd.complete(def, os.Args[2:])
+		return
+	}
+	os.Args = append(os.Args[:1], commandArgs(def, os.Args[1:])...)
+	def.Parse().Exec()
 }
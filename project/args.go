@@ -0,0 +1,287 @@
+package project
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Types of command arguments
+const (
+	ArgTypeString = "string"
+	ArgTypeInt    = "int"
+	ArgTypeFloat  = "float"
+	ArgTypeBool   = "bool"
+)
+
+// ArgVarPrefix prefixes the name of argument in substitutions of properties
+const ArgVarPrefix = "args."
+
+// ArgDef declares an argument accepted by a command
+type ArgDef struct {
+	Name     string        `map:"name"`
+	Desc     string        `map:"description"`
+	Type     string        `map:"type"`
+	Default  interface{}   `map:"default"`
+	Required bool          `map:"required"`
+	Choices  []interface{} `map:"choices"`
+	Variadic bool          `map:"variadic"`
+}
+
+// EnvName returns the name of environment variable containing the value
+func (a *ArgDef) EnvName() string {
+	return "HMAKE_ARG_" + strings.ToUpper(strings.Replace(a.Name, "-", "_", -1))
+}
+
+// Positional indicates the argument can be provided by position,
+// arguments of bool type or with default values are only accepted by name
+func (a *ArgDef) Positional() bool {
+	return a.Type != ArgTypeBool && a.Default == nil
+}
+
+// Usage returns the argument in command signature, like <name>, [name...],
+// [--name=VALUE] or [--name]
+func (a *ArgDef) Usage() string {
+	if !a.Positional() {
+		if a.Type == ArgTypeBool {
+			return "[--" + a.Name + "]"
+		}
+		val := "VALUE"
+		if len(a.Choices) > 0 {
+			val = strings.Join(a.choices(), "|")
+		}
+		return "[--" + a.Name + "=" + val + "]"
+	}
+	name := a.Name
+	if a.Variadic {
+		name += "..."
+	}
+	if a.Required {
+		return "<" + name + ">"
+	}
+	return "[" + name + "]"
+}
+
+func (a *ArgDef) choices() []string {
+	choices := make([]string, len(a.Choices))
+	for n, c := range a.Choices {
+		choices[n] = fmt.Sprint(c)
+	}
+	return choices
+}
+
+// Help describes the type, choices and default value of the argument
+func (a *ArgDef) Help() string {
+	var notes []string
+	if a.Type != "" && a.Type != ArgTypeString {
+		notes = append(notes, a.Type)
+	}
+	if len(a.Choices) > 0 {
+		notes = append(notes, "choices: "+strings.Join(a.choices(), ", "))
+	}
+	if a.Default != nil {
+		notes = append(notes, fmt.Sprintf("default: %v", a.Default))
+	}
+	if len(notes) == 0 {
+		return a.Desc
+	}
+	help := "(" + strings.Join(notes, "; ") + ")"
+	if a.Desc != "" {
+		help = a.Desc + " " + help
+	}
+	return help
+}
+
+// check validates the value against type and choices,
+// and returns the normalized value
+func (a *ArgDef) check(val string) (string, error) {
+	switch a.Type {
+	case ArgTypeInt:
+		if _, err := strconv.ParseInt(val, 0, 64); err != nil {
+			return val, fmt.Errorf("argument %s expects integer, got %q", a.Name, val)
+		}
+	case ArgTypeFloat:
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			return val, fmt.Errorf("argument %s expects number, got %q", a.Name, val)
+		}
+	case ArgTypeBool:
+		switch strings.ToLower(val) {
+		case "true", "yes", "y", "on", "1":
+			val = boolStr(true)
+		case "false", "no", "n", "off", "0":
+			val = boolStr(false)
+		default:
+			return val, fmt.Errorf("argument %s expects boolean, got %q", a.Name, val)
+		}
+	}
+	if len(a.Choices) > 0 {
+		choices := a.choices()
+		found := false
+		for _, c := range choices {
+			if c == val {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return val, fmt.Errorf("argument %s expects one of %s, got %q",
+				a.Name, strings.Join(choices, ", "), val)
+		}
+	}
+	return val, nil
+}
+
+// checkArgDefs validates the declarations of arguments
+func (t *Target) checkArgDefs() error {
+	if len(t.ArgDefs) == 0 {
+		return nil
+	}
+	if !t.Command {
+		return t.Errorf("args only allowed in commands")
+	}
+	names := make(map[string]bool)
+	for n, a := range t.ArgDefs {
+		if err := ValidateName(a.Name); err != nil {
+			return t.Errorf("args[%d]: illegal name '%s': %v", n, a.Name, err)
+		}
+		if names[a.Name] {
+			return t.Errorf("args[%d]: duplicated name %s", n, a.Name)
+		}
+		names[a.Name] = true
+		switch a.Type {
+		case "", ArgTypeString, ArgTypeInt, ArgTypeFloat, ArgTypeBool:
+		default:
+			return t.Errorf("args[%d]: unknown type %s", n, a.Type)
+		}
+		if a.Variadic && n+1 != len(t.ArgDefs) {
+			return t.Errorf("args[%d]: only the last argument can be variadic", n)
+		}
+		if a.Default != nil {
+			if _, err := a.check(fmt.Sprint(a.Default)); err != nil {
+				return t.Errorf("args[%d]: default: %v", n, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Signature returns the usage of arguments of the command
+func (t *Target) Signature() string {
+	usages := make([]string, len(t.ArgDefs))
+	for n, a := range t.ArgDefs {
+		usages[n] = a.Usage()
+	}
+	return strings.Join(usages, " ")
+}
+
+// WantsHelp indicates --help or -h is in the arguments of the command
+func (t *Target) WantsHelp() bool {
+	for _, arg := range t.Args {
+		if arg == "--" {
+			break
+		}
+		if arg == "--help" || arg == "-h" {
+			return true
+		}
+	}
+	return false
+}
+
+func (t *Target) findArgDef(name string) *ArgDef {
+	for _, a := range t.ArgDefs {
+		if a.Name == name {
+			return a
+		}
+	}
+	return nil
+}
+
+// ParseArgs parses the arguments of the command against declarations.
+// An argument is provided as --name=value (--name or --no-name for bool),
+// or by position in the order of declarations if it's positional, the
+// variadic one takes the rest. Values of variadic argument are joined
+// by spaces.
+// Without declarations, the arguments are passed through
+func (t *Target) ParseArgs() (map[string]string, error) {
+	if len(t.ArgDefs) == 0 {
+		return nil, nil
+	}
+	named := make(map[string][]string)
+	var positional []string
+	for n := 0; n < len(t.Args); n++ {
+		arg := t.Args[n]
+		if arg == "--" {
+			positional = append(positional, t.Args[n+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "--") || len(arg) == 2 {
+			positional = append(positional, arg)
+			continue
+		}
+		name, val := arg[2:], ""
+		if pos := strings.Index(name, "="); pos >= 0 {
+			name, val = name[:pos], name[pos+1:]
+		} else if a := t.findArgDef(strings.TrimPrefix(name, "no-")); a != nil && a.Type == ArgTypeBool {
+			val = boolStr(a.Name == name)
+			name = a.Name
+		}
+		a := t.findArgDef(name)
+		if a == nil {
+			return nil, t.Errorf("unknown argument --%s", name)
+		}
+		if len(named[name]) > 0 && !a.Variadic {
+			return nil, t.Errorf("argument %s specified more than once", name)
+		}
+		named[name] = append(named[name], val)
+	}
+
+	values := make(map[string]string)
+	for _, a := range t.ArgDefs {
+		vals, ok := named[a.Name]
+		if (!ok || a.Variadic) && a.Positional() && len(positional) > 0 {
+			if a.Variadic {
+				vals, positional = append(vals, positional...), nil
+			} else {
+				vals, positional = positional[:1], positional[1:]
+			}
+			ok = true
+		}
+		if !ok {
+			if a.Required {
+				return nil, t.Errorf("argument %s is required", a.Name)
+			}
+			if a.Default != nil {
+				vals = []string{fmt.Sprint(a.Default)}
+			} else if a.Type == ArgTypeBool {
+				vals = []string{boolStr(false)}
+			}
+		}
+		for n, val := range vals {
+			var err error
+			if vals[n], err = a.check(val); err != nil {
+				return nil, t.Errorf("%v", err)
+			}
+		}
+		values[a.Name] = strings.Join(vals, " ")
+	}
+	if len(positional) > 0 {
+		return nil, t.Errorf("unexpected arguments: %s", strings.Join(positional, " "))
+	}
+	return values, nil
+}
+
+// ApplyArgs parses the arguments of command, and substitutes $[args.NAME]
+// in properties with the values
+func (t *Target) ApplyArgs() error {
+	values, err := t.ParseArgs()
+	if err != nil || values == nil {
+		return err
+	}
+	t.ArgValues = values
+	vars := make(map[string]string)
+	for name, val := range values {
+		vars[ArgVarPrefix+name] = val
+	}
+	t.Ext = substMap(vars, t.Ext)
+	return nil
+}
@@ -0,0 +1,182 @@
+package project
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	zglob "github.com/mattn/go-zglob"
+)
+
+// GitChangedFiles returns the files changed since the merge base of rev
+// and HEAD, including uncommitted and untracked files, the paths are
+// relative to the project root, and files outside the project are ignored
+func (p *Project) GitChangedFiles(rev string) ([]string, error) {
+	base, err := p.git("merge-base", rev, "HEAD")
+	if err != nil {
+		return nil, err
+	}
+	if len(base) != 1 {
+		return nil, fmt.Errorf("unable to find the merge base of %s and HEAD", rev)
+	}
+	changed, err := p.git("diff", "--name-only", "--relative", base[0])
+	if err != nil {
+		return nil, err
+	}
+	untracked, err := p.git("ls-files", "--others", "--exclude-standard")
+	if err != nil {
+		return nil, err
+	}
+	return uniqueSorted(append(changed, untracked...)), nil
+}
+
+// git runs the git command in the project root, and returns the lines
+// of the output
+func (p *Project) git(args ...string) ([]string, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = p.BaseDir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return readLines(bytes.NewReader(out))
+}
+
+// ReadChangedFiles reads paths of changed files relative to the project
+// root line by line from the file, or stdin if the filename is "-"
+func ReadChangedFiles(filename string) ([]string, error) {
+	if filename == "-" {
+		return readLines(os.Stdin)
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return readLines(f)
+}
+
+func readLines(r io.Reader) (lines []string, err error) {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func uniqueSorted(strs []string) []string {
+	found := make(map[string]bool)
+	var out []string
+	for _, str := range strs {
+		if !found[str] {
+			found[str] = true
+			out = append(out, str)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// AffectedBy indicates any of the changed paths (relative to the root
+// project) is watched by the target, or is the file defining the target
+func (t *Target) AffectedBy(paths []string) bool {
+	prefix := ""
+	if root := t.Project.Root(); root != t.Project {
+		if rel, err := filepath.Rel(root.BaseDir, t.Project.BaseDir); err == nil {
+			prefix = filepath.ToSlash(rel)
+		}
+	}
+	source := path.Join(prefix, filepath.ToSlash(t.File.Source))
+	var includes, excludes []string
+	for _, pattern := range t.Watches {
+		if strings.HasPrefix(pattern, "!") {
+			excludes = append(excludes, path.Join(prefix, filepath.ToSlash(t.ProjectPath(pattern[1:]))))
+		} else {
+			includes = append(includes, path.Join(prefix, filepath.ToSlash(t.ProjectPath(pattern))))
+		}
+	}
+	for _, changed := range paths {
+		changed = path.Clean(filepath.ToSlash(changed))
+		if changed == source ||
+			(matchWatched(includes, changed) && !matchWatched(excludes, changed)) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchWatched indicates the path or any of its parent directories
+// matches one of the patterns
+func matchWatched(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if pattern == "." {
+			return true
+		}
+		for p := name; p != "." && p != "/"; p = path.Dir(p) {
+			if matched, err := zglob.Match(pattern, p); err == nil && matched {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SelectChanged selects targets affected by the changed paths among the
+// required targets and their dependencies. The targets watching the
+// changed paths are affected, so are the targets depending on them.
+// Transit targets are not selected as they have nothing to do
+func (p *Project) SelectChanged(requires []string, paths []string) []string {
+	affected := make(TargetNameMap)
+	var affect func(t *Target)
+	affect = func(t *Target) {
+		if affected[t.Name] != nil {
+			return
+		}
+		affected[t.Name] = t
+		for _, dependent := range t.Activates {
+			affect(dependent)
+		}
+	}
+	for _, t := range p.Targets {
+		if t.AffectedBy(paths) {
+			affect(t)
+		}
+	}
+
+	var selected []string
+	visited := make(map[string]bool)
+	var visit func(t *Target)
+	visit = func(t *Target) {
+		if visited[t.Name] {
+			return
+		}
+		visited[t.Name] = true
+		if affected[t.Name] != nil && !t.IsTransit() {
+			selected = append(selected, t.Name)
+		}
+		for _, dep := range t.Depends {
+			visit(dep)
+		}
+	}
+	for _, name := range requires {
+		if t := p.Targets[name]; t != nil {
+			visit(t)
+		}
+	}
+	sort.Strings(selected)
+	return selected
+}
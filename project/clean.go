@@ -0,0 +1,199 @@
+package project
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/easeway/langx.go/errors"
+)
+
+// CleanFile is the kind of CleanItem for files and directories
+const CleanFile = "file"
+
+// cleanSuffixes are the suffixes of state files of a target in WorkPath,
+// target lock files are kept as removing them while being locked by
+// another process breaks the locking
+var cleanSuffixes = []string{".success", ".script", ".log"}
+
+// CleanItem is something to be removed by clean
+type CleanItem struct {
+	// Task is the task of target owning the item
+	Task *Task
+	// Kind is the type of item, like file, image, container
+	Kind string
+	// Name identifies the item, files are relative to project root
+	Name string
+	// Remove removes the item
+	Remove func() error
+}
+
+func (item *CleanItem) String() string {
+	return item.Kind + " " + item.Name
+}
+
+// CleanItems lists the items to be removed by Clean for the specified
+// targets, or all targets if none is specified. When dependents is true,
+// the targets depending on specified targets are included
+func (p *ExecPlan) CleanItems(names []string, dependents bool) []*CleanItem {
+	targets := make(map[string]*Target)
+	if len(names) == 0 {
+		for name, t := range p.Project.Targets {
+			targets[name] = t
+		}
+	}
+	var include func(t *Target)
+	include = func(t *Target) {
+		if targets[t.Name] != nil {
+			return
+		}
+		targets[t.Name] = t
+		if dependents {
+			for _, dep := range t.Activates {
+				include(dep)
+			}
+		}
+	}
+	for _, name := range names {
+		if t := p.Project.Targets[name]; t != nil {
+			include(t)
+		}
+	}
+
+	sorted := make([]string, 0, len(targets))
+	for name := range targets {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var items []*CleanItem
+	found := make(map[string]bool)
+	for _, name := range sorted {
+		task := NewTask(p, targets[name])
+		for _, item := range p.cleanItemsOf(task) {
+			if key := item.String(); !found[key] {
+				found[key] = true
+				item.Task = task
+				items = append(items, item)
+			}
+		}
+	}
+	return items
+}
+
+func (p *ExecPlan) cleanItemsOf(task *Task) (items []*CleanItem) {
+	for _, artifact := range task.Target.Artifacts {
+		// missing artifacts are simply ignored
+		paths, _ := task.artifactPaths(artifact)
+		for _, path := range paths {
+			// never touch the project itself or anything outside
+			rel, err := filepath.Rel(p.Project.BaseDir, path)
+			if err != nil || rel == "." || rel == ".." ||
+				strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				continue
+			}
+			items = append(items, p.FileCleanItem(path))
+		}
+	}
+	for _, suffix := range cleanSuffixes {
+		fn := task.WorkFile(suffix)
+		if _, err := os.Stat(fn); err == nil {
+			items = append(items, p.FileCleanItem(fn))
+		}
+	}
+	if runner, ok := task.createRunnerErrIgnored().(CleanRunner); ok {
+		items = append(items, runner.CleanItems()...)
+	}
+	return
+}
+
+// FileCleanItem creates the CleanItem to remove a file or directory
+func (p *ExecPlan) FileCleanItem(fn string) *CleanItem {
+	name := fn
+	if rel, err := filepath.Rel(p.Project.BaseDir, fn); err == nil {
+		name = filepath.ToSlash(rel)
+	}
+	return &CleanItem{
+		Kind: CleanFile,
+		Name: name,
+		Remove: func() error {
+			return os.RemoveAll(fn)
+		},
+	}
+}
+
+// Clean removes the items and reports each of them, in DryRun, items are
+// only reported. The project is locked according to LockMode as Execute
+// does, and items of targets being executed by other processes are skipped
+func (p *ExecPlan) Clean(items []*CleanItem, report func(*CleanItem, error)) error {
+	switch p.LockMode {
+	case "", LockProject, LockTarget, LockNone:
+	default:
+		return fmt.Errorf("unknown lock mode %s", p.LockMode)
+	}
+	if p.DryRun {
+		for _, item := range items {
+			report(item, nil)
+		}
+		return nil
+	}
+
+	if p.LockMode == "" || p.LockMode == LockProject {
+		if err := os.MkdirAll(p.WorkPath, 0755); err != nil {
+			return err
+		}
+		lock, err := TryLock(p.Project.LockFile())
+		if _, locked := err.(*LockedError); locked {
+			return fmt.Errorf("another hmake is running in the project: %v", err)
+		} else if err != nil {
+			return err
+		}
+		defer lock.Unlock()
+	}
+
+	errs := &errors.AggregatedError{}
+	lockErrs := make(map[*Task]error)
+	for _, item := range items {
+		err, checked := lockErrs[item.Task]
+		if !checked {
+			err = p.lockClean(item.Task)
+			lockErrs[item.Task] = err
+			errs.Add(err)
+		}
+		if err != nil {
+			continue
+		}
+		err = item.Remove()
+		if err != nil {
+			err = fmt.Errorf("%s: %s: %v", item.Task.Name(), item, err)
+			errs.Add(err)
+		}
+		report(item, err)
+	}
+	for task := range lockErrs {
+		task.unlock()
+	}
+	return errs.Aggregate()
+}
+
+// lockClean acquires the lock of target to make sure it's not
+// being executed, the lock is released by unlock
+func (p *ExecPlan) lockClean(task *Task) error {
+	if p.LockMode == LockNone {
+		return nil
+	}
+	lock, err := TryLock(task.WorkFile(lockSuffix))
+	if err == nil {
+		task.lock = lock
+		return nil
+	}
+	if _, locked := err.(*LockedError); locked {
+		return fmt.Errorf("%s: %v", task.Name(), err)
+	}
+	// the lock file can't be created, e.g. WorkPath doesn't exist,
+	// so the target is not being executed
+	p.Logf("IGNORED: %s Lock Error: %v", task.Name(), err)
+	return nil
+}
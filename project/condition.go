@@ -0,0 +1,298 @@
+package project
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"unicode"
+
+	"github.com/easeway/langx.go/mapper"
+)
+
+// condition parses and evaluates expressions in "if" of target and "when".
+//
+// The grammar:
+//
+//	expr    := and ( "||" and )*
+//	and     := unary ( "&&" unary )*
+//	unary   := "!" unary | compare
+//	compare := operand ( ( "==" | "!=" ) operand )?
+//	operand := "(" expr ")" | STRING | NUMBER | "true" | "false" | IDENT
+//
+// IDENT is one of HMAKE_OS, HMAKE_ARCH, HMAKE_PROJECT_NAME, env.NAME or
+// settings.path.to.value. All values are strings, and a value is true
+// if it's not empty, "false" or "0".
+type condition struct {
+	value  func(string) (string, error)
+	tokens []string
+	pos    int
+}
+
+func isTrue(val string) bool {
+	return val != "" && val != "false" && val != "0"
+}
+
+func boolStr(b bool) string {
+	if b {
+		return "true"
+	}
+	return "false"
+}
+
+func tokenizeCondition(expr string) ([]string, error) {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		ch := expr[i]
+		switch {
+		case ch == ' ' || ch == '\t' || ch == '\n':
+			i++
+		case strings.HasPrefix(expr[i:], "&&"), strings.HasPrefix(expr[i:], "||"),
+			strings.HasPrefix(expr[i:], "=="), strings.HasPrefix(expr[i:], "!="):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		case ch == '!' || ch == '(' || ch == ')':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case ch == '"' || ch == '\'':
+			end := strings.IndexByte(expr[i+1:], ch)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			tokens = append(tokens, expr[i:i+end+2])
+			i += end + 2
+		default:
+			start := i
+			for i < len(expr) {
+				r := rune(expr[i])
+				if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '.' && r != '-' {
+					break
+				}
+				i++
+			}
+			if start == i {
+				return nil, fmt.Errorf("unexpected %q at %d", ch, i)
+			}
+			tokens = append(tokens, expr[start:i])
+		}
+	}
+	return tokens, nil
+}
+
+func (c *condition) peek() string {
+	if c.pos < len(c.tokens) {
+		return c.tokens[c.pos]
+	}
+	return ""
+}
+
+func (c *condition) next() string {
+	tok := c.peek()
+	c.pos++
+	return tok
+}
+
+func (c *condition) parseOr() (string, error) {
+	val, err := c.parseAnd()
+	for err == nil && c.peek() == "||" {
+		c.next()
+		var rhs string
+		if rhs, err = c.parseAnd(); err == nil {
+			val = boolStr(isTrue(val) || isTrue(rhs))
+		}
+	}
+	return val, err
+}
+
+func (c *condition) parseAnd() (string, error) {
+	val, err := c.parseUnary()
+	for err == nil && c.peek() == "&&" {
+		c.next()
+		var rhs string
+		if rhs, err = c.parseUnary(); err == nil {
+			val = boolStr(isTrue(val) && isTrue(rhs))
+		}
+	}
+	return val, err
+}
+
+func (c *condition) parseUnary() (string, error) {
+	if c.peek() == "!" {
+		c.next()
+		val, err := c.parseUnary()
+		return boolStr(!isTrue(val)), err
+	}
+	return c.parseCompare()
+}
+
+func (c *condition) parseCompare() (string, error) {
+	val, err := c.parseOperand()
+	if err != nil {
+		return val, err
+	}
+	if op := c.peek(); op == "==" || op == "!=" {
+		c.next()
+		rhs, err := c.parseOperand()
+		if err != nil {
+			return rhs, err
+		}
+		return boolStr((val == rhs) == (op == "==")), nil
+	}
+	return val, nil
+}
+
+func (c *condition) parseOperand() (string, error) {
+	tok := c.next()
+	switch {
+	case tok == "":
+		return "", fmt.Errorf("unexpected end of expression")
+	case tok == "(":
+		val, err := c.parseOr()
+		if err == nil && c.next() != ")" {
+			err = fmt.Errorf("missing )")
+		}
+		return val, err
+	case tok[0] == '"' || tok[0] == '\'':
+		return tok[1 : len(tok)-1], nil
+	case tok == "true" || tok == "false":
+		return tok, nil
+	case tok[0] >= '0' && tok[0] <= '9':
+		return tok, nil
+	}
+	return c.value(tok)
+}
+
+func isConditionIdent(ident string) bool {
+	switch ident {
+	case "HMAKE_OS", "HMAKE_ARCH", "HMAKE_PROJECT_NAME":
+		return true
+	}
+	return strings.HasPrefix(ident, "env.") || strings.HasPrefix(ident, "settings.")
+}
+
+// conditionValue resolves the value of an identifier in condition
+func (t *Target) conditionValue(ident string) (string, error) {
+	switch {
+	case ident == "HMAKE_OS":
+		return runtime.GOOS, nil
+	case ident == "HMAKE_ARCH":
+		return runtime.GOARCH, nil
+	case ident == "HMAKE_PROJECT_NAME":
+		return t.Project.Name, nil
+	case strings.HasPrefix(ident, "env."):
+		return os.Getenv(ident[4:]), nil
+	case strings.HasPrefix(ident, "settings."):
+		path := strings.Split(ident[9:], ".")
+		if val, ok := lookupSettings(t.File.Local, path); ok {
+			return val, nil
+		}
+		val, _ := lookupSettings(t.Project.MasterFile.Settings, path)
+		return val, nil
+	}
+	return "", fmt.Errorf("unknown identifier %s", ident)
+}
+
+func lookupSettings(settings map[string]interface{}, path []string) (string, bool) {
+	var val interface{} = settings
+	for _, name := range path {
+		dict, ok := val.(map[string]interface{})
+		if !ok {
+			if s, isSettings := val.(Settings); isSettings {
+				dict, ok = s, true
+			}
+		}
+		if !ok {
+			return "", false
+		}
+		if val, ok = dict[name]; !ok {
+			return "", false
+		}
+	}
+	if val == nil {
+		return "", true
+	}
+	return fmt.Sprintf("%v", val), true
+}
+
+func evalCondition(expr string, value func(string) (string, error)) (bool, error) {
+	tokens, err := tokenizeCondition(expr)
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %v", expr, err)
+	}
+	c := &condition{value: value, tokens: tokens}
+	val, err := c.parseOr()
+	if err == nil && c.pos < len(tokens) {
+		err = fmt.Errorf("unexpected %s", tokens[c.pos])
+	}
+	if err != nil {
+		return false, fmt.Errorf("invalid condition %q: %v", expr, err)
+	}
+	return isTrue(val), nil
+}
+
+// checkCondition validates the syntax and identifiers of a condition
+func checkCondition(expr string) error {
+	_, err := evalCondition(expr, func(ident string) (string, error) {
+		if !isConditionIdent(ident) {
+			return "", fmt.Errorf("unknown identifier %s", ident)
+		}
+		return "", nil
+	})
+	return err
+}
+
+// EvalCondition evaluates the condition expression in the context of target
+func (t *Target) EvalCondition(expr string) (bool, error) {
+	return evalCondition(expr, t.conditionValue)
+}
+
+// applyConditions merges properties in matched "when" and
+// evaluates "if" to decide whether the target is disabled. The properties
+// as defined are kept, so conditions are evaluated again from them each
+// time the targets are collected
+func (t *Target) applyConditions() error {
+	t.Disabled = ""
+	if t.defined == nil {
+		t.defined = &Target{}
+		t.defined.overlay(t)
+	} else {
+		t.resetProps(t.defined)
+	}
+	whens := t.When
+	t.When = nil
+	for n, when := range whens {
+		expr, ok := when["if"].(string)
+		if !ok {
+			return t.Errorf("when[%d]: if is required", n)
+		}
+		matched, err := t.EvalCondition(expr)
+		if err != nil {
+			return t.Errorf("when[%d]: %v", n, err)
+		}
+		if !matched {
+			continue
+		}
+		props := make(map[string]interface{})
+		for k, v := range when {
+			if k != "if" {
+				props[k] = v
+			}
+		}
+		o := &Target{}
+		if err = mapper.Map(o, props); err != nil {
+			return t.Errorf("when[%d]: %v", n, err)
+		}
+		o.markSet(props)
+		t.overlay(o)
+	}
+	if t.If != "" {
+		enabled, err := t.EvalCondition(t.If)
+		if err != nil {
+			return t.Errorf("%v", err)
+		}
+		if !enabled {
+			t.Disabled = "if: " + t.If
+		}
+	}
+	return nil
+}
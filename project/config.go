@@ -0,0 +1,298 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+
+	"github.com/easeway/langx.go/errors"
+	yaml "gopkg.in/yaml.v3"
+)
+
+const (
+	// ConfigFileName is the filename of user-level and system-level configuration
+	ConfigFileName = "config.yaml"
+	// ConfigOptions is the section of defaults of command line options
+	ConfigOptions = "options"
+	// ConfigSettings is the section of settings layered below project settings
+	ConfigSettings = "settings"
+)
+
+var (
+	// SystemConfigFile is the path to system-level configuration file
+	SystemConfigFile = systemConfigFile()
+	// UserConfigFile is the path to user-level configuration file
+	UserConfigFile = userConfigFile()
+)
+
+func systemConfigFile() string {
+	if runtime.GOOS == "windows" {
+		return filepath.Join(os.Getenv("ProgramData"), "hmake", ConfigFileName)
+	}
+	return filepath.Join("/etc", "hmake", ConfigFileName)
+}
+
+func userConfigFile() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		if runtime.GOOS == "windows" {
+			dir = os.Getenv("APPDATA")
+		} else {
+			dir = filepath.Join(os.Getenv("HOME"), ".config")
+		}
+	}
+	return filepath.Join(dir, "hmake", ConfigFileName)
+}
+
+// ConfigLayer is one source of configuration values
+type ConfigLayer struct {
+	// Name is the name of the layer, e.g. system, user
+	Name string
+	// Path is the file where values are loaded from, can be empty
+	Path string
+	// Values are the configuration values
+	Values map[string]interface{}
+}
+
+// ConfigEntry is a configuration value with the layer it comes from
+type ConfigEntry struct {
+	Key    string       `json:"key"`
+	Value  interface{}  `json:"value"`
+	Layer  *ConfigLayer `json:"-"`
+	Origin string       `json:"origin"`
+}
+
+// Config is the layered configuration, the latter layer overrides the former
+type Config struct {
+	Layers []*ConfigLayer
+}
+
+// Origin describes where the values come from
+func (l *ConfigLayer) Origin() string {
+	if l.Path == "" {
+		return l.Name
+	}
+	return l.Name + ":" + l.Path
+}
+
+// LoadConfig loads system-level and user-level configuration files,
+// the files not existed are ignored. The files failed to load are left
+// out, and the errors are returned with the configuration of the others
+func LoadConfig() (*Config, error) {
+	c := &Config{}
+	errs := &errors.AggregatedError{}
+	for _, layer := range []*ConfigLayer{
+		{Name: "system", Path: SystemConfigFile},
+		{Name: "user", Path: UserConfigFile},
+	} {
+		val, err := loadYaml(layer.Path)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err == nil {
+			for key := range val {
+				if key != ConfigOptions && key != ConfigSettings {
+					err = fmt.Errorf("%s: unknown section %s", layer.Path, key)
+					break
+				}
+			}
+		}
+		if err != nil {
+			errs.Add(err)
+			continue
+		}
+		layer.Values = val
+		c.Layers = append(c.Layers, layer)
+	}
+	return c, errs.Aggregate()
+}
+
+// AddLayer appends a layer overriding all existing layers
+func (c *Config) AddLayer(name, path string, values map[string]interface{}) {
+	c.Layers = append(c.Layers, &ConfigLayer{Name: name, Path: path, Values: values})
+}
+
+func (c *Config) merged(section string) Settings {
+	merged := make(Settings)
+	for _, layer := range c.Layers {
+		if val, ok := layer.Values[section].(map[string]interface{}); ok {
+			merged.Merge(Settings(copyValue(val).(map[string]interface{})))
+		}
+	}
+	return merged
+}
+
+// Options returns the defaults of command line options from all layers
+func (c *Config) Options() map[string]interface{} {
+	return c.merged(ConfigOptions)
+}
+
+// Settings returns the settings from all layers
+func (c *Config) Settings() Settings {
+	return c.merged(ConfigSettings)
+}
+
+func flattenConfig(prefix string, val interface{}, fn func(string, interface{})) {
+	var dict map[string]interface{}
+	switch v := val.(type) {
+	case map[string]interface{}:
+		dict = v
+	case Settings:
+		dict = v
+	default:
+		fn(prefix, val)
+		return
+	}
+	for key, item := range dict {
+		flattenConfig(joinPath(prefix, key), item, fn)
+	}
+}
+
+// List returns all effective values in flattened keys
+func (c *Config) List() []*ConfigEntry {
+	entries := make(map[string]*ConfigEntry)
+	for _, layer := range c.Layers {
+		flattenConfig("", layer.Values, func(key string, val interface{}) {
+			entries[key] = &ConfigEntry{Key: key, Value: val, Layer: layer, Origin: layer.Origin()}
+		})
+	}
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	list := make([]*ConfigEntry, 0, len(keys))
+	for _, key := range keys {
+		list = append(list, entries[key])
+	}
+	return list
+}
+
+// Get finds the value of a key (flattened with "."), it returns nil if not found
+func (c *Config) Get(key string) *ConfigEntry {
+	path := strings.Split(key, ".")
+	for n := len(c.Layers) - 1; n >= 0; n-- {
+		var val interface{} = c.Layers[n].Values
+		for _, name := range path {
+			dict, ok := val.(map[string]interface{})
+			if !ok {
+				if s, isSettings := val.(Settings); isSettings {
+					dict, ok = s, true
+				}
+			}
+			if !ok {
+				val = nil
+				break
+			}
+			if val, ok = dict[name]; !ok {
+				break
+			}
+		}
+		if val != nil {
+			return &ConfigEntry{Key: key, Value: val, Layer: c.Layers[n], Origin: c.Layers[n].Origin()}
+		}
+	}
+	return nil
+}
+
+// FormatConfigValue formats a value for display,
+// dictionaries and lists are encoded in JSON
+func FormatConfigValue(val interface{}) string {
+	switch val.(type) {
+	case map[string]interface{}, Settings, []interface{}:
+		encoded, _ := json.Marshal(val)
+		return string(encoded)
+	}
+	return fmt.Sprint(val)
+}
+
+// SetConfigValue sets a value in the configuration file, the value is parsed
+// as YAML, and comments in the file are preserved
+func SetConfigValue(fn, key, value string) error {
+	path := strings.Split(key, ".")
+	if len(path) < 2 || (path[0] != ConfigOptions && path[0] != ConfigSettings) {
+		return fmt.Errorf("invalid key %s: must start with %s. or %s.", key, ConfigOptions, ConfigSettings)
+	}
+	for _, name := range path {
+		if name == "" {
+			return fmt.Errorf("invalid key %s", key)
+		}
+	}
+
+	var doc yaml.Node
+	data, err := ioutil.ReadFile(fn)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", fn, err)
+	}
+	if len(doc.Content) == 0 {
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	var valNode yaml.Node
+	if err = yaml.Unmarshal([]byte(value), &valNode); err != nil || len(valNode.Content) == 0 {
+		valNode = yaml.Node{Content: []*yaml.Node{{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}}}
+	}
+
+	node := doc.Content[0]
+	for n, name := range path {
+		if node.Kind != yaml.MappingNode {
+			return fmt.Errorf("%s: %s is not a dictionary", fn, strings.Join(path[:n], "."))
+		}
+		_, val := mappingValue(node, name)
+		if n+1 == len(path) {
+			if val != nil {
+				*val = *valNode.Content[0]
+			} else {
+				node.Content = append(node.Content,
+					&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name},
+					valNode.Content[0])
+			}
+			break
+		}
+		if val == nil {
+			val = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: name}, val)
+		}
+		node = val
+	}
+
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(4)
+	if err = enc.Encode(&doc); err != nil {
+		return err
+	}
+	enc.Close()
+	if err = os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(fn, []byte(out.String()), 0644)
+}
+
+// ApplyConfig layers the settings in configuration below project settings,
+// deprecated settings are replaced and reported by Validate
+func (p *Project) ApplyConfig(c *Config) error {
+	// upgrade each layer before merging, so a deprecated setting
+	// doesn't override the replacement in upper layers
+	settings := make(Settings)
+	for _, layer := range c.Layers {
+		if val, ok := layer.Values[ConfigSettings].(map[string]interface{}); ok {
+			upgraded := copyValue(val).(map[string]interface{})
+			p.deprecate(layer.Origin(), upgradeSettings(upgraded))
+			settings.Merge(Settings(upgraded))
+		}
+	}
+	if err := settings.Merge(p.MasterFile.Settings); err != nil {
+		return err
+	}
+	p.MasterFile.Settings = settings
+	return nil
+}
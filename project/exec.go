@@ -10,6 +10,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"syscall"
@@ -45,6 +46,8 @@ type ExecPlan struct {
 	DebugLog bool
 	// Dryrun will skip the actual execution of target, just return success
 	DryRun bool
+	// LockMode is one of LockProject (default), LockTarget and LockNone
+	LockMode string
 	// WaitingTasks are tasks in waiting state
 	WaitingTasks map[string]*Task
 	// QueuedTasks are tasks in Queued state
@@ -58,8 +61,11 @@ type ExecPlan struct {
 	// Summary is the report of all executed targets
 	Summary ExecSummary
 
-	finishCh chan completion
-	logger   *log.Logger
+	finishCh    chan completion
+	logger      *log.Logger
+	masker      secretMasker
+	lockWaiting []*Task
+	abortTaskCh chan string
 }
 
 // EventHandler receives event notifications during execution of plan
@@ -104,6 +110,14 @@ type EvtTaskStop struct {
 	Task *Task
 }
 
+// EvtTaskLockWait is emitted when the task waits for the target
+// locked by another process
+type EvtTaskLockWait struct {
+	Task *Task
+	// Holder is nil if unknown
+	Holder *LockHolder
+}
+
 // Task is the execution state of a target
 type Task struct {
 	// Plan is ExecPlan owns the task
@@ -128,6 +142,10 @@ type Task struct {
 	currentDigest string
 	sigCh         chan os.Signal
 	bgRunner      BackgroundRunner
+	secretEnv     []string
+	outMask       maskBuffer
+	lock          *Lock
+	lockWaiting   bool
 }
 
 // TaskResult indicates the result of task execution
@@ -303,6 +321,25 @@ type BackgroundRunner interface {
 	Stop() error
 }
 
+// DryRunner describes what it would do when the plan is a dry run
+type DryRunner interface {
+	// DryRun reports the actions without actually performing them
+	DryRun() error
+}
+
+// PersistentRunner keeps a long-lived environment across exec mode invocations
+type PersistentRunner interface {
+	// StopPersistent tears down the long-lived environment
+	StopPersistent() error
+}
+
+// CleanRunner reports the resources created by the task besides files
+// in the project, like images and containers
+type CleanRunner interface {
+	// CleanItems lists the resources to be removed by clean
+	CleanItems() []*CleanItem
+}
+
 // RunnerFactory creates a runner from a task
 type RunnerFactory func(*Task) (Runner, error)
 
@@ -337,7 +374,8 @@ func NewExecPlan(project *Project) *ExecPlan {
 		WorkPath:       filepath.Join(project.BaseDir, WorkFolder),
 		WaitingTasks:   make(map[string]*Task),
 
-		logger: log.New(ioutil.Discard, "", log.Ltime),
+		logger:      log.New(ioutil.Discard, "", log.Ltime),
+		abortTaskCh: make(chan string, 1),
 	}
 	plan.Env["HMAKE_PROJECT_NAME"] = project.Name
 	plan.Env["HMAKE_PROJECT_DIR"] = project.BaseDir
@@ -382,7 +420,9 @@ func (p *ExecPlan) Require(targets ...string) error {
 	errs := &errors.AggregatedError{}
 	for _, name := range targets {
 		t := p.Project.Targets[name]
-		if t == nil {
+		if d := p.Project.DisabledTargets[name]; t == nil && d != nil {
+			errs.Add(fmt.Errorf("target %s is disabled: %s", name, d.Disabled))
+		} else if t == nil {
 			errs.Add(fmt.Errorf("target %s not defined", name))
 		} else if _, added := p.AddTarget(t); added {
 			p.RequiredTargets = append(p.RequiredTargets, name)
@@ -412,19 +452,45 @@ func (p *ExecPlan) AddTarget(t *Target) (*Task, bool) {
 }
 
 // Logf writes log to debug log file
-func (p *ExecPlan) Logf(fmt string, args ...interface{}) {
-	p.logger.Printf(fmt+"\n", args...)
+func (p *ExecPlan) Logf(format string, args ...interface{}) {
+	p.logger.Print(p.masker.mask(fmt.Sprintf(format+"\n", args...)))
 }
 
 // Execute start execution
 func (p *ExecPlan) Execute(abortCh <-chan os.Signal) error {
+	switch p.LockMode {
+	case "", LockProject, LockTarget, LockNone:
+	default:
+		return fmt.Errorf("unknown lock mode %s", p.LockMode)
+	}
 	p.Env["HMAKE_REQUIRED_TARGETS"] = strings.Join(p.RequiredTargets, " ")
 
+	// learn values of secrets before anything is logged,
+	// errors are reported when the task runs
+	for _, t := range p.Tasks {
+		t.resolveSecrets()
+	}
+
 	// DryRun should not make any changes
 	if !p.DryRun {
 		if err := os.MkdirAll(p.WorkPath, 0755); err != nil {
 			return err
 		}
+		for _, t := range p.Tasks {
+			if err := os.MkdirAll(t.WorkPath(), 0755); err != nil {
+				return err
+			}
+		}
+
+		if p.LockMode == "" || p.LockMode == LockProject {
+			lock, err := TryLock(p.Project.LockFile())
+			if _, locked := err.(*LockedError); locked {
+				return fmt.Errorf("another hmake is running in the project: %v", err)
+			} else if err != nil {
+				return err
+			}
+			defer lock.Unlock()
+		}
 
 		if p.DebugLog {
 			f, err := os.OpenFile(p.Project.DebugLogFile(),
@@ -455,6 +521,7 @@ func (p *ExecPlan) Execute(abortCh <-chan os.Signal) error {
 
 	aborting := false
 	stopping := false
+	abortedTasks := make(map[string]bool)
 	for !stopping {
 		if !aborting {
 			tasks := p.dequeueTasks(concurrency)
@@ -472,15 +539,34 @@ func (p *ExecPlan) Execute(abortCh <-chan os.Signal) error {
 			}
 		}
 
-		if len(p.RunningTasks) == 0 {
+		if len(p.RunningTasks) == 0 && len(p.lockWaiting) == 0 {
 			// nothing to run
 			break
 		}
 
+		var retryCh <-chan time.Time
+		if len(p.lockWaiting) > 0 {
+			retryCh = time.After(LockRetryInterval)
+		}
+
 		select {
 		case c := <-p.finishCh:
 			c.commit()
+		case <-retryCh:
+			p.QueuedTasks = append(p.QueuedTasks, p.lockWaiting...)
+			p.lockWaiting = nil
+		case name := <-p.abortTaskCh:
+			// a task is only signaled once, the rest is up to abortCh
+			if t := p.RunningTasks[name]; t != nil && !aborting && !abortedTasks[name] {
+				abortedTasks[name] = true
+				p.Logf("Abort %s %v(%s)", t.Name(), os.Interrupt, os.Interrupt.String())
+				p.emit(&EvtTaskAbort{Task: t, Signal: os.Interrupt})
+				t.Abort(false, os.Interrupt)
+			}
 		case signal, ok := <-abortCh:
+			// tasks waiting for locks are not started
+			p.QueuedTasks = append(p.QueuedTasks, p.lockWaiting...)
+			p.lockWaiting = nil
 			if !ok {
 				aborting = true
 			}
@@ -500,7 +586,13 @@ func (p *ExecPlan) Execute(abortCh <-chan os.Signal) error {
 		}
 	}
 
+	// abandoned tasks never finish
+	for _, t := range p.RunningTasks {
+		t.unlock()
+	}
+
 	p.GenerateSummary()
+	p.saveHistory()
 
 	errs := &errors.AggregatedError{}
 	for _, t := range p.FinishedTasks {
@@ -542,7 +634,10 @@ func (p *ExecPlan) GenerateSummary() (err error) {
 		p.Logf("Summary\n%s", string(encoded))
 	}
 	if !p.DryRun {
-		err = ioutil.WriteFile(p.Project.SummaryFile(), encoded, 0644)
+		// processes running concurrently in LockTarget mode replace the
+		// file instead of writing into it, so it's never corrupted, and
+		// it reports the process finished last
+		err = writeFileReplace(p.Project.SummaryFile(), encoded)
 		if err != nil {
 			p.Logf("Write summary failed: %v", err)
 		}
@@ -550,6 +645,28 @@ func (p *ExecPlan) GenerateSummary() (err error) {
 	return err
 }
 
+// writeFileReplace writes a temporary file and renames it to path
+func writeFileReplace(path string, data []byte) error {
+	tmp := fmt.Sprintf("%s.%d", path, os.Getpid())
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// AbortTask requests to abort a running task during Execute, the task
+// fails and other tasks are not affected
+func (p *ExecPlan) AbortTask(name string) {
+	select {
+	case p.abortTaskCh <- name:
+	default:
+	}
+}
+
 func (p *ExecPlan) dequeueTasks(dequeueCnt int) (tasks []*Task) {
 	if dequeueCnt < 0 {
 		// unlimited, dequeue all
@@ -575,7 +692,35 @@ func (p *ExecPlan) emit(event interface{}) {
 	}
 }
 
+// lockTask acquires the lock of the target, if it's locked by another
+// process, the task is put aside and retried later
+func (p *ExecPlan) lockTask(task *Task) bool {
+	if p.DryRun || p.LockMode == LockNone || task.Target.Exec {
+		return true
+	}
+	lock, err := TryLock(task.WorkFile(lockSuffix))
+	if err == nil {
+		task.lock = lock
+		return true
+	}
+	locked, ok := err.(*LockedError)
+	if !ok {
+		p.Logf("IGNORED: %s Lock Error: %v", task.Name(), err)
+		return true
+	}
+	if !task.lockWaiting {
+		task.lockWaiting = true
+		p.Logf("Wait %s: %v", task.Name(), err)
+		p.emit(&EvtTaskLockWait{Task: task, Holder: locked.Holder})
+	}
+	p.lockWaiting = append(p.lockWaiting, task)
+	return false
+}
+
 func (p *ExecPlan) startTask(task *Task) {
+	if !p.lockTask(task) {
+		return
+	}
 	p.Logf("Start %s", task.Name())
 	task.State = Running
 	p.RunningTasks[task.Name()] = task
@@ -607,6 +752,7 @@ func (p *ExecPlan) startTask(task *Task) {
 
 func (p *ExecPlan) finishTask(task *Task) {
 	if _, exist := p.RunningTasks[task.Name()]; !exist {
+		task.unlock()
 		// task is out-of-date, ignored
 		p.Logf("OUT-OF-DATE %s Result = %s, Err = %v",
 			task.Name(), task.Result.String(), task.Error)
@@ -641,6 +787,7 @@ func (p *ExecPlan) finishTask(task *Task) {
 				task.Name(), err)
 		}
 	}
+	task.unlock()
 
 	p.emit(&EvtTaskFinish{Task: task})
 
@@ -683,8 +830,17 @@ func (p *ExecPlan) abortTasks(abandon bool, signal os.Signal) {
 	p.emit(evt)
 }
 
-func (p *ExecPlan) successMarkFile(targetName string) string {
-	return filepath.Join(p.WorkPath, targetName+".success")
+// workPath returns the state folder for target, which is in
+// the sub-project if the target is from a sub-project
+func (p *ExecPlan) workPath(t *Target) string {
+	if t.Project != nil && t.Project != p.Project {
+		return t.Project.WorkPath()
+	}
+	return p.WorkPath
+}
+
+func (p *ExecPlan) successMarkFile(t *Target) string {
+	return filepath.Join(p.workPath(t), t.LocalName()+".success")
 }
 
 // NewTask creates a task for a target
@@ -808,8 +964,7 @@ func (t *Task) ValidateArtifacts() bool {
 	}
 	t.Plan.Logf("%s Validating Artifacts", t.Name())
 	for _, artifact := range t.Target.Artifacts {
-		fullPath := filepath.Join(t.Plan.Project.BaseDir, t.Target.ProjectPath(artifact))
-		if _, err := os.Stat(fullPath); err != nil {
+		if _, err := t.artifactPaths(artifact); err != nil {
 			t.Plan.Logf("%s invalid artifact %s: %v", t.Name(), artifact, err)
 			return false
 		}
@@ -826,14 +981,36 @@ func (t *Task) ValidateArtifacts() bool {
 	return true
 }
 
+// artifactPaths returns the full paths of the artifact, which can be
+// a glob pattern matching at least one file
+func (t *Task) artifactPaths(artifact string) ([]string, error) {
+	path := t.Target.ProjectPath(artifact)
+	if !strings.ContainsAny(path, "*?[") {
+		fullPath := filepath.Join(t.Project().BaseDir, path)
+		if _, err := os.Stat(fullPath); err != nil {
+			return nil, err
+		}
+		return []string{fullPath}, nil
+	}
+	paths, err := t.Project().Glob(path)
+	if err == nil && len(paths) == 0 {
+		err = fmt.Errorf("no files match %s", path)
+	}
+	sort.Strings(paths)
+	for n, matched := range paths {
+		paths[n] = filepath.Join(t.Project().BaseDir, matched)
+	}
+	return paths, err
+}
+
 func (t *Task) clearSuccessMark() {
 	t.alwaysBuild = true
 	if t.Plan.DryRun {
 		return
 	}
 	os.Remove(t.successMarkFile())
-	for name := range t.Target.Activates {
-		os.Remove(t.Plan.successMarkFile(name))
+	for _, target := range t.Target.Activates {
+		os.Remove(t.Plan.successMarkFile(target))
 	}
 }
 
@@ -877,12 +1054,18 @@ func (t *Task) Run() (result TaskResult, err error) {
 		return
 	}
 	var runner Runner
-	runner, err = t.CreateRunner()
+	if err = t.resolveSecrets(); err == nil {
+		runner, err = t.CreateRunner()
+	}
 	if err == nil {
 		go func() {
 			c := completion{task: t, result: Success, runner: runner}
 			if !t.Plan.DryRun {
 				c.result, c.err = runner.Run(t.sigCh)
+			} else if r, ok := runner.(DryRunner); ok {
+				if c.err = r.DryRun(); c.err != nil {
+					c.result = Failure
+				}
 			}
 			c.finishTime = time.Now()
 			t.Plan.finishCh <- c
@@ -907,6 +1090,15 @@ func (t *Task) Abort(abandon bool, signal os.Signal) {
 	}
 }
 
+func (t *Task) unlock() {
+	if t.lock != nil {
+		if err := t.lock.Unlock(); err != nil {
+			t.Plan.Logf("IGNORED: %s Unlock Error: %v", t.Name(), err)
+		}
+		t.lock = nil
+	}
+}
+
 // IsBackground determine if task is running in background
 func (t *Task) IsBackground() bool {
 	return t.Result == Started
@@ -923,9 +1115,32 @@ func (t *Task) Stop() (err error) {
 	return
 }
 
+// StopPersistent tears down the long-lived exec environment of the task
+func (t *Task) StopPersistent() error {
+	runner, err := t.CreateRunner()
+	if err != nil {
+		return err
+	}
+	if r, ok := runner.(PersistentRunner); ok {
+		t.Plan.Logf("Stop Persistent %s", t.Name())
+		return r.StopPersistent()
+	}
+	return nil
+}
+
 // successMarkFile returns the filename of success mark
 func (t *Task) successMarkFile() string {
-	return t.Plan.successMarkFile(t.Name())
+	return t.Plan.successMarkFile(t.Target)
+}
+
+// WorkPath returns the state folder (.hmake) of the project of the task
+func (t *Task) WorkPath() string {
+	return t.Plan.workPath(t.Target)
+}
+
+// WorkFile returns the full path of a state file of the task
+func (t *Task) WorkFile(suffix string) string {
+	return filepath.Join(t.WorkPath(), t.Target.LocalName()+suffix)
 }
 
 // WorkingDir is absolute path of working dir to execute the task
@@ -935,18 +1150,48 @@ func (t *Task) WorkingDir(dirs ...string) string {
 
 // EnvVars returns task specific envs
 func (t *Task) EnvVars() []string {
-	return []string{
+	envs := []string{
 		"HMAKE_TARGET=" + t.Name(),
 		"HMAKE_TARGET_DIR=" + t.Target.BaseDir(),
 	}
+	if p := t.Project(); p != t.Plan.Project {
+		envs = append(envs,
+			"HMAKE_PROJECT_NAME="+p.Name,
+			"HMAKE_PROJECT_DIR="+p.BaseDir,
+			"HMAKE_PROJECT_FILE="+p.MasterFile.Source,
+			"HMAKE_WORK_DIR="+p.WorkPath())
+	}
+	names := make([]string, 0, len(t.Target.Vars))
+	for name := range t.Target.Vars {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		envs = append(envs, "HMAKE_VAR_"+strings.ToUpper(name)+"="+t.Target.Vars[name])
+	}
+	for _, a := range t.Target.ArgDefs {
+		if val, ok := t.Target.ArgValues[a.Name]; ok {
+			envs = append(envs, a.EnvName()+"="+val)
+		}
+	}
+	return envs
 }
 
 // Write implements io.Writer to receive execution output
 func (t *Task) Write(p []byte) (int, error) {
-	t.Plan.emit(&EvtTaskOutput{Task: t, Output: p})
+	if out := t.outMask.mask(&t.Plan.masker, p); len(out) > 0 {
+		t.Plan.emit(&EvtTaskOutput{Task: t, Output: out})
+	}
 	return len(p), nil
 }
 
+// flushOutput emits the output held for masking secrets
+func (t *Task) flushOutput() {
+	if out := t.outMask.flush(); len(out) > 0 {
+		t.Plan.emit(&EvtTaskOutput{Task: t, Output: out})
+	}
+}
+
 type completion struct {
 	task       *Task
 	result     TaskResult
@@ -956,8 +1201,9 @@ type completion struct {
 }
 
 func (c completion) commit() {
+	c.task.flushOutput()
 	c.task.Result = c.result
-	c.task.Error = c.err
+	c.task.Error = c.task.Plan.maskError(c.err)
 	c.task.FinishTime = c.finishTime
 	if c.result == Started {
 		if r, ok := c.runner.(BackgroundRunner); ok {
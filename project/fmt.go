@@ -0,0 +1,255 @@
+package project
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var (
+	// fileKeyOrder is the canonical order of top-level properties,
+	// unknown ones are placed after them
+	fileKeyOrder = []string{
+		"format", "name", "description",
+		"templates", "targets", "commands",
+		"settings", "local", "secrets", "projects", "includes",
+	}
+	// targetKeyOrder is the canonical order of properties of a target,
+	// properties of exec-drivers are sorted by name in place of "*"
+	targetKeyOrder = []string{
+		"name", "description", "command", "args", "extends", "matrix", "tags",
+		"if", "before", "after", "exec-driver", "workdir",
+		"watches", "secrets", "always",
+		"*",
+		"artifacts", "when",
+	}
+)
+
+// keyRank returns the position of the key in order, unknown keys are
+// ranked as "*" if present, otherwise after all keys
+func keyRank(order []string, key string) int {
+	other := len(order)
+	for n, name := range order {
+		if name == key {
+			return n
+		}
+		if name == "*" {
+			other = n
+		}
+	}
+	return other
+}
+
+// sortKeys reorders the properties in the mapping node by rank,
+// the keys of the same rank are sorted by name if byName is set,
+// otherwise their order is kept
+func sortKeys(node *yaml.Node, order []string, byName bool) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return
+	}
+	type pair struct{ key, val *yaml.Node }
+	pairs := make([]pair, 0, len(node.Content)/2)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		pairs = append(pairs, pair{node.Content[i], node.Content[i+1]})
+	}
+	sort.SliceStable(pairs, func(i, j int) bool {
+		ri, rj := keyRank(order, pairs[i].key.Value), keyRank(order, pairs[j].key.Value)
+		if ri != rj {
+			return ri < rj
+		}
+		return byName && order[ri] == "*" && pairs[i].key.Value < pairs[j].key.Value
+	})
+	for n, p := range pairs {
+		node.Content[n*2], node.Content[n*2+1] = p.key, p.val
+	}
+}
+
+// blockStyle converts dictionaries and lists in flow style into block style,
+// empty ones are kept as {} or []
+func blockStyle(node *yaml.Node) {
+	if (node.Kind == yaml.MappingNode || node.Kind == yaml.SequenceNode) && len(node.Content) > 0 {
+		node.Style &^= yaml.FlowStyle
+	}
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+// formatTarget sorts the properties of a target, including the ones in when
+func formatTarget(node *yaml.Node) {
+	sortKeys(node, targetKeyOrder, true)
+	if _, whens := mappingValue(node, "when"); whens != nil && whens.Kind == yaml.SequenceNode {
+		for _, when := range whens.Content {
+			formatTarget(when)
+		}
+	}
+}
+
+// formatDoc rearranges the nodes of a project file in canonical format,
+// and returns the properties which should be separated by blank lines
+func formatDoc(file string, doc *yaml.Node) (map[*yaml.Node]bool, error) {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("%s: expects dictionary", file)
+	}
+	blockStyle(doc)
+	sortKeys(doc, fileKeyOrder, false)
+	spaced := make(map[*yaml.Node]bool)
+	for i := 2; i < len(doc.Content); i += 2 {
+		// description stays together with name
+		if doc.Content[i].Value != "description" || doc.Content[i-2].Value != "name" {
+			spaced[doc.Content[i]] = true
+		}
+	}
+	for _, section := range []string{"templates", "targets", "commands"} {
+		_, targets := mappingValue(doc, section)
+		if targets == nil || targets.Kind != yaml.MappingNode {
+			continue
+		}
+		for i := 0; i+1 < len(targets.Content); i += 2 {
+			if i > 0 {
+				spaced[targets.Content[i]] = true
+			}
+			formatTarget(targets.Content[i+1])
+		}
+	}
+	return spaced, nil
+}
+
+// FormatFile returns the content of a project file in canonical format:
+// top-level properties and properties of targets are in canonical order,
+// dictionaries and lists are in block style, and blank lines separate
+// top-level properties and targets. Comments and other blank lines
+// are preserved
+func FormatFile(baseDir, path string) ([]byte, error) {
+	data, err := loadAndRender(filepath.Join(baseDir, path))
+	if err != nil {
+		return nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return data, nil
+	}
+	spaced, err := formatDoc(path, &doc)
+	if err != nil {
+		return nil, err
+	}
+	return encodeDoc(data, &doc, spaced)
+}
+
+// UnifiedDiff returns the changes from orig to updated of the file
+// in unified format, it's empty if the contents are identical
+func UnifiedDiff(path string, orig, updated []byte) string {
+	const context = 3
+	a, b := splitLines(orig), splitLines(updated)
+	// lcs[i][j] is the length of longest common lines of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	type edit struct {
+		op   byte
+		line string
+		// a and b are the line indices before the edit
+		a, b int
+	}
+	var edits []edit
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, edit{' ', a[i], i, j})
+			i++
+			j++
+		case j >= len(b) || (i < len(a) && lcs[i+1][j] >= lcs[i][j+1]):
+			edits = append(edits, edit{'-', a[i], i, j})
+			i++
+		default:
+			edits = append(edits, edit{'+', b[j], i, j})
+			j++
+		}
+	}
+
+	var out bytes.Buffer
+	for n := 0; n < len(edits); {
+		if edits[n].op == ' ' {
+			n++
+			continue
+		}
+		start, last := n-context, n
+		if start < 0 {
+			start = 0
+		}
+		for k := n; k < len(edits) && k-last <= context*2; k++ {
+			if edits[k].op != ' ' {
+				last = k
+			}
+		}
+		end := last + context + 1
+		if end > len(edits) {
+			end = len(edits)
+		}
+		if out.Len() == 0 {
+			fmt.Fprintf(&out, "--- a/%s\n+++ b/%s\n", filepath.ToSlash(path), filepath.ToSlash(path))
+		}
+		countA, countB := 0, 0
+		for _, e := range edits[start:end] {
+			if e.op != '+' {
+				countA++
+			}
+			if e.op != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&out, "@@ -%s +%s @@\n",
+			hunkRange(edits[start].a, countA), hunkRange(edits[start].b, countB))
+		for _, e := range edits[start:end] {
+			out.WriteByte(e.op)
+			out.WriteString(e.line)
+			if !strings.HasSuffix(e.line, "\n") {
+				out.WriteString("\n\\ No newline at end of file\n")
+			}
+		}
+		n = end
+	}
+	return out.String()
+}
+
+// splitLines splits content into lines with line endings kept
+func splitLines(content []byte) []string {
+	lines := strings.SplitAfter(string(content), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start+1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
@@ -0,0 +1,451 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Deprecation describes a property of target (or in settings of exec-driver)
+// in hypermake.v0 which is replaced in hypermake.v1
+type Deprecation struct {
+	// Path is the path to the property
+	Path []string
+	// Value only matches the property with the value if not empty
+	Value string
+	// Replace is the name of new property
+	Replace string
+	// NewValue is the value of new property, the value is unchanged if nil
+	NewValue interface{}
+}
+
+var (
+	deprecations = make(map[string][]Deprecation)
+)
+
+// RegisterDeprecations registers v0 properties replaced in v1, section is the
+// name of settings of exec-driver where the properties may also be defined
+func RegisterDeprecations(section string, items ...Deprecation) {
+	deprecations[section] = append(deprecations[section], items...)
+}
+
+func deprecationSections() []string {
+	sections := make([]string, 0, len(deprecations))
+	for section := range deprecations {
+		sections = append(sections, section)
+	}
+	sort.Strings(sections)
+	return sections
+}
+
+func (d *Deprecation) matchValue(val interface{}) bool {
+	return d.Value == "" || fmt.Sprint(val) == d.Value
+}
+
+// message describes the deprecation, prefix is prepended to the paths
+func (d *Deprecation) message(prefix string) string {
+	name := prefix + strings.Join(d.Path, ".")
+	if d.Value != "" {
+		name += ": " + d.Value
+	}
+	replace := prefix + strings.Join(append(d.Path[:len(d.Path)-1:len(d.Path)-1], d.Replace), ".")
+	if d.NewValue != nil {
+		replace += ": " + fmt.Sprint(d.NewValue)
+	}
+	return fmt.Sprintf("%s is deprecated, use %s instead", name, replace)
+}
+
+// upgradeProps applies deprecations to properties,
+// and returns the ones applied
+func upgradeProps(props map[string]interface{}, items []Deprecation) (applied []*Deprecation) {
+	for n := range items {
+		d := &items[n]
+		dict := props
+		for _, name := range d.Path[:len(d.Path)-1] {
+			if dict, _ = dict[name].(map[string]interface{}); dict == nil {
+				break
+			}
+		}
+		if dict == nil {
+			continue
+		}
+		name := d.Path[len(d.Path)-1]
+		val, exists := dict[name]
+		if !exists || !d.matchValue(val) {
+			continue
+		}
+		delete(dict, name)
+		if d.NewValue != nil {
+			val = d.NewValue
+		}
+		dict[d.Replace] = val
+		applied = append(applied, d)
+	}
+	return
+}
+
+// upgradeSettings applies deprecations to settings of exec-drivers,
+// and returns the messages of the ones applied
+func upgradeSettings(settings map[string]interface{}) (messages []string) {
+	for _, section := range deprecationSections() {
+		props, ok := settings[section].(map[string]interface{})
+		if !ok {
+			if s, isSettings := settings[section].(Settings); isSettings {
+				props, ok = s, true
+			}
+		}
+		if !ok {
+			continue
+		}
+		for _, d := range upgradeProps(props, deprecations[section]) {
+			messages = append(messages, d.message(section+"."))
+		}
+	}
+	return
+}
+
+// upgradeFlat applies deprecations to settings in a flat key/value map,
+// the map is returned as is if nothing is deprecated
+func upgradeFlat(flat map[string]interface{}) (map[string]interface{}, []string, error) {
+	settings := make(Settings)
+	if err := settings.MergeFlat(flat); err != nil {
+		return nil, nil, err
+	}
+	messages := upgradeSettings(settings)
+	if len(messages) == 0 {
+		return flat, nil, nil
+	}
+	upgraded := make(map[string]interface{})
+	flattenConfig("", settings, func(key string, val interface{}) {
+		upgraded[key] = val
+	})
+	return upgraded, messages, nil
+}
+
+// upgradeTargetProps applies all deprecations to properties of target
+func upgradeTargetProps(props map[string]interface{}) {
+	for _, section := range deprecationSections() {
+		upgradeProps(props, deprecations[section])
+	}
+	whens, _ := props["when"].([]interface{})
+	for _, when := range whens {
+		if dict, ok := when.(map[string]interface{}); ok {
+			upgradeTargetProps(dict)
+		}
+	}
+}
+
+// upgradeV0 converts the content of a hypermake.v0 file into hypermake.v1
+func upgradeV0(val map[string]interface{}) error {
+	val["format"] = Format
+	for _, section := range []string{"targets", "templates"} {
+		targets, _ := val[section].(map[string]interface{})
+		for _, t := range targets {
+			if props, ok := t.(map[string]interface{}); ok {
+				upgradeTargetProps(props)
+			}
+		}
+	}
+	for _, section := range []string{"settings", "local"} {
+		if settings, ok := val[section].(map[string]interface{}); ok {
+			upgradeSettings(settings)
+		}
+	}
+
+	// commands are targets with property command in v1
+	commands, _ := val["commands"].(map[string]interface{})
+	if len(commands) == 0 {
+		delete(val, "commands")
+		return nil
+	}
+	targets, _ := val["targets"].(map[string]interface{})
+	if targets == nil {
+		targets = make(map[string]interface{})
+		val["targets"] = targets
+	}
+	for name, cmd := range commands {
+		if _, exists := targets[name]; exists {
+			// reported by nodeUpgrader when validating
+			name = conflictName(name)
+			_, target := targets[name]
+			_, command := commands[name]
+			if target || command {
+				return fmt.Errorf("duplicate command/target name %s", name)
+			}
+		}
+		props, _ := cmd.(map[string]interface{})
+		if props == nil {
+			props = make(map[string]interface{})
+		}
+		upgradeTargetProps(props)
+		props["command"] = true
+		targets[name] = props
+	}
+	delete(val, "commands")
+	return nil
+}
+
+// conflictName is the new name of a command conflicting with a target,
+// as both are targets in hypermake.v1
+func conflictName(name string) string {
+	return name + "-command"
+}
+
+// nodeUpgrader upgrades hypermake.v0 file in yaml nodes and
+// records the positions of deprecated properties
+type nodeUpgrader struct {
+	file  string
+	diags []*Diagnostic
+}
+
+func mappingValue(node *yaml.Node, name string) (key, val *yaml.Node) {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil, nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == name {
+			return node.Content[i], node.Content[i+1]
+		}
+	}
+	return nil, nil
+}
+
+func (u *nodeUpgrader) deprecated(node *yaml.Node, format string, args ...interface{}) {
+	u.diags = append(u.diags, &Diagnostic{
+		File:       u.file,
+		Line:       node.Line,
+		Column:     node.Column,
+		Message:    fmt.Sprintf(format, args...),
+		Deprecated: true,
+	})
+}
+
+func (u *nodeUpgrader) upgradeProps(where string, node *yaml.Node, items []Deprecation) {
+	for n := range items {
+		d := &items[n]
+		dict := node
+		for _, name := range d.Path[:len(d.Path)-1] {
+			_, dict = mappingValue(dict, name)
+		}
+		key, val := mappingValue(dict, d.Path[len(d.Path)-1])
+		if key == nil || val.Kind != yaml.ScalarNode || !d.matchValue(val.Value) {
+			continue
+		}
+		u.deprecated(key, "%s: %s", where, d.message(""))
+		key.Value = d.Replace
+		if d.NewValue != nil {
+			newVal := &yaml.Node{}
+			if err := newVal.Encode(d.NewValue); err == nil {
+				val.Tag, val.Value, val.Style = newVal.Tag, newVal.Value, newVal.Style
+			}
+		}
+	}
+}
+
+func (u *nodeUpgrader) upgradeTarget(where string, node *yaml.Node) {
+	for _, section := range deprecationSections() {
+		u.upgradeProps(where, node, deprecations[section])
+	}
+	if _, whens := mappingValue(node, "when"); whens != nil && whens.Kind == yaml.SequenceNode {
+		for _, when := range whens.Content {
+			u.upgradeTarget(where, when)
+		}
+	}
+}
+
+func (u *nodeUpgrader) upgrade(doc *yaml.Node) error {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: expects dictionary", u.file)
+	}
+	if _, format := mappingValue(doc, "format"); format != nil {
+		format.Value = Format
+	}
+	for _, section := range []string{"targets", "templates"} {
+		_, targets := mappingValue(doc, section)
+		if targets == nil || targets.Kind != yaml.MappingNode {
+			continue
+		}
+		kind := strings.TrimSuffix(section, "s")
+		for i := 0; i+1 < len(targets.Content); i += 2 {
+			u.upgradeTarget(kind+" "+targets.Content[i].Value, targets.Content[i+1])
+		}
+	}
+	for _, section := range []string{"settings", "local"} {
+		_, settings := mappingValue(doc, section)
+		for _, name := range deprecationSections() {
+			if _, props := mappingValue(settings, name); props != nil {
+				u.upgradeProps(section, props, deprecations[name])
+			}
+		}
+	}
+	return u.upgradeCommands(doc)
+}
+
+// upgradeCommands moves commands into targets with property command
+func (u *nodeUpgrader) upgradeCommands(doc *yaml.Node) error {
+	var cmdKey, commands *yaml.Node
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		if doc.Content[i].Value == "commands" {
+			cmdKey, commands = doc.Content[i], doc.Content[i+1]
+			doc.Content = append(doc.Content[:i], doc.Content[i+2:]...)
+			break
+		}
+	}
+	if cmdKey == nil || commands.Kind != yaml.MappingNode || len(commands.Content) == 0 {
+		return nil
+	}
+	u.deprecated(cmdKey, "commands is deprecated, use targets with command: true instead")
+	_, targets := mappingValue(doc, "targets")
+	if targets == nil {
+		// commands becomes targets
+		cmdKey.Value = "targets"
+		doc.Content = append(doc.Content, cmdKey, commands)
+		targets = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	} else if cmdKey.HeadComment != "" && len(commands.Content) > 0 {
+		// keep the comment and the position of commands for the first command
+		commands.Content[0].HeadComment = cmdKey.HeadComment
+		commands.Content[0].Line = cmdKey.Line
+	}
+	for i := 0; i+1 < len(commands.Content); i += 2 {
+		name, cmd := commands.Content[i], commands.Content[i+1]
+		if key, _ := mappingValue(targets, name.Value); key != nil {
+			renamed := conflictName(name.Value)
+			if key, _ = mappingValue(targets, renamed); key == nil {
+				key, _ = mappingValue(commands, renamed)
+			}
+			if key != nil {
+				return fmt.Errorf("%s: duplicate command/target name %s", u.file, renamed)
+			}
+			u.deprecated(name, "command %s conflicts with target %s, renamed to %s, run hmake migrate to update the file",
+				name.Value, name.Value, renamed)
+			name.Value = renamed
+		}
+		u.upgradeTarget("command "+name.Value, cmd)
+		if cmd.Kind != yaml.MappingNode {
+			cmd.Kind, cmd.Tag, cmd.Value = yaml.MappingNode, "!!map", ""
+		}
+		cmd.Content = append([]*yaml.Node{
+			{Kind: yaml.ScalarNode, Tag: "!!str", Value: "command"},
+			{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"},
+		}, cmd.Content...)
+		if targets != commands {
+			targets.Content = append(targets.Content, name, cmd)
+		}
+	}
+	return nil
+}
+
+func parseFormat(doc *yaml.Node) string {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	_, format := mappingValue(doc, "format")
+	if format == nil {
+		return ""
+	}
+	return format.Value
+}
+
+// MigrateFile rewrites a hypermake.v0 file into the latest format,
+// comments and the order of properties are preserved, and the
+// deprecated properties are reported. The content is nil if the file
+// is already in latest format
+func MigrateFile(baseDir, path string) ([]byte, []*Diagnostic, error) {
+	data, err := loadAndRender(filepath.Join(baseDir, path))
+	if err != nil {
+		return nil, nil, err
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, nil, fmt.Errorf("%s: %v", path, err)
+	}
+	switch parseFormat(&doc) {
+	case Format:
+		return nil, nil, nil
+	case FormatV0:
+	default:
+		return nil, nil, fmt.Errorf("%s: %v", path, ErrUnsupportedFormat)
+	}
+	u := &nodeUpgrader{file: path}
+	if err = u.upgrade(&doc); err != nil {
+		return nil, nil, err
+	}
+	migrated, err := encodeDoc(data, &doc, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	return migrated, u.diags, nil
+}
+
+// encodeDoc encodes the yaml nodes parsed from the original content,
+// blank lines before properties and the document start are kept
+func encodeDoc(data []byte, doc *yaml.Node, spaced map[*yaml.Node]bool) ([]byte, error) {
+	var out strings.Builder
+	enc := yaml.NewEncoder(&out)
+	enc.SetIndent(4)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	enc.Close()
+	encoded, err := keepBlankLines(string(data), doc, out.String(), spaced)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(string(data), "---") && !strings.HasPrefix(encoded, "---") {
+		encoded = "---\n" + encoded
+	}
+	return []byte(encoded), nil
+}
+
+func commentLines(comment string) int {
+	if comment == "" {
+		return 0
+	}
+	return strings.Count(comment, "\n") + 1
+}
+
+// keepBlankLines restores the blank lines before properties in original
+// content which are dropped by yaml encoder, and adds blank lines before
+// the properties in spaced. The encoded content is parsed again to locate
+// the properties as the structure is identical
+func keepBlankLines(orig string, doc *yaml.Node, encoded string, spaced map[*yaml.Node]bool) (string, error) {
+	var encodedDoc yaml.Node
+	if err := yaml.Unmarshal([]byte(encoded), &encodedDoc); err != nil {
+		return "", err
+	}
+	origLines, lines := strings.Split(orig, "\n"), strings.Split(encoded, "\n")
+	// the index of the line above the property and its comments
+	above := func(key *yaml.Node) int {
+		return key.Line - 2 - commentLines(key.HeadComment)
+	}
+	blanks := make(map[int]bool)
+	var walk func(node, encodedNode *yaml.Node)
+	walk = func(node, encodedNode *yaml.Node) {
+		if node.Kind != encodedNode.Kind || len(node.Content) != len(encodedNode.Content) {
+			return
+		}
+		for n, child := range node.Content {
+			if node.Kind == yaml.MappingNode && n%2 == 0 && child.Line > 0 {
+				if l := above(child); spaced[child] || (l >= 0 && l < len(origLines) && strings.TrimSpace(origLines[l]) == "") {
+					blanks[above(encodedNode.Content[n])+1] = true
+				}
+			}
+			walk(child, encodedNode.Content[n])
+		}
+	}
+	walk(doc, &encodedDoc)
+	result := make([]string, 0, len(lines)+len(blanks))
+	for n, line := range lines {
+		if blanks[n] && len(result) > 0 {
+			result = append(result, "")
+		}
+		result = append(result, line)
+	}
+	return strings.Join(result, "\n"), nil
+}
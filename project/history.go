@@ -0,0 +1,49 @@
+package project
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"time"
+)
+
+// History is the durations of the last successful executions of targets,
+// it's used to estimate the time of executions
+type History map[string]time.Duration
+
+// History loads the durations of targets, it's empty if nothing
+// has been executed
+func (p *Project) History() History {
+	history := make(History)
+	data, err := ioutil.ReadFile(p.HistoryFile())
+	if err == nil {
+		json.Unmarshal(data, &history)
+	}
+	return history
+}
+
+// saveHistory records the durations of targets executed successfully,
+// skipped targets and the executions in exec mode are not recorded
+func (p *ExecPlan) saveHistory() {
+	if p.DryRun {
+		return
+	}
+	history := p.Project.History()
+	updated := false
+	for _, t := range p.FinishedTasks {
+		if t.Result != Success || t.Target.Exec || t.Target.IsTransit() {
+			continue
+		}
+		history[t.Name()] = t.Duration()
+		updated = true
+	}
+	if !updated {
+		return
+	}
+	encoded, err := json.Marshal(history)
+	if err == nil {
+		err = ioutil.WriteFile(p.Project.HistoryFile(), encoded, 0644)
+	}
+	if err != nil {
+		p.Logf("Write history failed: %v", err)
+	}
+}
@@ -0,0 +1,48 @@
+// +build windows
+
+package project
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	kernel32         = syscall.NewLazyDLL("kernel32.dll")
+	procLockFileEx   = kernel32.NewProc("LockFileEx")
+	procUnlockFileEx = kernel32.NewProc("UnlockFileEx")
+)
+
+const (
+	lockfileFailImmediately = 0x1
+	lockfileExclusiveLock   = 0x2
+
+	errorLockViolation syscall.Errno = 33
+)
+
+// lockRegion returns the locked region which is far beyond the content,
+// as the locked region can't be read by other processes on Windows
+func lockRegion() *syscall.Overlapped {
+	return &syscall.Overlapped{Offset: 0, OffsetHigh: 0x7fffffff}
+}
+
+func lockFile(f *os.File) error {
+	flags := uintptr(lockfileFailImmediately | lockfileExclusiveLock)
+	r, _, err := procLockFileEx.Call(f.Fd(), flags, 0, 1, 0, uintptr(unsafe.Pointer(lockRegion())))
+	if r != 0 {
+		return nil
+	}
+	if err == errorLockViolation {
+		return errLockHeld
+	}
+	return err
+}
+
+func unlockFile(f *os.File) error {
+	r, _, err := procUnlockFileEx.Call(f.Fd(), 0, 1, 0, uintptr(unsafe.Pointer(lockRegion())))
+	if r != 0 {
+		return nil
+	}
+	return err
+}
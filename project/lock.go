@@ -0,0 +1,110 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// Lock modes of ExecPlan
+const (
+	// LockProject allows only one plan executed in the project,
+	// and targets are locked as LockTarget does
+	LockProject = "project"
+	// LockTarget only locks the targets being executed, plans without
+	// overlapping targets are executed concurrently, and overlapping
+	// targets wait for each other
+	LockTarget = "target"
+	// LockNone disables locking
+	LockNone = "none"
+)
+
+// LockRetryInterval is the interval to retry the tasks waiting for
+// targets locked by other processes
+var LockRetryInterval = 500 * time.Millisecond
+
+// lockSuffix is the suffix of target lock file in WorkPath, it never
+// conflicts with LockFileName
+const lockSuffix = ".target.lock"
+
+// errLockHeld is returned by lockFile if the lock is held by others
+var errLockHeld = fmt.Errorf("lock held")
+
+// LockHolder describes the process holding an exclusive lock
+type LockHolder struct {
+	PID     int    `json:"pid"`
+	Command string `json:"command"`
+}
+
+// LockedError indicates the lock is held by another process
+type LockedError struct {
+	Path string
+	// Holder is nil if unknown
+	Holder *LockHolder
+}
+
+func (e *LockedError) Error() string {
+	if e.Holder == nil {
+		return fmt.Sprintf("%s is locked by another process", e.Path)
+	}
+	return fmt.Sprintf("%s is locked by PID %d: %s", e.Path, e.Holder.PID, e.Holder.Command)
+}
+
+// Lock is an exclusive advisory lock on a file, it's released automatically
+// when the process exits
+type Lock struct {
+	Path string
+
+	file *os.File
+}
+
+// TryLock acquires the lock on the file without waiting, LockedError is
+// returned if it's held by another process. The holder writes the PID and
+// command line into the file
+func TryLock(path string) (*Lock, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(f); err != nil {
+		f.Close()
+		if err == errLockHeld {
+			return nil, &LockedError{Path: path, Holder: ReadLockHolder(path)}
+		}
+		return nil, err
+	}
+	encoded, _ := json.Marshal(&LockHolder{
+		PID:     os.Getpid(),
+		Command: strings.Join(os.Args, " "),
+	})
+	f.Truncate(0)
+	f.WriteAt(encoded, 0)
+	return &Lock{Path: path, file: f}, nil
+}
+
+// ReadLockHolder reads the holder of the lock from the file,
+// it returns nil if unknown
+func ReadLockHolder(path string) *LockHolder {
+	data, err := ioutil.ReadFile(path)
+	if err != nil || len(data) == 0 {
+		return nil
+	}
+	var holder LockHolder
+	if json.Unmarshal(data, &holder) != nil || holder.PID == 0 {
+		return nil
+	}
+	return &holder
+}
+
+// Unlock releases the lock
+func (l *Lock) Unlock() error {
+	l.file.Truncate(0)
+	err := unlockFile(l.file)
+	if e := l.file.Close(); err == nil {
+		err = e
+	}
+	return err
+}
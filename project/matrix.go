@@ -0,0 +1,112 @@
+package project
+
+import (
+	"fmt"
+)
+
+// SettingMatrix is the property name of matrix in settings
+const SettingMatrix = "matrix"
+
+// Matrix defines named value sets referenced by expandable target names
+type Matrix map[string][]string
+
+// TargetMatrix adjusts the combinations of an expandable target
+type TargetMatrix struct {
+	// Exclude removes the combinations matching all values in any entry
+	Exclude []map[string]string `map:"exclude"`
+	// Include adds extra combinations
+	Include []map[string]string `map:"include"`
+}
+
+// mergeFrom returns a new matrix with value sets in settings overriding m
+func (m Matrix) mergeFrom(settings Settings) (Matrix, error) {
+	var own Matrix
+	if err := settings.GetBy(SettingMatrix, &own); err != nil {
+		return nil, err
+	}
+	if len(own) == 0 {
+		return m, nil
+	}
+	merged := make(Matrix)
+	for name, values := range m {
+		merged[name] = values
+	}
+	for name, values := range own {
+		merged[name] = values
+	}
+	return merged, nil
+}
+
+func matchVars(vars, filter map[string]string) bool {
+	for k, v := range filter {
+		if vars[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+func sameVars(vars1, vars2 map[string]string) bool {
+	return len(vars1) == len(vars2) && matchVars(vars1, vars2)
+}
+
+// combinations generates variables for each target expanded from tokens
+func (m *TargetMatrix) combinations(tokens []expToken) ([]map[string]string, error) {
+	combos := []map[string]string{make(map[string]string)}
+	for _, token := range tokens {
+		if token.name == "" {
+			continue
+		}
+		expanded := make([]map[string]string, 0, len(combos)*len(token.values))
+		for _, vars := range combos {
+			for _, val := range token.values {
+				v := make(map[string]string)
+				for k, val := range vars {
+					v[k] = val
+				}
+				v[token.name] = val
+				expanded = append(expanded, v)
+			}
+		}
+		combos = expanded
+	}
+	if m == nil {
+		return combos, nil
+	}
+	if len(combos) == 1 && len(combos[0]) == 0 {
+		return nil, fmt.Errorf("matrix requires expandable target name")
+	}
+
+	result := make([]map[string]string, 0, len(combos))
+	for _, vars := range combos {
+		excluded := false
+		for _, filter := range m.Exclude {
+			if matchVars(vars, filter) {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			result = append(result, vars)
+		}
+	}
+
+	for _, vars := range m.Include {
+		for _, token := range tokens {
+			if token.name != "" && vars[token.name] == "" {
+				return nil, fmt.Errorf("matrix include %v missing %s", vars, token.name)
+			}
+		}
+		exists := false
+		for _, combo := range result {
+			if sameVars(combo, vars) {
+				exists = true
+				break
+			}
+		}
+		if !exists {
+			result = append(result, vars)
+		}
+	}
+	return result, nil
+}
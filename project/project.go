@@ -21,8 +21,10 @@ import (
 )
 
 const (
-	// Format is the supported format
-	Format = "hypermake.v0"
+	// Format is the latest supported format
+	Format = "hypermake.v1"
+	// FormatV0 is the legacy format which is upgraded when loaded
+	FormatV0 = "hypermake.v0"
 	// RcFile is the filename of local setting file to override some settings
 	RcFile = ".hmakerc"
 	// WorkFolder is the name of project WorkFolder
@@ -31,8 +33,18 @@ const (
 	SummaryFileName = "hmake.summary.json"
 	// LogFileName is the filename of hmake debug log
 	LogFileName = "hmake.debug.log"
+	// LockFileName is the filename of project lock
+	LockFileName = "hmake.lock"
+	// SocketFileName is the filename of unix socket served by hmake serve
+	SocketFileName = "hmake.sock"
+	// TokenFileName is the filename of the token required by hmake serve on TCP
+	TokenFileName = "serve.token"
+	// HistoryFileName is the filename of durations of targets
+	HistoryFileName = "hmake.history.json"
 	// WrapperMagic is the magic string at the beginning of the file
 	WrapperMagic = "#hmake-wrapper"
+	// WrapperTargetMagic starts a target section in wrapper file
+	WrapperTargetMagic = "#hmake-target"
 	// WrapperName is project name for wrapped project
 	WrapperName = "wrapper"
 	// WrapperDesc is project description for wrapped project
@@ -69,19 +81,25 @@ type File struct {
 	Desc string `map:"description"`
 	// Targets are targets defined in current file
 	Targets map[string]*Target `map:"targets"`
-	// Commands are targets used as commands
-	Commands map[string]*Target `map:"commands"`
+	// Templates are abstract targets extended by targets
+	Templates map[string]*Target `map:"templates"`
 	// Settings are properties
 	Settings Settings `map:"settings"`
 	// Local are properties only applied to file
 	Local Settings `map:"local"`
 	// Includes are patterns for sourcing external files
 	Includes []string `map:"includes"`
+	// Secrets are sources of secret values used by targets
+	Secrets map[string]*Secret `map:"secrets"`
+	// Projects are sub-projects by name and path
+	Projects map[string]string `map:"projects"`
 
 	// Source is the relative path to the project
 	Source string `map:"-"`
 	// WrapperTarget specifies the default target in wrapper mode
 	WrapperTarget string `map:"-"`
+	// Wrapper indicates the file is in wrapper format
+	Wrapper bool `map:"-"`
 }
 
 // Project is the world view of hmake
@@ -94,12 +112,29 @@ type Project struct {
 	LaunchPath string
 	// MasterFile is the file with everything merged
 	MasterFile File
+	// Parent is the project including this one as a sub-project
+	Parent *Project
+	// Namespace prefixes the names of targets in sub-project
+	Namespace string
+	// SubProjects are loaded from projects
+	SubProjects map[string]*Project
 
 	// All loaded make files
 	Files []*File
 
 	// Tasks are built from resolved targets
 	Targets TargetNameMap
+	// DisabledTargets are targets disabled by conditions
+	DisabledTargets TargetNameMap
+
+	// settings of sub-project before inheriting from parent
+	settings Settings
+	// invalid are files (relative to BaseDir) failed to load,
+	// including the ones in sub-projects
+	invalid []string
+	// deprecated are deprecated settings merged from
+	// configuration and command line
+	deprecated []*Diagnostic
 }
 
 // CommonSettings are well known settings
@@ -107,6 +142,7 @@ type CommonSettings struct {
 	DefaultTargets []string `map:"default-targets"`
 	ExecTarget     string   `map:"exec-target"`
 	ExecShell      string   `map:"exec-shell"`
+	ExecPersistent bool     `map:"exec-persistent"`
 }
 
 func loadAndRender(fn string) ([]byte, error) {
@@ -167,6 +203,7 @@ func loadAsWrapper(fn string) (*File, error) {
 		Desc:     WrapperDesc,
 		Targets:  make(map[string]*Target),
 		Settings: make(Settings),
+		Wrapper:  true,
 	}
 
 	buildFrom := ""
@@ -194,6 +231,13 @@ func loadAsWrapper(fn string) (*File, error) {
 		}
 		projFile.Targets[t.Name] = t
 	}
+	content, err := ioutil.ReadAll(rd)
+	if err != nil {
+		return nil, err
+	}
+	if hasWrapperTargets(content) {
+		return projFile, loadWrapperTargets(projFile, image, buildFrom != "", content)
+	}
 	t := &Target{
 		Name:   "build",
 		Desc:   "wrapped build target",
@@ -202,10 +246,6 @@ func loadAsWrapper(fn string) (*File, error) {
 			"image": image,
 		},
 	}
-	content, err := ioutil.ReadAll(rd)
-	if err != nil {
-		return nil, err
-	}
 	content = bytes.TrimSpace(content)
 	if len(content) > 0 {
 		if bytes.HasPrefix(content, []byte("#!")) {
@@ -228,7 +268,107 @@ func loadAsWrapper(fn string) (*File, error) {
 	return projFile, nil
 }
 
-var expandableTargetPattern = regexp.MustCompile(`^(\w+):(([\w-\.]+,)*)([\w-\.]+)$`)
+func hasWrapperTargets(content []byte) bool {
+	for _, line := range strings.Split(string(content), "\n") {
+		if strings.HasPrefix(line, WrapperTargetMagic+" ") {
+			return true
+		}
+	}
+	return false
+}
+
+func wrapperScript(shebang string, lines []string) string {
+	script := strings.TrimSpace(strings.Join(lines, "\n"))
+	if strings.HasPrefix(script, "#!") {
+		return script
+	}
+	return shebang + "\n" + script
+}
+
+// loadWrapperTargets creates targets from "#hmake-target NAME [KEY=VALUE ...]"
+// sections, the lines before the first section are shared by all targets.
+// Supported keys are after, watches (both comma separated) and image
+func loadWrapperTargets(f *File, image string, toolchain bool, content []byte) error {
+	type section struct {
+		target *Target
+		lines  []string
+	}
+	var prelude []string
+	var sections []*section
+	for _, line := range strings.Split(string(content), "\n") {
+		if !strings.HasPrefix(line, WrapperTargetMagic+" ") {
+			if len(sections) == 0 {
+				prelude = append(prelude, line)
+			} else {
+				s := sections[len(sections)-1]
+				s.lines = append(s.lines, line)
+			}
+			continue
+		}
+		tokens := strings.Fields(line[len(WrapperTargetMagic)+1:])
+		if len(tokens) == 0 {
+			return fmt.Errorf("target name missing after %s", WrapperTargetMagic)
+		}
+		t := &Target{
+			Name: tokens[0],
+			Desc: "wrapped target",
+			Ext:  map[string]interface{}{"image": image},
+		}
+		if f.Targets[t.Name] != nil {
+			return fmt.Errorf("duplicated target %s", t.Name)
+		}
+		for _, token := range tokens[1:] {
+			kv := strings.SplitN(token, "=", 2)
+			if len(kv) != 2 || kv[1] == "" {
+				return fmt.Errorf("%s %s: invalid %s, expect KEY=VALUE", WrapperTargetMagic, t.Name, token)
+			}
+			switch kv[0] {
+			case "after":
+				t.After = append(t.After, strings.Split(kv[1], ",")...)
+			case "watches":
+				t.Watches = append(t.Watches, strings.Split(kv[1], ",")...)
+			case "image":
+				t.Ext["image"] = kv[1]
+			default:
+				return fmt.Errorf("%s %s: unknown key %s", WrapperTargetMagic, t.Name, kv[0])
+			}
+		}
+		if toolchain {
+			t.After = append(t.After, "toolchain")
+		}
+		f.Targets[t.Name] = t
+		sections = append(sections, &section{target: t})
+	}
+
+	// the interpreter of the script is shared by all targets
+	shebang := "#!/bin/sh"
+	for n, line := range prelude {
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#!") {
+			shebang, prelude = line, prelude[n+1:]
+		}
+		break
+	}
+	var names []string
+	for _, s := range sections {
+		shared := prelude
+		if lines := strings.TrimSpace(strings.Join(s.lines, "\n")); strings.HasPrefix(lines, "#!") {
+			shared = nil
+		}
+		s.target.Ext["script"] = wrapperScript(shebang, append(append([]string{}, shared...), s.lines...))
+		names = append(names, s.target.Name)
+	}
+	f.Settings["default-targets"] = names
+	f.Settings["exec-target"] = names[0]
+	return nil
+}
+
+var (
+	expandableTargetPattern = regexp.MustCompile(`^(\w+):(([\w-\.]+,)*)([\w-\.]+)$`)
+	matrixRefPattern        = regexp.MustCompile(`^\w+$`)
+)
 
 type expToken struct {
 	name   string
@@ -236,7 +376,7 @@ type expToken struct {
 	text   string
 }
 
-func parseTarget(name string) (tokens []expToken, err error) {
+func parseTarget(name string, matrix Matrix) (tokens []expToken, err error) {
 	str := name
 	for len(str) > 0 {
 		pos := strings.Index(str, "[")
@@ -249,10 +389,19 @@ func parseTarget(name string) (tokens []expToken, err error) {
 				return nil, fmt.Errorf("invalid expandable target name: %s: missing ]", name)
 			}
 			token := expToken{text: str[pos+1 : pos+pos1]}
+			str = str[pos+pos1+1:]
+			if matrixRefPattern.MatchString(token.text) {
+				token.name = token.text
+				token.values = matrix[token.name]
+				if len(token.values) == 0 {
+					return nil, fmt.Errorf("invalid expandable target name: %s: matrix %s not defined", name, token.name)
+				}
+				tokens = append(tokens, token)
+				continue
+			}
 			if !expandableTargetPattern.MatchString(token.text) {
 				return nil, fmt.Errorf("invalid expandable target name: %s: bad format: %s", name, token.text)
 			}
-			str = str[pos+pos1+1:]
 
 			pos = strings.Index(token.text, ":")
 			token.name = token.text[:pos]
@@ -331,6 +480,8 @@ func substInterface(vars map[string]string, v interface{}) interface{} {
 		return substString(vars, val)
 	case []interface{}:
 		return substSlice(vars, val)
+	case []string:
+		return substStrings(vars, val)
 	case map[string]interface{}:
 		return substMap(vars, val)
 	default:
@@ -351,32 +502,50 @@ func buildTarget(origin *Target, name string, vars map[string]string, result map
 		WorkDir:    substString(vars, origin.WorkDir),
 		Watches:    substStrings(vars, origin.Watches),
 		Artifacts:  substStrings(vars, origin.Artifacts),
+		Secrets:    substStrings(vars, origin.Secrets),
+		Tags:       substStrings(vars, origin.Tags),
 		Ext:        substMap(vars, origin.Ext),
 		Always:     origin.Always,
+		Command:    origin.Command,
+		ArgDefs:    origin.ArgDefs,
+		If:         substString(vars, origin.If),
+	}
+	t.alwaysSet, t.commandSet = origin.alwaysSet, origin.commandSet
+	for _, when := range origin.When {
+		t.When = append(t.When, substMap(vars, when))
+	}
+	if len(vars) > 0 {
+		t.Vars = make(map[string]string)
+		for k, v := range vars {
+			t.Vars[k] = v
+		}
 	}
 	result[name] = t
 	return nil
 }
 
-func constructTargets(tokens []expToken, prefix string, n int,
-	t *Target, vars map[string]string, result map[string]*Target) error {
-	if n >= len(tokens) {
-		return buildTarget(t, prefix, vars, result)
+func constructTargets(tokens []expToken, t *Target, result map[string]*Target) error {
+	combos, err := t.Matrix.combinations(tokens)
+	if err != nil {
+		return err
 	}
-	if name := tokens[n].name; name != "" {
-		for _, val := range tokens[n].values {
-			vars[name] = val
-			if err := constructTargets(tokens, prefix+val, n+1, t, vars, result); err != nil {
-				return err
+	for _, vars := range combos {
+		name := ""
+		for _, token := range tokens {
+			if token.name != "" {
+				name += vars[token.name]
+			} else {
+				name += token.text
 			}
 		}
-	} else {
-		return constructTargets(tokens, prefix+tokens[n].text, n+1, t, vars, result)
+		if err = buildTarget(t, name, vars, result); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
-func expandTargets(origin map[string]*Target) (map[string]*Target, error) {
+func expandTargets(origin map[string]*Target, matrix Matrix) (map[string]*Target, error) {
 	keys := make([]string, 0, len(origin))
 	for key := range origin {
 		keys = append(keys, key)
@@ -384,13 +553,13 @@ func expandTargets(origin map[string]*Target) (map[string]*Target, error) {
 
 	result := make(map[string]*Target)
 	for _, key := range keys {
-		tokens, err := parseTarget(key)
+		tokens, err := parseTarget(key, matrix)
 		if err != nil {
 			return nil, err
 		}
-		err = constructTargets(tokens, "", 0, origin[key], make(map[string]string), result)
+		err = constructTargets(tokens, origin[key], result)
 		if err != nil {
-			return nil, err
+			return nil, fmt.Errorf("%s: %v", key, err)
 		}
 	}
 	return result, nil
@@ -398,6 +567,11 @@ func expandTargets(origin map[string]*Target) (map[string]*Target, error) {
 
 // LoadFile loads from specified path
 func LoadFile(baseDir, path string, allowWrapper bool) (*File, error) {
+	return loadFile(baseDir, path, allowWrapper, nil)
+}
+
+// loadFile loads from specified path with matrix inherited from project
+func loadFile(baseDir, path string, allowWrapper bool, matrix Matrix) (*File, error) {
 	fn := filepath.Join(baseDir, path)
 	if allowWrapper {
 		if f, err := loadAsWrapper(fn); err != nil || f != nil {
@@ -410,36 +584,38 @@ func LoadFile(baseDir, path string, allowWrapper bool) (*File, error) {
 		return nil, err
 	}
 
-	if format, ok := val["format"].(string); !ok || format != Format {
+	switch format, _ := val["format"].(string); format {
+	case Format:
+	case FormatV0:
+		if err = upgradeV0(val); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	default:
 		return nil, fmt.Errorf("unsupported format: " + format)
 	}
 
-	f := &File{}
+	f := &File{Source: path}
 	err = mapper.Map(f, val)
 	if err != nil {
 		return nil, err
 	}
-	f.Targets, err = expandTargets(f.Targets)
-	if err != nil {
+	markTargets(f.Targets, val["targets"])
+	markTargets(f.Templates, val["templates"])
+	if err = resolveTemplates(f); err != nil {
 		return nil, err
 	}
-	f.Source = path
-	// merge commands into targets
-	var errs errors.AggregatedError
-	if f.Commands != nil {
-		for name, t := range f.Commands {
-			t.Command = true
-			if _, exists := f.Targets[name]; exists {
-				errs.Add(fmt.Errorf("duplicate command/target name %s", name))
-			} else {
-				f.Targets[name] = t
-			}
-		}
+	if matrix, err = matrix.mergeFrom(f.Settings); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
-	return f, errs.Aggregate()
+	f.Targets, err = expandTargets(f.Targets, matrix)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
 }
 
-// LocateProjectFrom creates a project by locating the root file from startDir
+// LocateProjectFrom creates a project by locating the root file from startDir,
+// if the root file is found but fails to load, the project is also returned
 func LocateProjectFrom(startDir, projectFile string) (*Project, error) {
 	wd, err := filepath.Abs(startDir)
 	if err != nil {
@@ -454,7 +630,8 @@ func LocateProjectFrom(startDir, projectFile string) (*Project, error) {
 			return p, nil
 		}
 		if !os.IsNotExist(err) {
-			return nil, err
+			// the project is returned for validating the file
+			return p, err
 		}
 		dir := filepath.Dir(wd)
 		if dir == wd {
@@ -555,6 +732,28 @@ func (f *File) Merge(s *File) error {
 	}
 	errs.Add(f.Settings.Merge(s.Settings))
 
+	if f.Secrets == nil {
+		f.Secrets = make(map[string]*Secret)
+	}
+	for name, secret := range s.Secrets {
+		if _, exist := f.Secrets[name]; exist {
+			errs.Add(fmt.Errorf("duplicated secret %s defined in %s", name, s.Source))
+		} else {
+			f.Secrets[name] = secret
+		}
+	}
+
+	if f.Projects == nil {
+		f.Projects = make(map[string]string)
+	}
+	for name, path := range s.Projects {
+		if _, exist := f.Projects[name]; exist {
+			errs.Add(fmt.Errorf("duplicated project %s defined in %s", name, s.Source))
+		} else {
+			f.Projects[name] = RelPath(s.Source, path)
+		}
+	}
+
 	for _, inc := range s.Includes {
 		path := RelPath(s.Source, inc)
 		found := false
@@ -578,8 +777,15 @@ func (p *Project) Load(path string) (*File, error) {
 			return f, nil
 		}
 	}
-	f, err := LoadFile(p.BaseDir, path, len(p.Files) == 0)
+	var matrix Matrix
+	if err := p.MasterFile.Settings.GetBy(SettingMatrix, &matrix); err != nil {
+		return nil, err
+	}
+	f, err := loadFile(p.BaseDir, path, len(p.Files) == 0, matrix)
 	if err != nil {
+		if !os.IsNotExist(err) {
+			p.invalid = append(p.invalid, path)
+		}
 		return nil, err
 	}
 	for name, t := range f.Targets {
@@ -661,26 +867,55 @@ func (p *Project) Resolve() error {
 			errs.Add(err)
 		}
 	}
+	errs.Add(p.loadSubProjects())
 	return errs.Aggregate()
 }
 
 // Finalize builds up the relationship between targets and settings
 // and also verifies any cyclic dependencies
 func (p *Project) Finalize() error {
-	errs := errors.AggregatedError{}
-	p.Targets = make(TargetNameMap)
-	for name, t := range p.MasterFile.Targets {
-		t.Initialize(name, p)
-		errs.Add(p.Targets.Add(t))
-	}
+	errs := &errors.AggregatedError{}
+	errs.Add(p.CollectTargets())
 	errs.AddMany(
-		p.Targets.BuildDeps(),
+		p.Targets.BuildDepsWith(p.DisabledTargets),
 		p.Targets.CheckCyclicDeps(),
 	)
 
 	return errs.Aggregate()
 }
 
+// CollectTargets gathers targets of the project and sub-projects into
+// Targets and DisabledTargets without building up the dependencies,
+// it's cheaper than Finalize when only names of targets are needed
+func (p *Project) CollectTargets() error {
+	errs := &errors.AggregatedError{}
+	p.Targets = make(TargetNameMap)
+	p.DisabledTargets = make(TargetNameMap)
+	p.collectTargets(p, errs)
+	return errs.Aggregate()
+}
+
+// collectTargets adds targets of the project and sub-projects into root
+func (p *Project) collectTargets(root *Project, errs *errors.AggregatedError) {
+	for name, t := range p.MasterFile.Targets {
+		t.Initialize(p.Namespace+name, p)
+		if errs.Add(t.applyConditions()) || errs.Add(t.checkArgDefs()) || errs.Add(t.checkTags()) {
+			continue
+		}
+		if t.Disabled != "" {
+			root.DisabledTargets[t.Name] = t
+			continue
+		}
+		errs.Add(root.Targets.Add(t))
+	}
+	for _, name := range p.SubProjectNames() {
+		sub := p.SubProjects[name]
+		if !errs.Add(sub.inheritSettings()) {
+			sub.collectTargets(root, errs)
+		}
+	}
+}
+
 // Plan creates an ExecPlan for this project
 func (p *Project) Plan() *ExecPlan {
 	return NewExecPlan(p)
@@ -694,6 +929,34 @@ func (p *Project) IsCommand(name string) bool {
 	return false
 }
 
+// SelectTargets resolves the targets to run from the arguments on command
+// line: in wrapper mode, all arguments are passed to the wrapper target; if
+// the first argument is a command, the rest are parsed as its arguments;
+// otherwise, the arguments are target names
+func (p *Project) SelectTargets(args []string) ([]string, error) {
+	errs := &errors.AggregatedError{}
+	var requires []string
+	if t := p.WrapperTarget(); t != nil {
+		t.Args = args
+		requires = append(requires, t.Name)
+	} else if len(args) > 0 && p.IsCommand(args[0]) {
+		t := p.Targets[args[0]]
+		t.Args = args[1:]
+		requires = append(requires, t.Name)
+		errs.Add(t.ApplyArgs())
+	} else {
+		requires = p.Targets.CompleteNames(p.QualifyNames(args, errs), errs)
+	}
+	if len(requires) > 1 {
+		for _, name := range requires {
+			if t := p.Targets[name]; t != nil && t.Command {
+				errs.Add(fmt.Errorf("command %s should be the first target", t.Name))
+			}
+		}
+	}
+	return requires, errs.Aggregate()
+}
+
 // TargetNames returns sorted target names
 func (p *Project) TargetNames() []string {
 	targets := make([]string, 0, len(p.Targets))
@@ -704,6 +967,32 @@ func (p *Project) TargetNames() []string {
 	return targets
 }
 
+// DisabledTargetNames returns sorted names of disabled targets
+func (p *Project) DisabledTargetNames() []string {
+	targets := make([]string, 0, len(p.DisabledTargets))
+	for name := range p.DisabledTargets {
+		targets = append(targets, name)
+	}
+	sort.Strings(targets)
+	return targets
+}
+
+// TagNames returns sorted tags of targets
+func (p *Project) TagNames() []string {
+	found := make(map[string]bool)
+	var tags []string
+	for _, t := range p.Targets {
+		for _, tag := range t.Tags {
+			if !found[tag] {
+				found[tag] = true
+				tags = append(tags, tag)
+			}
+		}
+	}
+	sort.Strings(tags)
+	return tags
+}
+
 // TargetNamesMatch returns sorted and matched target names
 func (p *Project) TargetNamesMatch(pattern string) (names []string, err error) {
 	names, err = p.Targets.CompleteName(pattern)
@@ -723,8 +1012,14 @@ func (p *Project) GetSettingsIn(name string, v interface{}) error {
 	return p.MasterFile.Settings.GetBy(name, v)
 }
 
-// MergeSettingsFlat merges settings from a flat key/value map
+// MergeSettingsFlat merges settings from a flat key/value map (from
+// command line), deprecated settings are replaced and reported by Validate
 func (p *Project) MergeSettingsFlat(flat map[string]interface{}) error {
+	flat, messages, err := upgradeFlat(flat)
+	if err != nil {
+		return err
+	}
+	p.deprecate("command line", messages)
 	sets := p.MasterFile.Settings
 	if sets == nil {
 		sets = make(Settings)
@@ -733,6 +1028,13 @@ func (p *Project) MergeSettingsFlat(flat map[string]interface{}) error {
 	return sets.MergeFlat(flat)
 }
 
+// deprecate records deprecated settings from origin
+func (p *Project) deprecate(origin string, messages []string) {
+	for _, msg := range messages {
+		p.deprecated = append(p.deprecated, &Diagnostic{File: origin, Message: msg, Deprecated: true})
+	}
+}
+
 // WorkPath returns the internal state folder (.hmake) for hmake
 func (p *Project) WorkPath() string {
 	return filepath.Join(p.BaseDir, WorkFolder)
@@ -748,6 +1050,26 @@ func (p *Project) SummaryFile() string {
 	return filepath.Join(p.WorkPath(), SummaryFileName)
 }
 
+// LockFile returns the fullpath to project lock file
+func (p *Project) LockFile() string {
+	return filepath.Join(p.WorkPath(), LockFileName)
+}
+
+// SocketFile returns the fullpath to unix socket of hmake serve
+func (p *Project) SocketFile() string {
+	return filepath.Join(p.WorkPath(), SocketFileName)
+}
+
+// TokenFile returns the fullpath to the token of hmake serve
+func (p *Project) TokenFile() string {
+	return filepath.Join(p.WorkPath(), TokenFileName)
+}
+
+// HistoryFile returns the fullpath to the durations of targets
+func (p *Project) HistoryFile() string {
+	return filepath.Join(p.WorkPath(), HistoryFileName)
+}
+
 // Summary loads the execution summary
 func (p *Project) Summary() (ExecSummary, error) {
 	f, err := os.Open(p.SummaryFile())
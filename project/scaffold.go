@@ -0,0 +1,300 @@
+package project
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+	"unicode"
+)
+
+// ScaffoldProfile describes how a type of project is built
+type ScaffoldProfile struct {
+	// Marker is the file identifying the type of project
+	Marker string
+	// Base is the base image of the builder image
+	Base string
+	// Setup are the instructions in Dockerfile of the builder image
+	Setup []string
+	// Deps are the commands fetching dependencies
+	Deps        []string
+	DepsWatches []string
+	// Build are the commands building the project
+	Build        []string
+	BuildWatches []string
+	// Test are the commands running tests
+	Test []string
+	// Lint are the commands checking the code
+	Lint []string
+}
+
+// ScaffoldData is the data used to render the templates
+type ScaffoldData struct {
+	*ScaffoldProfile
+	// Name is the name of the project
+	Name string
+	// Type is the type of the project, e.g. go
+	Type string
+	// Image is the builder image
+	Image string
+}
+
+// ScaffoldProfiles are the built-in types of projects,
+// and ScaffoldTypes are the names in the order of detection
+var (
+	ScaffoldProfiles = map[string]*ScaffoldProfile{
+		"go": &ScaffoldProfile{
+			Marker: "go.mod",
+			Base:   "golang:1.22",
+			Setup: []string{
+				"ENV GOPATH=/go GOCACHE=/go/.cache",
+				"RUN mkdir -p /go/.cache && chmod -R a+rw /go",
+			},
+			Deps:         []string{"go mod download"},
+			DepsWatches:  []string{"go.mod", "go.sum"},
+			Build:        []string{"go build ./..."},
+			BuildWatches: []string{"**/*.go", "go.mod", "go.sum"},
+			Test:         []string{"go test ./..."},
+			Lint:         []string{"go vet ./..."},
+		},
+		"rust": &ScaffoldProfile{
+			Marker: "Cargo.toml",
+			Base:   "rust:1.77",
+			Setup: []string{
+				"RUN rustup component add clippy && chmod -R a+rw $CARGO_HOME",
+			},
+			Deps:         []string{"cargo fetch"},
+			DepsWatches:  []string{"Cargo.toml", "Cargo.lock"},
+			Build:        []string{"cargo build"},
+			BuildWatches: []string{"src", "Cargo.toml", "Cargo.lock"},
+			Test:         []string{"cargo test"},
+			Lint:         []string{"cargo clippy -- -D warnings"},
+		},
+		"node": &ScaffoldProfile{
+			Marker:       "package.json",
+			Base:         "node:20",
+			Setup:        []string{"ENV npm_config_cache=/tmp/.npm"},
+			Deps:         []string{"npm ci"},
+			DepsWatches:  []string{"package.json", "package-lock.json"},
+			Build:        []string{"npm run build --if-present"},
+			BuildWatches: []string{"src", "package.json"},
+			Test:         []string{"npm test"},
+			Lint:         []string{"npm run lint --if-present"},
+		},
+		"make": &ScaffoldProfile{
+			Marker:       "Makefile",
+			Base:         "gcc:13",
+			Build:        []string{"make"},
+			BuildWatches: []string{"Makefile", "**/*.c", "**/*.h"},
+			Test:         []string{"make test"},
+		},
+		"docker": &ScaffoldProfile{
+			Marker:       "Dockerfile",
+			Base:         "docker:24-cli",
+			Build:        []string{"docker build -t $HMAKE_PROJECT_NAME:latest ."},
+			BuildWatches: []string{"."},
+		},
+	}
+	ScaffoldTypes = []string{"go", "rust", "node", "make", "docker"}
+)
+
+// ScaffoldBuilderDir is the directory containing Dockerfile of
+// the builder image
+const ScaffoldBuilderDir = "hack/builder"
+
+const scaffoldDockerfile = `FROM {{.Base}}
+{{range .Setup}}{{.}}
+{{end}}`
+
+const scaffoldHyperMake = `---
+format: hypermake.v1
+
+name: {{.Name}}
+description: {{.Name}} built by HyperMake
+
+targets:
+    builder:
+        description: build the docker image including the toolchain
+        watches:
+            - ` + ScaffoldBuilderDir + `
+        build: ` + ScaffoldBuilderDir + `
+{{- if .Deps}}
+
+    vendor:
+        description: fetch the dependencies
+        after:
+            - builder
+        watches:{{range .DepsWatches}}
+            - {{quote .}}{{end}}
+        cmds:{{range .Deps}}
+            - {{.}}{{end}}
+{{- end}}
+
+    build:
+        description: build the project
+        after:
+            - {{deps}}
+        watches:{{range .BuildWatches}}
+            - {{quote .}}{{end}}
+        cmds:{{range .Build}}
+            - {{.}}{{end}}
+{{- if .Test}}
+
+    test:
+        description: run the tests
+        after:
+            - build
+        cmds:{{range .Test}}
+            - {{.}}{{end}}
+{{- end}}
+{{- if .Lint}}
+
+    lint:
+        description: check the code
+        after:
+            - {{deps}}
+        watches:{{range .BuildWatches}}
+            - {{quote .}}{{end}}
+        cmds:{{range .Lint}}
+            - {{.}}{{end}}
+{{- end}}
+
+settings:
+    default-targets:
+        - build
+    exec-target: build
+    docker:
+        image: {{.Image}}
+{{- if eq .Type "docker"}}
+        expose-docker: true
+{{- end}}
+`
+
+const scaffoldWrapper = `#hmake-wrapper {{.Image}} ` + ScaffoldBuilderDir + `
+set -e
+{{if .Deps}}
+#hmake-target vendor watches={{join .DepsWatches ","}}
+{{range .Deps}}{{.}}
+{{end}}{{end}}
+#hmake-target build{{if .Deps}} after=vendor{{end}} watches={{join .BuildWatches ","}}
+{{range .Build}}{{.}}
+{{end}}{{if .Test}}
+#hmake-target test after=build
+{{range .Test}}{{.}}
+{{end}}{{end}}{{if .Lint}}
+#hmake-target lint{{if .Deps}} after=vendor{{end}} watches={{join .BuildWatches ","}}
+{{range .Lint}}{{.}}
+{{end}}{{end}}`
+
+// DetectProjectType returns the type of project in dir by the marker files
+func DetectProjectType(dir string) string {
+	for _, typ := range ScaffoldTypes {
+		if _, err := os.Stat(filepath.Join(dir, ScaffoldProfiles[typ].Marker)); err == nil {
+			return typ
+		}
+	}
+	return ""
+}
+
+// ScaffoldName derives a valid project name from the directory
+func ScaffoldName(dir string) string {
+	name := []rune(filepath.Base(dir))
+	for n, r := range name {
+		if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '_' && r != '-' && r != '.' {
+			name[n] = '-'
+		}
+	}
+	if len(name) == 0 || (!unicode.IsLetter(name[0]) && name[0] != '_') {
+		name = append([]rune{'_'}, name...)
+	}
+	if len(name) > MaxNameLen {
+		name = name[:MaxNameLen]
+	}
+	return string(name)
+}
+
+// Scaffold renders the files of a new project of the type in dir. With
+// wrapper, HyperMake is in wrapper mode. Templates in templateDir/TYPE
+// (or templateDir/TYPE-wrapper) override the built-in ones, and all
+// files in the directory are rendered. It returns the contents by the
+// paths relative to dir
+func Scaffold(dir, typ string, wrapper bool, templateDir string) (map[string][]byte, error) {
+	data := &ScaffoldData{
+		ScaffoldProfile: ScaffoldProfiles[typ],
+		Name:            ScaffoldName(dir),
+		Type:            typ,
+	}
+	data.Image = strings.TrimLeft(strings.ToLower(data.Name), "_-.") + "-builder:latest"
+	if data.ScaffoldProfile == nil {
+		data.ScaffoldProfile = &ScaffoldProfile{}
+	}
+
+	templates := make(map[string]string)
+	if templateDir != "" {
+		src := filepath.Join(templateDir, typ)
+		if wrapper {
+			src += "-wrapper"
+		}
+		err := filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, err := filepath.Rel(src, path)
+			templates[filepath.ToSlash(rel)] = string(content)
+			return err
+		})
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+	}
+	if len(templates) == 0 {
+		if ScaffoldProfiles[typ] == nil {
+			return nil, fmt.Errorf("unknown project type %s, expect one of: %s",
+				typ, strings.Join(ScaffoldTypes, ", "))
+		}
+		templates[ScaffoldBuilderDir+"/Dockerfile"] = scaffoldDockerfile
+		templates[RootFile] = scaffoldHyperMake
+		if wrapper {
+			templates[RootFile] = scaffoldWrapper
+		}
+	}
+
+	funcs := template.FuncMap{
+		"join": strings.Join,
+		"quote": func(str string) string {
+			return "'" + strings.Replace(str, "'", "''", -1) + "'"
+		},
+		"deps": func() string {
+			if len(data.Deps) > 0 {
+				return "vendor"
+			}
+			return "builder"
+		},
+	}
+	names := make([]string, 0, len(templates))
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	files := make(map[string][]byte)
+	for _, name := range names {
+		tmpl, err := template.New(name).Funcs(funcs).Parse(templates[name])
+		if err != nil {
+			return nil, err
+		}
+		var buf bytes.Buffer
+		if err = tmpl.Execute(&buf, data); err != nil {
+			return nil, err
+		}
+		files[filepath.FromSlash(name)] = buf.Bytes()
+	}
+	return files, nil
+}
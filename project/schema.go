@@ -0,0 +1,172 @@
+package project
+
+import (
+	"reflect"
+	"strings"
+)
+
+// SchemaKind is the kind of value accepted by a property
+type SchemaKind int
+
+// Schema kinds
+const (
+	// KindAny accepts any value
+	KindAny SchemaKind = iota
+	// KindString accepts a scalar
+	KindString
+	// KindBool accepts a boolean
+	KindBool
+	// KindInt accepts an integer
+	KindInt
+	// KindFloat accepts a number
+	KindFloat
+	// KindList accepts a list of Elem
+	KindList
+	// KindMap accepts a dictionary with arbitrary keys and values of Elem
+	KindMap
+	// KindObject accepts a dictionary with known Properties
+	KindObject
+)
+
+// Schema describes the value of a property
+type Schema struct {
+	Kind SchemaKind
+	// Elem is the schema of items in list or values in map
+	Elem *Schema
+	// Properties are known properties of an object
+	Properties map[string]*Schema
+	// Open indicates unknown properties are allowed in an object
+	Open bool
+	// Variants are alternative schemas of the same property,
+	// the value is valid if it's accepted by any of them
+	Variants []*Schema
+	// Check validates the value of a scalar
+	Check func(string) error
+}
+
+var (
+	schemas = make(map[string]*Schema)
+)
+
+// String returns the name of the kind
+func (k SchemaKind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindBool:
+		return "boolean"
+	case KindInt:
+		return "integer"
+	case KindFloat:
+		return "number"
+	case KindList:
+		return "list"
+	case KindMap, KindObject:
+		return "dictionary"
+	}
+	return "any"
+}
+
+// SchemaOf derives the schema of an object from map tags of struct fields,
+// properties of all provided values are merged
+func SchemaOf(vals ...interface{}) *Schema {
+	s := &Schema{Kind: KindObject, Properties: make(map[string]*Schema)}
+	for _, val := range vals {
+		s.merge(schemaOfType(reflect.TypeOf(val)))
+	}
+	return s
+}
+
+func schemaOfType(t reflect.Type) *Schema {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return &Schema{Kind: KindString}
+	case reflect.Bool:
+		return &Schema{Kind: KindBool}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return &Schema{Kind: KindInt}
+	case reflect.Float32, reflect.Float64:
+		return &Schema{Kind: KindFloat}
+	case reflect.Slice, reflect.Array:
+		return &Schema{Kind: KindList, Elem: schemaOfType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Kind: KindMap, Elem: schemaOfType(t.Elem())}
+	case reflect.Struct:
+		return schemaOfStruct(t)
+	}
+	return &Schema{Kind: KindAny}
+}
+
+func schemaOfStruct(t reflect.Type) *Schema {
+	s := &Schema{Kind: KindObject, Properties: make(map[string]*Schema)}
+	var whole []*Schema
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("map"), ",")[0]
+		if field.PkgPath != "" || tag == "" || tag == "-" {
+			continue
+		}
+		if tag == "*" {
+			if field.Type.Kind() == reflect.Map {
+				s.Open = true
+			} else {
+				// the whole value is mapped to the field
+				whole = append(whole, schemaOfType(field.Type))
+			}
+			continue
+		}
+		s.Properties[tag] = s.Properties[tag].or(schemaOfType(field.Type))
+	}
+	if len(whole) > 0 {
+		return &Schema{Variants: append(whole, s)}
+	}
+	return s
+}
+
+// or combines two schemas of the same property
+func (s *Schema) or(s1 *Schema) *Schema {
+	if s == nil {
+		return s1
+	}
+	if len(s.Variants) == 0 {
+		s = &Schema{Variants: []*Schema{s}}
+	}
+	s.Variants = append(s.Variants, s1)
+	return s
+}
+
+func (s *Schema) merge(s1 *Schema) {
+	s.Open = s.Open || s1.Open
+	for name, prop := range s1.Properties {
+		if s.Properties[name] == nil {
+			s.Properties[name] = prop
+		}
+	}
+}
+
+// Property finds the schema of a nested property,
+// dictionaries in variants are also looked up
+func (s *Schema) Property(path ...string) *Schema {
+	if len(path) == 0 {
+		return s
+	}
+	for _, v := range s.Variants {
+		if prop := v.Property(path...); prop != nil {
+			return prop
+		}
+	}
+	if prop := s.Properties[path[0]]; prop != nil {
+		return prop.Property(path[1:]...)
+	}
+	return nil
+}
+
+// RegisterExecDriverSchema registers the schema of target properties
+// specific to an exec-driver
+func RegisterExecDriverSchema(name string, schema *Schema) {
+	schemas[name] = schema
+}
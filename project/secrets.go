@@ -0,0 +1,227 @@
+package project
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/easeway/langx.go/errors"
+)
+
+// SecretMask replaces the values of secrets in logs and outputs
+const SecretMask = "***"
+
+// Secret defines the source of a secret value
+type Secret struct {
+	// Env is the name of environment variable providing the value
+	Env string `map:"env"`
+	// File is the path to the file providing the value
+	File string `map:"file"`
+}
+
+// secretMasker masks values of secrets in text
+type secretMasker struct {
+	lock   sync.RWMutex
+	values []string
+}
+
+// maskBuffer masks values of secrets in a stream written in chunks, the
+// tail which may be the beginning of a secret is held until more is
+// written or it's flushed
+type maskBuffer struct {
+	lock    sync.Mutex
+	pending []byte
+}
+
+type maskWriter struct {
+	w      io.Writer
+	masker *secretMasker
+	buf    maskBuffer
+}
+
+// Value retrieves the value of the secret, relative file path is
+// resolved against baseDir
+func (s *Secret) Value(baseDir string) (string, error) {
+	if s.Env != "" {
+		val, ok := os.LookupEnv(s.Env)
+		if !ok {
+			return "", fmt.Errorf("environment variable %s not set", s.Env)
+		}
+		return val, nil
+	}
+	if s.File != "" {
+		fn := s.File
+		if strings.HasPrefix(fn, "~/") {
+			fn = filepath.Join(os.Getenv("HOME"), fn[2:])
+		} else if !filepath.IsAbs(fn) {
+			fn = filepath.Join(baseDir, fn)
+		}
+		data, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	}
+	return "", fmt.Errorf("env or file must be specified")
+}
+
+func (m *secretMasker) add(value string) {
+	if value == "" {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, v := range m.values {
+		if v == value {
+			return
+		}
+	}
+	m.values = append(m.values, value)
+	// longer values are masked first in case one contains another
+	sort.SliceStable(m.values, func(i, j int) bool {
+		return len(m.values[i]) > len(m.values[j])
+	})
+}
+
+func (m *secretMasker) mask(str string) string {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, v := range m.values {
+		str = strings.Replace(str, v, SecretMask, -1)
+	}
+	return str
+}
+
+// maskPartial masks str which may end with a part of a secret, the
+// masked text and the tail which can't be determined yet are returned
+func (m *secretMasker) maskPartial(str string) (string, string) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var out bytes.Buffer
+	for i := 0; i < len(str); {
+		masked := false
+		for _, v := range m.values {
+			if strings.HasPrefix(str[i:], v) {
+				out.WriteString(SecretMask)
+				i += len(v)
+				masked = true
+				break
+			}
+		}
+		if masked {
+			continue
+		}
+		for _, v := range m.values {
+			if len(str)-i < len(v) && strings.HasPrefix(v, str[i:]) {
+				return out.String(), str[i:]
+			}
+		}
+		out.WriteByte(str[i])
+		i++
+	}
+	return out.String(), ""
+}
+
+func (m *secretMasker) empty() bool {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.values) == 0
+}
+
+// mask returns the masked content ready to be written out
+func (b *maskBuffer) mask(m *secretMasker, p []byte) []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if len(b.pending) == 0 && m.empty() {
+		return p
+	}
+	out, rest := m.maskPartial(string(b.pending) + string(p))
+	b.pending = []byte(rest)
+	return []byte(out)
+}
+
+// flush returns the content held
+func (b *maskBuffer) flush() []byte {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	out := b.pending
+	b.pending = nil
+	return out
+}
+
+func (w *maskWriter) Write(p []byte) (int, error) {
+	if _, err := w.w.Write(w.buf.mask(w.masker, p)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes out the content held, the underlying writer is not closed
+func (w *maskWriter) Close() error {
+	if out := w.buf.flush(); len(out) > 0 {
+		_, err := w.w.Write(out)
+		return err
+	}
+	return nil
+}
+
+// MaskSecrets replaces values of secrets in str
+func (p *ExecPlan) MaskSecrets(str string) string {
+	return p.masker.mask(str)
+}
+
+// MaskWriter wraps w to mask values of secrets written, a secret may
+// span multiple writes, so it must be closed to write out the rest
+func (p *ExecPlan) MaskWriter(w io.Writer) io.WriteCloser {
+	return &maskWriter{w: w, masker: &p.masker}
+}
+
+func (p *ExecPlan) maskError(err error) error {
+	if err == nil || p.masker.empty() {
+		return err
+	}
+	if msg := p.masker.mask(err.Error()); msg != err.Error() {
+		return fmt.Errorf("%s", msg)
+	}
+	return err
+}
+
+// resolveSecrets retrieves values of secrets used by the task
+func (t *Task) resolveSecrets() error {
+	t.secretEnv = nil
+	if len(t.Target.Secrets) == 0 {
+		return nil
+	}
+	errs := &errors.AggregatedError{}
+	for _, name := range t.Target.Secrets {
+		secret := t.Project().MasterFile.Secrets[name]
+		if secret == nil {
+			errs.Add(t.Target.Errorf("secret %s not defined", name))
+			continue
+		}
+		val, err := secret.Value(t.Project().BaseDir)
+		if err != nil {
+			errs.Add(t.Target.Errorf("secret %s: %v", name, err))
+			continue
+		}
+		t.Plan.masker.add(val)
+		t.secretEnv = append(t.secretEnv, name+"="+val)
+	}
+	return errs.Aggregate()
+}
+
+// SecretEnv returns secrets used by task as environment variables
+func (t *Task) SecretEnv() []string {
+	return t.secretEnv
+}
+
+// SecretNames returns names of secrets used by task
+func (t *Task) SecretNames() []string {
+	return t.Target.Secrets
+}
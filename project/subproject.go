@@ -0,0 +1,162 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/easeway/langx.go/errors"
+)
+
+const (
+	// SubProjectSep separates names of sub-projects and target
+	SubProjectSep = ":"
+	// projectPathPrefix starts a target name referenced by path of project
+	projectPathPrefix = "//"
+)
+
+// Root returns the top-level project
+func (p *Project) Root() *Project {
+	for p.Parent != nil {
+		p = p.Parent
+	}
+	return p
+}
+
+// SubProjectNames returns sorted names of sub-projects
+func (p *Project) SubProjectNames() []string {
+	names := make([]string, 0, len(p.SubProjects))
+	for name := range p.SubProjects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (p *Project) findProject(dir string) *Project {
+	if filepath.Clean(p.BaseDir) == dir {
+		return p
+	}
+	for _, sub := range p.SubProjects {
+		if found := sub.findProject(dir); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// QualifyName translates a target name referenced in the project to the
+// name exposed by the root project: name is prefixed by the names of
+// sub-projects, and "//path:name" refers to the project in path
+// relative to the root project, regexp patterns are unchanged, and tag
+// selectors (e.g. "@lint") only select targets in the project
+func (p *Project) QualifyName(name string) (string, error) {
+	if strings.HasPrefix(name, projectPathPrefix) {
+		pos := strings.LastIndex(name, SubProjectSep)
+		if pos < 0 {
+			return "", fmt.Errorf("invalid target name %s: missing %s", name, SubProjectSep)
+		}
+		root := p.Root()
+		dir := filepath.Join(root.BaseDir, filepath.FromSlash(name[len(projectPathPrefix):pos]))
+		proj := root.findProject(dir)
+		if proj == nil {
+			return "", fmt.Errorf("invalid target name %s: project not found", name)
+		}
+		return proj.Namespace + name[pos+1:], nil
+	}
+	if strings.HasPrefix(name, "/") {
+		return name, nil
+	}
+	return p.Namespace + name, nil
+}
+
+// QualifyNames translates a list of target names using QualifyName
+func (p *Project) QualifyNames(names []string, errs *errors.AggregatedError) (out []string) {
+	for _, name := range names {
+		qualified, err := p.QualifyName(name)
+		if !errs.Add(err) {
+			out = append(out, qualified)
+		}
+	}
+	return
+}
+
+// loadSubProjects loads the projects defined in "projects"
+func (p *Project) loadSubProjects() error {
+	errs := &errors.AggregatedError{}
+	p.SubProjects = make(map[string]*Project)
+	names := make([]string, 0, len(p.MasterFile.Projects))
+	for name := range p.MasterFile.Projects {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		path := p.MasterFile.Projects[name]
+		if err := ValidateName(name); err != nil {
+			errs.Add(fmt.Errorf("illegal project name '%s': %v", name, err))
+			continue
+		}
+		sub := &Project{
+			BaseDir:   filepath.Join(p.BaseDir, filepath.FromSlash(path)),
+			Parent:    p,
+			Namespace: p.Namespace + name + SubProjectSep,
+		}
+		for ancestor := p; ancestor != nil; ancestor = ancestor.Parent {
+			if filepath.Clean(ancestor.BaseDir) == sub.BaseDir {
+				sub = nil
+				break
+			}
+		}
+		if sub == nil {
+			errs.Add(fmt.Errorf("project %s(%s): cyclic projects", name, path))
+			continue
+		}
+		_, err := sub.Load(RootFile)
+		if err != nil {
+			err = fmt.Errorf("project %s(%s): %v", name, path, err)
+		} else {
+			err = sub.Resolve()
+		}
+		if errs.Add(err) {
+			for _, fn := range sub.invalid {
+				p.invalid = append(p.invalid, filepath.Join(filepath.FromSlash(path), fn))
+			}
+			continue
+		}
+		sub.settings = sub.MasterFile.Settings
+		p.SubProjects[name] = sub
+	}
+	return errs.Aggregate()
+}
+
+func copyValue(v interface{}) interface{} {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			m[k] = copyValue(item)
+		}
+		return m
+	case Settings:
+		return copyValue(map[string]interface{}(val))
+	case []interface{}:
+		list := make([]interface{}, len(val))
+		for n, item := range val {
+			list[n] = copyValue(item)
+		}
+		return list
+	}
+	return v
+}
+
+// inheritSettings merges the settings of the sub-project over
+// the settings of its parent
+func (p *Project) inheritSettings() error {
+	settings := Settings(copyValue(p.Parent.MasterFile.Settings).(map[string]interface{}))
+	if err := settings.Merge(Settings(copyValue(p.settings).(map[string]interface{}))); err != nil {
+		return fmt.Errorf("project %s: %v", strings.TrimSuffix(p.Namespace, SubProjectSep), err)
+	}
+	p.MasterFile.Settings = settings
+	return nil
+}
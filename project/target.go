@@ -15,26 +15,43 @@ import (
 
 // Target defines a build target
 type Target struct {
-	Name       string                 `map:"name"`
-	Desc       string                 `map:"description"`
-	Before     []string               `map:"before"`
-	After      []string               `map:"after"`
-	ExecDriver string                 `map:"exec-driver"`
-	WorkDir    string                 `map:"workdir"`
-	Watches    []string               `map:"watches"`
-	Always     bool                   `map:"always"`
-	Artifacts  []string               `map:"artifacts"`
-	Ext        map[string]interface{} `map:"*"`
+	Name       string                   `map:"name"`
+	Desc       string                   `map:"description"`
+	Before     []string                 `map:"before"`
+	After      []string                 `map:"after"`
+	ExecDriver string                   `map:"exec-driver"`
+	WorkDir    string                   `map:"workdir"`
+	Watches    []string                 `map:"watches"`
+	Always     bool                     `map:"always"`
+	Artifacts  []string                 `map:"artifacts"`
+	Secrets    []string                 `map:"secrets"`
+	Tags       []string                 `map:"tags"`
+	Extends    []string                 `map:"extends"`
+	Matrix     *TargetMatrix            `map:"matrix"`
+	Command    bool                     `map:"command"`
+	ArgDefs    []*ArgDef                `map:"args"`
+	If         string                   `map:"if"`
+	When       []map[string]interface{} `map:"when"`
+	Ext        map[string]interface{}   `map:"*"`
 
 	// Runtime fields
 
-	Project   *Project      `map:"-"`
-	File      *File         `map:"-"`
-	Command   bool          `map:"-"`
-	Exec      bool          `map:"-"`
-	Args      []string      `map:"-"`
-	Depends   TargetNameMap `map:"-"`
-	Activates TargetNameMap `map:"-"`
+	Project   *Project          `map:"-"`
+	File      *File             `map:"-"`
+	Vars      map[string]string `map:"-"`
+	Disabled  string            `map:"-"`
+	Exec      bool              `map:"-"`
+	Args      []string          `map:"-"`
+	ArgValues map[string]string `map:"-"`
+	Depends   TargetNameMap     `map:"-"`
+	Activates TargetNameMap     `map:"-"`
+
+	// defined keeps the properties before conditions are applied
+	defined *Target
+	// alwaysSet and commandSet indicate always and command are set
+	// explicitly, so false overrides the value from templates
+	alwaysSet  bool
+	commandSet bool
 }
 
 // TargetNameMap is targets mapping by name
@@ -62,6 +79,19 @@ func (t *Target) Initialize(name string, project *Project) {
 	t.Activates = make(TargetNameMap)
 }
 
+// LocalName returns the name of target inside its own project
+func (t *Target) LocalName() string {
+	return t.Name[strings.LastIndex(t.Name, SubProjectSep)+1:]
+}
+
+// depNames qualifies names in before/after referenced by the target
+func (t *Target) depNames(names []string, errs *errors.AggregatedError) []string {
+	if t.Project == nil {
+		return names
+	}
+	return t.Project.QualifyNames(names, errs)
+}
+
 // IsTransit indicates the targets doesn't have actual work to do
 func (t *Target) IsTransit() bool {
 	return t.ExecDriver == "" &&
@@ -199,9 +229,32 @@ func (m TargetNameMap) Add(t *Target) error {
 	return nil
 }
 
+// HasTag indicates the target is tagged with tag
+func (t *Target) HasTag(tag string) bool {
+	for _, name := range t.Tags {
+		if name == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTags validates the names of tags
+func (t *Target) checkTags() error {
+	for _, tag := range t.Tags {
+		if err := ValidateName(tag); err != nil {
+			return t.Errorf("invalid tag %q: %v", tag, err)
+		}
+	}
+	return nil
+}
+
 // CompleteName resolve pattern as a single name
 func (m TargetNameMap) CompleteName(name string) ([]string, error) {
 	var out []string
+	if scope, terms, ok := tagSelector(name); ok {
+		return m.selectTagged(name, scope, terms)
+	}
 	if strings.HasPrefix(name, "/") {
 		if len(name) <= 1 || !strings.HasSuffix(name, "/") {
 			return nil, fmt.Errorf("incomplete regexp: %s", name)
@@ -230,6 +283,98 @@ func (m TargetNameMap) CompleteName(name string) ([]string, error) {
 	return out, nil
 }
 
+const (
+	// TagPrefix starts a tag selector, e.g. @lint
+	TagPrefix = "@"
+	// tagNegate selects targets without the tag, e.g. !@slow
+	tagNegate = "!"
+	// tagAnd joins terms of a tag selector, e.g. @lint+!@slow
+	tagAnd = "+"
+)
+
+// tagSelector splits a tag selector like @tag1+!@tag2 into the
+// namespace of sub-project it applies to and the terms
+func tagSelector(name string) (scope string, terms []string, ok bool) {
+	pos := strings.IndexAny(name, TagPrefix+tagNegate)
+	if pos < 0 || (pos > 0 && !strings.HasSuffix(name[:pos], SubProjectSep)) {
+		return "", nil, false
+	}
+	return name[:pos], strings.Split(name[pos:], tagAnd), true
+}
+
+// selectTagged returns the names of targets in scope matching all terms
+func (m TargetNameMap) selectTagged(name, scope string, terms []string) ([]string, error) {
+	tags := make([]string, len(terms))
+	negates := make([]bool, len(terms))
+	for n, term := range terms {
+		negates[n] = strings.HasPrefix(term, tagNegate)
+		tag := strings.TrimPrefix(term, tagNegate)
+		if !strings.HasPrefix(tag, TagPrefix) || ValidateName(tag[len(TagPrefix):]) != nil {
+			return nil, fmt.Errorf("invalid tag selector: %s", name)
+		}
+		tags[n] = tag[len(TagPrefix):]
+	}
+	// a misspelled tag would silently select nothing or everything
+	defined := make(map[string]bool)
+	for n, t := range m {
+		if strings.HasPrefix(n, scope) {
+			for _, tag := range t.Tags {
+				defined[tag] = true
+			}
+		}
+	}
+	for _, tag := range tags {
+		if !defined[tag] {
+			return nil, fmt.Errorf("tag %s is not defined on any target: %s", tag, name)
+		}
+	}
+	var out []string
+	for n, t := range m {
+		if !strings.HasPrefix(n, scope) {
+			continue
+		}
+		matched := true
+		for i, tag := range tags {
+			if t.HasTag(tag) == negates[i] {
+				matched = false
+				break
+			}
+		}
+		if matched {
+			out = append(out, n)
+		}
+	}
+	// commands can't be selected with other targets
+	if len(out) > 1 {
+		targets := out[:0]
+		for _, n := range out {
+			if !m[n].Command {
+				targets = append(targets, n)
+			}
+		}
+		out = targets
+	}
+	return out, nil
+}
+
+// completeDeps resolves patterns in before or after of target t,
+// a tag selector never selects t itself
+func (m TargetNameMap) completeDeps(t *Target, in []string, errs *errors.AggregatedError) (out []string) {
+	for _, name := range in {
+		completed, err := m.CompleteName(name)
+		if errs.Add(err) {
+			continue
+		}
+		_, _, selector := tagSelector(name)
+		for _, n := range completed {
+			if !selector || n != t.Name {
+				out = append(out, n)
+			}
+		}
+	}
+	return
+}
+
 // CompleteNames resolves pattern in name list
 func (m TargetNameMap) CompleteNames(in []string, errs *errors.AggregatedError) (out []string) {
 	for _, name := range in {
@@ -244,9 +389,21 @@ func (m TargetNameMap) CompleteNames(in []string, errs *errors.AggregatedError)
 
 // BuildDeps builds direct depends and activates
 func (m TargetNameMap) BuildDeps() error {
+	return m.BuildDepsWith(nil)
+}
+
+// BuildDepsWith builds direct depends and activates, and reports
+// dependencies on disabled targets
+func (m TargetNameMap) BuildDepsWith(disabled TargetNameMap) error {
+	undefined := func(t *Target, rel, name string) error {
+		if d := disabled[name]; d != nil {
+			return t.Errorf("%s %s which is disabled: %s", rel, name, d.Disabled)
+		}
+		return t.Errorf("%s %s which is not defined", rel, name)
+	}
 	errs := &errors.AggregatedError{}
 	for _, t := range m {
-		names := m.CompleteNames(t.Before, errs)
+		names := m.completeDeps(t, t.depNames(t.Before, errs), errs)
 		if t.Command && len(names) > 0 {
 			errs.Add(t.Errorf("before not allowed in commands"))
 			continue
@@ -255,17 +412,17 @@ func (m TargetNameMap) BuildDeps() error {
 		for _, name := range names {
 			dest, ok := m[name]
 			if !ok {
-				errs.Add(t.Errorf("before %s which is not defined", name))
+				errs.Add(undefined(t, "before", name))
 			} else {
 				dest.AddDep(t)
 			}
 		}
-		names = m.CompleteNames(t.After, errs)
+		names = m.completeDeps(t, t.depNames(t.After, errs), errs)
 		// add depends for all after
 		for _, name := range names {
 			dest, ok := m[name]
 			if !ok {
-				errs.Add(t.Errorf("after %s which is not defined", name))
+				errs.Add(undefined(t, "after", name))
 			} else if dest.Command {
 				errs.Add(t.Errorf("dependency on command %s not allowed", name))
 			} else {
@@ -381,6 +538,17 @@ func (s Settings) MergeFlat(flat map[string]interface{}) error {
 	return nil
 }
 
+// FlatKeys returns sorted keys of values in settings in the form
+// accepted by MergeFlat, e.g. docker.image
+func (s Settings) FlatKeys() []string {
+	var keys []string
+	flattenConfig("", s, func(key string, val interface{}) {
+		keys = append(keys, key)
+	})
+	sort.Strings(keys)
+	return keys
+}
+
 // IsEmpty indicates the watch list is empty
 func (w WatchList) IsEmpty() bool {
 	return len(w) == 0
@@ -0,0 +1,184 @@
+package project
+
+import (
+	"fmt"
+	"strings"
+)
+
+// templateResolver resolves extends of targets from templates in a file
+type templateResolver struct {
+	templates map[string]*Target
+	resolved  map[string]*Target
+	resolving []string
+}
+
+// mergeValue merges over into base: lists append, maps merge
+// and scalars override
+func mergeValue(base, over interface{}) interface{} {
+	switch o := over.(type) {
+	case map[string]interface{}:
+		if b, ok := base.(map[string]interface{}); ok {
+			return mergeExt(b, o)
+		}
+	case []interface{}:
+		if b, ok := base.([]interface{}); ok {
+			return append(append([]interface{}{}, b...), o...)
+		}
+	}
+	return over
+}
+
+func mergeExt(base, over map[string]interface{}) map[string]interface{} {
+	if base == nil && over == nil {
+		return nil
+	}
+	m := make(map[string]interface{})
+	for k, v := range base {
+		m[k] = v
+	}
+	for k, v := range over {
+		if b, exists := m[k]; exists {
+			m[k] = mergeValue(b, v)
+		} else {
+			m[k] = v
+		}
+	}
+	return m
+}
+
+func mergeStrings(base, over []string) []string {
+	if base == nil {
+		return over
+	}
+	return append(append([]string{}, base...), over...)
+}
+
+func mergeString(base, over string) string {
+	if over != "" {
+		return over
+	}
+	return base
+}
+
+// mergeFlag overrides base with over if over is set explicitly,
+// otherwise the flag is true if either is true
+func mergeFlag(base, baseSet, over, overSet bool) (bool, bool) {
+	if overSet {
+		return over, true
+	}
+	return base || over, baseSet
+}
+
+// markSet records the flags set explicitly in the properties of target
+func (t *Target) markSet(props map[string]interface{}) {
+	_, t.alwaysSet = props["always"]
+	_, t.commandSet = props["command"]
+}
+
+// markTargets records the flags set explicitly for targets mapped from val
+func markTargets(targets map[string]*Target, val interface{}) {
+	props, _ := val.(map[string]interface{})
+	for name, t := range targets {
+		if p, ok := props[name].(map[string]interface{}); ok {
+			t.markSet(p)
+		}
+	}
+}
+
+// mergeTarget creates a new target with properties of over merged into base
+func mergeTarget(base, over *Target) *Target {
+	t := &Target{Name: over.Name}
+	t.overlay(base)
+	t.overlay(over)
+	return t
+}
+
+// overlay merges properties of o into t
+func (t *Target) overlay(o *Target) {
+	t.Desc = mergeString(t.Desc, o.Desc)
+	t.Before = mergeStrings(t.Before, o.Before)
+	t.After = mergeStrings(t.After, o.After)
+	t.ExecDriver = mergeString(t.ExecDriver, o.ExecDriver)
+	t.WorkDir = mergeString(t.WorkDir, o.WorkDir)
+	t.Watches = mergeStrings(t.Watches, o.Watches)
+	t.Always, t.alwaysSet = mergeFlag(t.Always, t.alwaysSet, o.Always, o.alwaysSet)
+	t.Command, t.commandSet = mergeFlag(t.Command, t.commandSet, o.Command, o.commandSet)
+	if o.ArgDefs != nil {
+		t.ArgDefs = o.ArgDefs
+	}
+	t.Artifacts = mergeStrings(t.Artifacts, o.Artifacts)
+	t.Secrets = mergeStrings(t.Secrets, o.Secrets)
+	t.Tags = mergeStrings(t.Tags, o.Tags)
+	t.Ext = mergeExt(t.Ext, o.Ext)
+	t.If = mergeString(t.If, o.If)
+	t.When = append(append([]map[string]interface{}{}, t.When...), o.When...)
+	if o.Matrix != nil {
+		t.Matrix = o.Matrix
+	}
+}
+
+// resetProps replaces the properties merged by overlay with the ones of o
+func (t *Target) resetProps(o *Target) {
+	t.Desc, t.Before, t.After = o.Desc, o.Before, o.After
+	t.ExecDriver, t.WorkDir, t.Watches = o.ExecDriver, o.WorkDir, o.Watches
+	t.Always, t.Command, t.ArgDefs = o.Always, o.Command, o.ArgDefs
+	t.alwaysSet, t.commandSet = o.alwaysSet, o.commandSet
+	t.Artifacts, t.Secrets, t.Tags = o.Artifacts, o.Secrets, o.Tags
+	t.Ext, t.If, t.When, t.Matrix = o.Ext, o.If, o.When, o.Matrix
+}
+
+// extend merges all templates in t.Extends in order, then t itself
+func (r *templateResolver) extend(t *Target) (*Target, error) {
+	if len(t.Extends) == 0 {
+		return t, nil
+	}
+	merged := &Target{}
+	for _, name := range t.Extends {
+		base, err := r.resolve(name)
+		if err != nil {
+			return nil, err
+		}
+		merged = mergeTarget(merged, base)
+	}
+	return mergeTarget(merged, t), nil
+}
+
+func (r *templateResolver) resolve(name string) (*Target, error) {
+	if t := r.resolved[name]; t != nil {
+		return t, nil
+	}
+	t := r.templates[name]
+	if t == nil {
+		return nil, fmt.Errorf("unknown template %s", name)
+	}
+	for n, resolving := range r.resolving {
+		if resolving == name {
+			chain := append(r.resolving[n:], name)
+			return nil, fmt.Errorf("cyclic templates %s", strings.Join(chain, " -> "))
+		}
+	}
+	r.resolving = append(r.resolving, name)
+	resolved, err := r.extend(t)
+	r.resolving = r.resolving[:len(r.resolving)-1]
+	if err != nil {
+		return nil, err
+	}
+	r.resolved[name] = resolved
+	return resolved, nil
+}
+
+// resolveTemplates merges templates into targets extending them
+func resolveTemplates(f *File) error {
+	r := &templateResolver{
+		templates: f.Templates,
+		resolved:  make(map[string]*Target),
+	}
+	for name, t := range f.Targets {
+		extended, err := r.extend(t)
+		if err != nil {
+			return fmt.Errorf("%s(%s): %v", name, f.Source, err)
+		}
+		f.Targets[name] = extended
+	}
+	return nil
+}
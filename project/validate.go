@@ -0,0 +1,395 @@
+package project
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// Diagnostic is a problem found when validating a file
+type Diagnostic struct {
+	File    string `json:"file"`
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+	// Deprecated indicates the problem is the use of a property
+	// replaced in the latest format, which still works
+	Deprecated bool `json:"deprecated,omitempty"`
+}
+
+// String formats the diagnostic as file:line:column: message
+func (d *Diagnostic) String() string {
+	if d.Line == 0 {
+		return d.File + ": " + d.Message
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", d.File, d.Line, d.Column, d.Message)
+}
+
+// validator checks the nodes of a file against schema
+type validator struct {
+	file   string
+	driver string
+	diags  []*Diagnostic
+}
+
+var boolValues = map[string]bool{
+	"true": true, "false": true, "yes": true, "no": true,
+	"y": true, "n": true, "on": true, "off": true,
+}
+
+func (v *validator) report(node *yaml.Node, format string, args ...interface{}) {
+	v.diags = append(v.diags, &Diagnostic{
+		File:    v.file,
+		Line:    node.Line,
+		Column:  node.Column,
+		Message: fmt.Sprintf(format, args...),
+	})
+}
+
+func nodeKind(node *yaml.Node) string {
+	switch node.Kind {
+	case yaml.SequenceNode:
+		return "list"
+	case yaml.MappingNode:
+		return "dictionary"
+	}
+	switch node.Tag {
+	case "!!bool":
+		return "boolean"
+	case "!!int":
+		return "integer"
+	case "!!float":
+		return "number"
+	case "!!null":
+		return "null"
+	}
+	return "string"
+}
+
+// accepts checks if the kind of node matches schema
+func (s *Schema) accepts(node *yaml.Node) bool {
+	if len(s.Variants) > 0 {
+		return s.variant(node) != nil
+	}
+	if node.Tag == "!!null" {
+		return true
+	}
+	switch s.Kind {
+	case KindString:
+		return node.Kind == yaml.ScalarNode
+	case KindBool:
+		return node.Kind == yaml.ScalarNode &&
+			(node.Tag == "!!bool" || boolValues[strings.ToLower(node.Value)])
+	case KindInt:
+		return node.Kind == yaml.ScalarNode && node.Tag == "!!int"
+	case KindFloat:
+		return node.Kind == yaml.ScalarNode && (node.Tag == "!!int" || node.Tag == "!!float")
+	case KindList:
+		return node.Kind == yaml.SequenceNode
+	case KindMap, KindObject:
+		return node.Kind == yaml.MappingNode
+	}
+	return true
+}
+
+func (s *Schema) variant(node *yaml.Node) *Schema {
+	for _, v := range s.Variants {
+		if v.accepts(node) {
+			return v
+		}
+	}
+	return nil
+}
+
+func (s *Schema) expects() string {
+	if len(s.Variants) == 0 {
+		return s.Kind.String()
+	}
+	kinds := make([]string, 0, len(s.Variants))
+	for _, v := range s.Variants {
+		kinds = append(kinds, v.expects())
+	}
+	return strings.Join(kinds, " or ")
+}
+
+// suggest finds the most similar name of known properties
+func (s *Schema) suggest(name string) string {
+	names := make([]string, 0, len(s.Properties))
+	for n := range s.Properties {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	best, bestDist := "", len(name)
+	for _, n := range names {
+		if d := editDistance(name, n); d < bestDist {
+			best, bestDist = n, d
+		}
+	}
+	// allow more edits for longer names
+	limit := 1
+	if len(name) > 4 {
+		limit = 2
+	}
+	if l := len(name) / 3; l > limit {
+		limit = l
+	}
+	if bestDist <= limit {
+		return best
+	}
+	return ""
+}
+
+// editDistance calculates the Levenshtein distance between two strings
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = prev[j-1] + cost
+			if d := prev[j] + 1; d < cur[j] {
+				cur[j] = d
+			}
+			if d := cur[j-1] + 1; d < cur[j] {
+				cur[j] = d
+			}
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func at(where, path string) string {
+	if path == "" {
+		return where
+	}
+	return where + ": " + path
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+// check validates node against schema, where describes the enclosing
+// section and path is the property path inside it
+func (v *validator) check(node *yaml.Node, s *Schema, where, path string) {
+	for node.Kind == yaml.AliasNode {
+		node = node.Alias
+	}
+	if len(s.Variants) > 0 {
+		if matched := s.variant(node); matched != nil {
+			v.check(node, matched, where, path)
+		} else {
+			v.report(node, "%s expects %s, got %s", at(where, path), s.expects(), nodeKind(node))
+		}
+		return
+	}
+	if !s.accepts(node) {
+		v.report(node, "%s expects %s, got %s", at(where, path), s.expects(), nodeKind(node))
+		return
+	}
+	switch node.Kind {
+	case yaml.ScalarNode:
+		if s.Check != nil && node.Tag != "!!null" {
+			if err := s.Check(node.Value); err != nil {
+				v.report(node, "%s: %v", at(where, path), err)
+			}
+		}
+	case yaml.SequenceNode:
+		if s.Elem != nil {
+			for n, item := range node.Content {
+				v.check(item, s.Elem, where, fmt.Sprintf("%s[%d]", path, n))
+			}
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, val := node.Content[i], node.Content[i+1]
+			if key.Value == "<<" {
+				continue
+			}
+			switch {
+			case s.Kind == KindMap && s.Elem != nil:
+				v.check(val, s.Elem, where, joinPath(path, key.Value))
+			case s.Kind == KindObject:
+				if prop := s.Properties[key.Value]; prop != nil {
+					v.check(val, prop, where, joinPath(path, key.Value))
+				} else if !s.Open {
+					v.unknown(key, s, where, joinPath(path, key.Value))
+				}
+			}
+		}
+	}
+}
+
+func (v *validator) unknown(key *yaml.Node, s *Schema, where, path string) {
+	if suggestion := s.suggest(key.Value); suggestion != "" {
+		v.report(key, "%s: unknown property %s, did you mean %s?", where, path, suggestion)
+	} else {
+		v.report(key, "%s: unknown property %s", where, path)
+	}
+}
+
+func checkExecDriver(name string) error {
+	if _, ok := drivers[name]; !ok && len(drivers) > 0 {
+		return fmt.Errorf("unknown exec-driver %s", name)
+	}
+	return nil
+}
+
+// targetSchema builds the schema of a target using the exec-driver
+func targetSchema(driver string) *Schema {
+	s := SchemaOf(&Target{})
+	if ds := schemas[driver]; ds != nil {
+		// properties not known by the exec-driver are reported
+		s.Open = false
+		s.merge(ds)
+	}
+	s.Properties["exec-driver"].Check = checkExecDriver
+	s.Properties["if"].Check = checkCondition
+	when := &Schema{Kind: KindObject, Open: s.Open, Properties: make(map[string]*Schema)}
+	for name, prop := range s.Properties {
+		if name != "when" && name != "extends" && name != "matrix" {
+			when.Properties[name] = prop
+		}
+	}
+	s.Properties["when"] = &Schema{Kind: KindList, Elem: when}
+	return s
+}
+
+func scalarValue(node *yaml.Node, path ...string) string {
+	for _, name := range path {
+		if node == nil || node.Kind != yaml.MappingNode {
+			return ""
+		}
+		var found *yaml.Node
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == name {
+				found = node.Content[i+1]
+			}
+		}
+		node = found
+	}
+	if node == nil || node.Kind != yaml.ScalarNode {
+		return ""
+	}
+	return node.Value
+}
+
+func (v *validator) checkTargets(node *yaml.Node, section string) {
+	if node.Kind != yaml.MappingNode {
+		v.report(node, "%s expects dictionary, got %s", section, nodeKind(node))
+		return
+	}
+	kind := strings.TrimSuffix(section, "s")
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name, t := node.Content[i], node.Content[i+1]
+		driver := scalarValue(t, SettingExecDriver)
+		if driver == "" {
+			driver = v.driver
+		}
+		v.check(t, targetSchema(driver), kind+" "+name.Value, "")
+	}
+}
+
+func (v *validator) checkFile(doc *yaml.Node) {
+	if doc.Kind == yaml.DocumentNode && len(doc.Content) > 0 {
+		doc = doc.Content[0]
+	}
+	if doc.Kind != yaml.MappingNode {
+		v.report(doc, "expects dictionary, got %s", nodeKind(doc))
+		return
+	}
+	if driver := scalarValue(doc, "local", SettingExecDriver); driver != "" {
+		v.driver = driver
+	}
+	s := SchemaOf(&File{})
+	for i := 0; i+1 < len(doc.Content); i += 2 {
+		key, val := doc.Content[i], doc.Content[i+1]
+		switch key.Value {
+		case "targets", "templates":
+			v.checkTargets(val, key.Value)
+		default:
+			if prop := s.Properties[key.Value]; prop != nil {
+				v.check(val, prop, "file", key.Value)
+			} else {
+				v.unknown(key, s, "file", key.Value)
+			}
+		}
+	}
+}
+
+// ValidateFile checks properties in a file against the schema,
+// driver is the default exec-driver of targets
+func ValidateFile(baseDir, path, driver string) []*Diagnostic {
+	v := &validator{file: path, driver: driver}
+	data, err := loadAndRender(filepath.Join(baseDir, path))
+	if err != nil {
+		return []*Diagnostic{{File: path, Message: err.Error()}}
+	}
+	var doc yaml.Node
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return []*Diagnostic{{File: path, Message: err.Error()}}
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	var diags []*Diagnostic
+	if parseFormat(&doc) == FormatV0 {
+		// validate the upgraded content and report deprecated properties
+		u := &nodeUpgrader{file: path}
+		if err = u.upgrade(&doc); err != nil {
+			return []*Diagnostic{{File: path, Message: err.Error()}}
+		}
+		diags = u.diags
+	}
+	v.checkFile(&doc)
+	return append(diags, v.diags...)
+}
+
+// Validate checks all loaded files against the schema, and the files
+// failed to load, so the problems are located when loading fails
+func (p *Project) Validate() (diags []*Diagnostic) {
+	driver := DefaultExecDriver
+	if d, ok := p.MasterFile.Settings[SettingExecDriver].(string); ok && d != "" {
+		driver = d
+	}
+	diags = append(diags, p.deprecated...)
+	prefix := ""
+	if root := p.Root(); root != p {
+		if rel, err := filepath.Rel(root.BaseDir, p.BaseDir); err == nil {
+			prefix = rel
+		}
+	}
+	for _, f := range p.Files {
+		if f.Wrapper {
+			continue
+		}
+		for _, d := range ValidateFile(p.BaseDir, f.Source, driver) {
+			d.File = filepath.Join(prefix, d.File)
+			diags = append(diags, d)
+		}
+	}
+	for _, fn := range p.invalid {
+		for _, d := range ValidateFile(p.BaseDir, fn, driver) {
+			d.File = filepath.Join(prefix, d.File)
+			diags = append(diags, d)
+		}
+	}
+	for _, name := range p.SubProjectNames() {
+		diags = append(diags, p.SubProjects[name].Validate()...)
+	}
+	return
+}
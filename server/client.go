@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// MismatchError indicates the server loads the project differently
+// from the client, so the run should be local
+type MismatchError struct {
+	Reason string
+}
+
+func (e *MismatchError) Error() string {
+	return e.Reason
+}
+
+// Client talks to the server on a unix socket
+type Client struct {
+	http *http.Client
+}
+
+// Dial connects to the server on the unix socket, it fails if
+// the server is not running
+func Dial(socket string) (*Client, error) {
+	conn, err := net.DialTimeout("unix", socket, time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.Close()
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				Dial: func(network, addr string) (net.Conn, error) {
+					return net.Dial("unix", socket)
+				},
+			},
+		},
+	}, nil
+}
+
+func (c *Client) do(method, name string, body interface{}) (*http.Response, error) {
+	var rd io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		rd = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequest(method, "http://hmake"+APIPrefix+name, rd)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.NewDecoder(resp.Body).Decode(&e) != nil || e.Error == "" {
+			e.Error = resp.Status
+		}
+		if resp.StatusCode == http.StatusPreconditionFailed {
+			return nil, &MismatchError{Reason: e.Error}
+		}
+		return nil, fmt.Errorf("%s", e.Error)
+	}
+	return resp, nil
+}
+
+func (c *Client) call(method, name string, body, result interface{}) error {
+	resp, err := c.do(method, name, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// Project returns the information of loaded project
+func (c *Client) Project() (info *ProjectInfo, err error) {
+	err = c.call(http.MethodGet, "project", nil, &info)
+	return
+}
+
+// Targets lists all targets including disabled ones
+func (c *Client) Targets() (targets []*TargetInfo, err error) {
+	err = c.call(http.MethodGet, "targets", nil, &targets)
+	return
+}
+
+// Graph returns the dependency graph
+func (c *Client) Graph() (g *Graph, err error) {
+	err = c.call(http.MethodGet, "graph", nil, &g)
+	return
+}
+
+// Summary returns the summary of last execution
+func (c *Client) Summary() (sum hm.ExecSummary, err error) {
+	err = c.call(http.MethodGet, "summary", nil, &sum)
+	return
+}
+
+// Log returns the output of last execution of target
+func (c *Client) Log(target string) ([]byte, error) {
+	resp, err := c.do(http.MethodGet, "logs/"+target, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+// Start starts a run
+func (c *Client) Start(req *RunRequest) (info *RunInfo, err error) {
+	err = c.call(http.MethodPost, "runs", req, &info)
+	return
+}
+
+// Run returns the information of a run
+func (c *Client) Run(id int) (info *RunInfo, err error) {
+	err = c.call(http.MethodGet, "runs/"+strconv.Itoa(id), nil, &info)
+	return
+}
+
+// Abort requests to abort a run
+func (c *Client) Abort(id int) error {
+	var info RunInfo
+	return c.call(http.MethodPost, "runs/"+strconv.Itoa(id)+"/abort", nil, &info)
+}
+
+// Events receives events of a run until it completes
+func (c *Client) Events(id int, handler func(*Event)) error {
+	resp, err := c.do(http.MethodGet, "runs/"+strconv.Itoa(id)+"/events", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	rd := bufio.NewReader(resp.Body)
+	for {
+		line, err := rd.ReadString('\n')
+		if strings.HasPrefix(line, "data: ") {
+			var e Event
+			if err = json.Unmarshal([]byte(line[6:]), &e); err != nil {
+				return err
+			}
+			handler(&e)
+			if e.Event == EventDone {
+				return nil
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("run %d: events incomplete: %v", id, err)
+		}
+	}
+}
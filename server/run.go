@@ -0,0 +1,387 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/easeway/langx.go/errors"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// Event types streamed from a run
+const (
+	EventActivate       = "activate"
+	EventStart          = "start"
+	EventFinish         = "finish"
+	EventOutput         = "output"
+	EventAbort          = "abort"
+	EventAbortRequested = "abort-requested"
+	EventStop           = "stop"
+	EventLockWait       = "lock-wait"
+	// EventDone is the last event when the run completes
+	EventDone = "done"
+)
+
+// RunRequest is the request to start a run,
+// the fields correspond to the command line options
+type RunRequest struct {
+	// Args are targets, or a command with arguments
+	Args           []string `json:"args,omitempty"`
+	RebuildAll     bool     `json:"rebuild-all,omitempty"`
+	RebuildTargets []string `json:"rebuild-targets,omitempty"`
+	Rebuild        bool     `json:"rebuild,omitempty"`
+	Skip           []string `json:"skip,omitempty"`
+	Parallel       int      `json:"parallel,omitempty"`
+	DryRun         bool     `json:"dryrun,omitempty"`
+	DebugLog       bool     `json:"debug-log,omitempty"`
+	LockMode       string   `json:"lock,omitempty"`
+	// SelectChanged only executes the targets affected by Changes,
+	// which are paths of changed files relative to the project root
+	SelectChanged bool     `json:"select-changed,omitempty"`
+	Changes       []string `json:"changes,omitempty"`
+	// Context is how the client loads the project, the run is rejected
+	// if the server loads it differently, not checked if absent
+	Context *LoadContext `json:"context,omitempty"`
+}
+
+// LoadContext describes what affects loading and running the project
+// other than the project files
+type LoadContext struct {
+	// RootFile is the filename of the project file (hm.RootFile)
+	RootFile string `json:"root-file"`
+	// LaunchPath is where hmake launches relative to project root,
+	// it determines .hmakerc files loaded
+	LaunchPath string `json:"launch-path"`
+	// Env is the environment as KEY=VALUE, which is used by
+	// conditions, secrets and exec-drivers
+	Env []string `json:"env"`
+}
+
+// volatileEnv are variables maintained by shells without effect on runs
+var volatileEnv = map[string]bool{"_": true, "PWD": true, "OLDPWD": true, "SHLVL": true}
+
+// CurrentContext returns the context of current process
+func CurrentContext(p *hm.Project) *LoadContext {
+	return &LoadContext{RootFile: hm.RootFile, LaunchPath: p.LaunchPath, Env: os.Environ()}
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string)
+	for _, item := range env {
+		if pos := strings.Index(item, "="); pos > 0 && !volatileEnv[item[:pos]] {
+			m[item[:pos]] = item[pos+1:]
+		}
+	}
+	return m
+}
+
+// Diff returns the error describing how c1 differs from c,
+// values of environment variables are not revealed
+func (c *LoadContext) Diff(c1 *LoadContext) error {
+	if c.RootFile != c1.RootFile {
+		return fmt.Errorf("project file is %s, not %s", c.RootFile, c1.RootFile)
+	}
+	if c.LaunchPath != c1.LaunchPath {
+		return fmt.Errorf("launched in %q, not %q", c.LaunchPath, c1.LaunchPath)
+	}
+	env, env1 := envMap(c.Env), envMap(c1.Env)
+	var names []string
+	for key, val := range env {
+		if val1, ok := env1[key]; !ok || val1 != val {
+			names = append(names, key)
+		}
+	}
+	for key := range env1 {
+		if _, ok := env[key]; !ok {
+			names = append(names, key)
+		}
+	}
+	if len(names) > 0 {
+		sort.Strings(names)
+		return fmt.Errorf("environment variables differ: %s", strings.Join(names, ", "))
+	}
+	return nil
+}
+
+// Plan creates the plan in the project, default targets are used
+// if no targets are specified
+func (r *RunRequest) Plan(p *hm.Project) (*hm.ExecPlan, error) {
+	args := r.Args
+	if len(args) == 0 && p.WrapperTarget() == nil {
+		var settings hm.CommonSettings
+		p.GetSettings(&settings)
+		if args = settings.DefaultTargets; len(args) == 0 {
+			return nil, fmt.Errorf("no targets selected")
+		}
+	}
+	return r.plan(p, func(plan *hm.ExecPlan) ([]string, error) {
+		requires, err := p.SelectTargets(args)
+		if err == nil && r.SelectChanged {
+			requires = p.SelectChanged(requires, r.Changes)
+		}
+		return requires, err
+	})
+}
+
+// ExecPlan creates the plan to execute Args as a shell command
+// in the context of the target. As the execution may last long,
+// only targets are locked unless locking is disabled
+func (r *RunRequest) ExecPlan(p *hm.Project, target string) (*hm.ExecPlan, error) {
+	return r.plan(p, func(plan *hm.ExecPlan) ([]string, error) {
+		if plan.LockMode != hm.LockNone {
+			plan.LockMode = hm.LockTarget
+		}
+		errs := &errors.AggregatedError{}
+		requires := p.Targets.CompleteNames([]string{target}, errs)
+		if len(requires) > 0 {
+			t := p.Targets[requires[0]]
+			t.Args = r.Args
+			t.Exec = true
+			plan.Rebuild(requires[0])
+		}
+		return requires, errs.Aggregate()
+	})
+}
+
+func (r *RunRequest) plan(p *hm.Project, selectTargets func(*hm.ExecPlan) ([]string, error)) (*hm.ExecPlan, error) {
+	plan := p.Plan()
+	plan.LockMode = r.LockMode
+	errs := &errors.AggregatedError{}
+	plan.Rebuild(p.Targets.CompleteNames(p.QualifyNames(r.RebuildTargets, errs), errs)...)
+	plan.Skip(p.Targets.CompleteNames(p.QualifyNames(r.Skip, errs), errs)...)
+	requires, err := selectTargets(plan)
+	errs.Add(err)
+	if err = errs.Aggregate(); err != nil {
+		return nil, err
+	}
+	if r.Rebuild {
+		plan.Rebuild(requires...)
+	}
+	plan.RebuildAll = r.RebuildAll
+	plan.MaxConcurrency = r.Parallel
+	plan.DebugLog = r.DebugLog
+	plan.DryRun = r.DryRun
+	return plan, plan.Require(requires...)
+}
+
+// Event is the JSON form of events emitted by ExecPlan
+type Event struct {
+	Seq      int           `json:"seq"`
+	Event    string        `json:"event"`
+	Target   string        `json:"target,omitempty"`
+	State    hm.TaskState  `json:"state,omitempty"`
+	Result   hm.TaskResult `json:"result,omitempty"`
+	StartAt  *time.Time    `json:"start-at,omitempty"`
+	FinishAt *time.Time    `json:"finish-at,omitempty"`
+	Error    string        `json:"error,omitempty"`
+	Output   []byte        `json:"output,omitempty"`
+	Abandon  bool          `json:"abandon,omitempty"`
+	// Holder is the process holding the lock of target
+	Holder *hm.LockHolder `json:"holder,omitempty"`
+	// Tasks is the number of tasks being aborted
+	Tasks int `json:"tasks,omitempty"`
+}
+
+func taskEvent(event string, t *hm.Task) *Event {
+	e := &Event{Event: event, Target: t.Name(), State: t.State}
+	if t.State >= hm.Running {
+		startAt := t.StartTime
+		e.StartAt = &startAt
+	}
+	if t.State >= hm.Abandoned {
+		e.Result = t.Result
+	}
+	if t.State >= hm.Finished {
+		finishAt := t.FinishTime
+		e.FinishAt = &finishAt
+	}
+	if t.Error != nil {
+		e.Error = t.Error.Error()
+	}
+	return e
+}
+
+// Run is the execution of a plan
+type Run struct {
+	ID       int
+	Request  *RunRequest
+	Plan     *hm.ExecPlan
+	StartAt  time.Time
+	FinishAt time.Time
+	Err      error
+
+	abortCh chan os.Signal
+	events  []*Event
+	done    bool
+	cond    *sync.Cond
+}
+
+// RunInfo describes a run
+type RunInfo struct {
+	ID       int         `json:"id"`
+	Request  *RunRequest `json:"request"`
+	Targets  []string    `json:"targets"`
+	State    string      `json:"state"`
+	StartAt  time.Time   `json:"start-at"`
+	FinishAt *time.Time  `json:"finish-at,omitempty"`
+	Error    string      `json:"error,omitempty"`
+	// Summary is available when the run completes
+	Summary hm.ExecSummary `json:"summary,omitempty"`
+}
+
+// Run states
+const (
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+)
+
+func newRun(id int, req *RunRequest, plan *hm.ExecPlan) *Run {
+	r := &Run{
+		ID:      id,
+		Request: req,
+		Plan:    plan,
+		StartAt: time.Now(),
+		abortCh: make(chan os.Signal, 2),
+		cond:    sync.NewCond(&sync.Mutex{}),
+	}
+	plan.OnEvent(r.onEvent)
+	return r
+}
+
+func (r *Run) execute() {
+	err := r.Plan.Execute(r.abortCh)
+	r.cond.L.Lock()
+	r.Err = err
+	r.FinishAt = time.Now()
+	r.done = true
+	e := &Event{Event: EventDone}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	r.appendEvent(e)
+	r.cond.L.Unlock()
+}
+
+// appendEvent must be called with r.cond.L locked
+func (r *Run) appendEvent(e *Event) {
+	e.Seq = len(r.events) + 1
+	r.events = append(r.events, e)
+	r.cond.Broadcast()
+}
+
+func (r *Run) onEvent(event interface{}) {
+	var e *Event
+	switch evt := event.(type) {
+	case *hm.EvtTaskActivated:
+		e = taskEvent(EventActivate, evt.Task)
+	case *hm.EvtTaskStart:
+		e = taskEvent(EventStart, evt.Task)
+	case *hm.EvtTaskFinish:
+		e = taskEvent(EventFinish, evt.Task)
+	case *hm.EvtTaskOutput:
+		e = taskEvent(EventOutput, evt.Task)
+		e.Output = append([]byte{}, evt.Output...)
+	case *hm.EvtTaskAbort:
+		e = taskEvent(EventAbort, evt.Task)
+		e.Abandon = evt.Abandon
+	case *hm.EvtAbortRequested:
+		e = &Event{Event: EventAbortRequested, Abandon: evt.Abandon, Tasks: len(evt.Tasks)}
+	case *hm.EvtTaskStop:
+		e = taskEvent(EventStop, evt.Task)
+	case *hm.EvtTaskLockWait:
+		e = taskEvent(EventLockWait, evt.Task)
+		e.Holder = evt.Holder
+	default:
+		return
+	}
+	r.cond.L.Lock()
+	r.appendEvent(e)
+	r.cond.L.Unlock()
+}
+
+// Done indicates the run completes
+func (r *Run) Done() bool {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	return r.done
+}
+
+// Abort requests to abort running tasks, the second request
+// abandons the tasks, the same as pressing Ctrl-C twice
+func (r *Run) Abort() {
+	select {
+	case r.abortCh <- os.Interrupt:
+	default:
+	}
+}
+
+// Info returns the description of the run
+func (r *Run) Info() *RunInfo {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	info := &RunInfo{
+		ID:      r.ID,
+		Request: r.Request,
+		Targets: r.Plan.RequiredTargets,
+		State:   RunRunning,
+		StartAt: r.StartAt,
+	}
+	if r.done {
+		finishAt := r.FinishAt
+		info.FinishAt = &finishAt
+		info.State = RunSucceeded
+		info.Summary = r.Plan.Summary
+		if r.Err != nil {
+			info.State = RunFailed
+			info.Error = r.Err.Error()
+		}
+	}
+	return info
+}
+
+// Events waits for events after the sequence number since, it returns
+// nil if no more events will come
+func (r *Run) Events(since int) []*Event {
+	r.cond.L.Lock()
+	defer r.cond.L.Unlock()
+	for !r.done && since >= len(r.events) {
+		r.cond.Wait()
+	}
+	if since >= len(r.events) {
+		return nil
+	}
+	return r.events[since:]
+}
+
+// streamEvents sends events as Server-Sent Events, starting after
+// the sequence number since, until the run completes
+func (r *Run) streamEvents(w http.ResponseWriter, since int) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for {
+		events := r.Events(since)
+		if events == nil {
+			return
+		}
+		for _, e := range events {
+			encoded, _ := json.Marshal(e)
+			if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", e.Seq, e.Event, encoded); err != nil {
+				return
+			}
+			since = e.Seq
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
@@ -0,0 +1,417 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	hm "github.com/evo-cloud/hmake/project"
+)
+
+// APIPrefix prefixes all endpoints of the API
+const APIPrefix = "/v1/"
+
+// maxRuns is the number of finished runs kept in memory
+const maxRuns = 16
+
+// Loader loads, resolves and finalizes the project
+type Loader func() (*hm.Project, error)
+
+// Server keeps a project loaded and serves the HTTP/JSON API,
+// the project is reloaded when any of the project files changes
+type Server struct {
+	// Load loads the project
+	Load Loader
+	// Env is additional environment variables for runs
+	Env map[string]string
+	// Token is required as the bearer token in requests if not empty
+	Token string
+
+	lock     sync.Mutex
+	project  *hm.Project
+	loadErr  error
+	loadedAt time.Time
+	files    map[string]time.Time
+	runs     []*Run
+	lastID   int
+	mux      *http.ServeMux
+}
+
+// ProjectInfo describes the loaded project
+type ProjectInfo struct {
+	Name     string    `json:"name,omitempty"`
+	BaseDir  string    `json:"base-dir,omitempty"`
+	Files    []string  `json:"files,omitempty"`
+	LoadedAt time.Time `json:"loaded-at"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// TargetInfo describes a target
+type TargetInfo struct {
+	Name      string   `json:"name"`
+	Desc      string   `json:"description,omitempty"`
+	Signature string   `json:"signature,omitempty"`
+	Command   bool     `json:"command,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Disabled  string   `json:"disabled,omitempty"`
+	Depends   []string `json:"depends,omitempty"`
+}
+
+// Edge in dependency graph, From depends on To
+type Edge struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// Graph is the dependency graph of targets
+type Graph struct {
+	Nodes []*TargetInfo `json:"nodes"`
+	Edges []*Edge       `json:"edges"`
+}
+
+// apiError is the error with HTTP status code
+type apiError struct {
+	Status int
+	Err    error
+}
+
+func (e *apiError) Error() string {
+	return e.Err.Error()
+}
+
+func httpError(status int, format string, args ...interface{}) error {
+	return &apiError{Status: status, Err: fmt.Errorf(format, args...)}
+}
+
+// NewServer creates a server with the project loader
+func NewServer(loader Loader) *Server {
+	s := &Server{Load: loader, Env: make(map[string]string)}
+	s.mux = http.NewServeMux()
+	s.handle("project", s.getProject)
+	s.handle("targets", s.getTargets)
+	s.handle("graph", s.getGraph)
+	s.handle("summary", s.getSummary)
+	s.mux.HandleFunc(APIPrefix+"runs", s.handleRuns)
+	s.mux.HandleFunc(APIPrefix+"runs/", s.handleRun)
+	s.mux.HandleFunc(APIPrefix+"logs/", s.handleLog)
+	return s
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" {
+		auth := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+s.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, httpError(http.StatusUnauthorized, "unauthorized"))
+			return
+		}
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) handle(name string, fn func() (interface{}, error)) {
+	s.mux.HandleFunc(APIPrefix+name, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, httpError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+			return
+		}
+		writeResult(w, http.StatusOK)(fn())
+	})
+}
+
+func writeError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	if e, ok := err.(*apiError); ok {
+		status = e.Status
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+func writeJSON(w http.ResponseWriter, status int, val interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(val)
+}
+
+func writeResult(w http.ResponseWriter, status int) func(interface{}, error) {
+	return func(val interface{}, err error) {
+		if err != nil {
+			writeError(w, err)
+		} else {
+			writeJSON(w, status, val)
+		}
+	}
+}
+
+// projectFiles returns the full paths of all files loaded in the project
+// including the ones in sub-projects
+func projectFiles(p *hm.Project) (files []string) {
+	for _, f := range p.Files {
+		files = append(files, filepath.Join(p.BaseDir, f.Source))
+	}
+	for _, name := range p.SubProjectNames() {
+		files = append(files, projectFiles(p.SubProjects[name])...)
+	}
+	return
+}
+
+func (s *Server) changed() bool {
+	for fn, modTime := range s.files {
+		info, err := os.Stat(fn)
+		if err != nil || !info.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) reload() {
+	s.loadedAt = time.Now()
+	s.project, s.loadErr = s.Load()
+	s.files = make(map[string]time.Time)
+	if s.loadErr != nil {
+		s.project = nil
+		return
+	}
+	for _, fn := range projectFiles(s.project) {
+		if info, err := os.Stat(fn); err == nil {
+			s.files[fn] = info.ModTime()
+		}
+	}
+}
+
+// Project returns the loaded project, it's reloaded if any file changed,
+// or last loading failed
+func (s *Server) Project() (*hm.Project, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.currentProject()
+}
+
+func (s *Server) currentProject() (*hm.Project, error) {
+	if s.project == nil || s.changed() {
+		s.reload()
+	}
+	return s.project, s.loadErr
+}
+
+func (s *Server) getProject() (interface{}, error) {
+	p, err := s.Project()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	info := &ProjectInfo{LoadedAt: s.loadedAt}
+	if err != nil {
+		info.Error = err.Error()
+		return info, nil
+	}
+	info.Name = p.Name
+	info.BaseDir = p.BaseDir
+	for fn := range s.files {
+		info.Files = append(info.Files, fn)
+	}
+	sort.Strings(info.Files)
+	return info, nil
+}
+
+func targetInfo(t *hm.Target) *TargetInfo {
+	info := &TargetInfo{
+		Name:      t.Name,
+		Desc:      t.Desc,
+		Signature: t.Signature(),
+		Command:   t.Command,
+		Tags:      t.Tags,
+		Disabled:  t.Disabled,
+	}
+	for name := range t.Depends {
+		info.Depends = append(info.Depends, name)
+	}
+	sort.Strings(info.Depends)
+	return info
+}
+
+func (s *Server) getTargets() (interface{}, error) {
+	p, err := s.Project()
+	if err != nil {
+		return nil, err
+	}
+	targets := make([]*TargetInfo, 0, len(p.Targets)+len(p.DisabledTargets))
+	for _, name := range p.TargetNames() {
+		targets = append(targets, targetInfo(p.Targets[name]))
+	}
+	for _, name := range p.DisabledTargetNames() {
+		targets = append(targets, targetInfo(p.DisabledTargets[name]))
+	}
+	return targets, nil
+}
+
+func (s *Server) getGraph() (interface{}, error) {
+	p, err := s.Project()
+	if err != nil {
+		return nil, err
+	}
+	g := &Graph{Nodes: []*TargetInfo{}, Edges: []*Edge{}}
+	for _, name := range p.TargetNames() {
+		info := targetInfo(p.Targets[name])
+		for _, dep := range info.Depends {
+			g.Edges = append(g.Edges, &Edge{From: name, To: dep})
+		}
+		info.Depends = nil
+		g.Nodes = append(g.Nodes, info)
+	}
+	return g, nil
+}
+
+func (s *Server) getSummary() (interface{}, error) {
+	p, err := s.Project()
+	if err != nil {
+		return nil, err
+	}
+	sum, err := p.Summary()
+	if os.IsNotExist(err) {
+		return hm.ExecSummary{}, nil
+	}
+	return sum, err
+}
+
+func (s *Server) handleLog(w http.ResponseWriter, r *http.Request) {
+	p, err := s.Project()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, APIPrefix+"logs/")
+	t := p.Targets[name]
+	if t == nil {
+		writeError(w, httpError(http.StatusNotFound, "target %s not defined", name))
+		return
+	}
+	f, err := os.Open(hm.NewTask(p.Plan(), t).WorkFile(".log"))
+	if os.IsNotExist(err) {
+		err = httpError(http.StatusNotFound, "no log of target %s", name)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain")
+	io.Copy(w, f)
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		s.lock.Lock()
+		runs := make([]*RunInfo, 0, len(s.runs))
+		for _, run := range s.runs {
+			runs = append(runs, run.Info())
+		}
+		s.lock.Unlock()
+		writeJSON(w, http.StatusOK, runs)
+	case http.MethodPost:
+		var req RunRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			writeError(w, httpError(http.StatusBadRequest, "invalid request: %v", err))
+			return
+		}
+		run, err := s.Start(&req)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, run.Info())
+	default:
+		writeError(w, httpError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+	}
+}
+
+// handleRun serves runs/ID, runs/ID/events and runs/ID/abort
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	path := strings.Split(strings.TrimPrefix(r.URL.Path, APIPrefix+"runs/"), "/")
+	id, err := strconv.Atoi(path[0])
+	run := s.Run(id)
+	if err != nil || run == nil || len(path) > 2 {
+		writeError(w, httpError(http.StatusNotFound, "run %s not found", path[0]))
+		return
+	}
+	action := ""
+	if len(path) > 1 {
+		action = path[1]
+	}
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		writeJSON(w, http.StatusOK, run.Info())
+	case action == "events" && r.Method == http.MethodGet:
+		since, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+		run.streamEvents(w, since)
+	case action == "abort" && r.Method == http.MethodPost:
+		run.Abort()
+		writeJSON(w, http.StatusOK, run.Info())
+	case action == "events" || action == "abort" || action == "":
+		writeError(w, httpError(http.StatusMethodNotAllowed, "method %s not allowed", r.Method))
+	default:
+		writeError(w, httpError(http.StatusNotFound, "unknown action %s", action))
+	}
+}
+
+// Run finds the run by ID
+func (s *Server) Run(id int) *Run {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, run := range s.runs {
+		if run.ID == id {
+			return run
+		}
+	}
+	return nil
+}
+
+// Start creates a plan from the request and runs it in background,
+// only one run is allowed at a time
+func (s *Server) Start(req *RunRequest) (*Run, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, run := range s.runs {
+		if !run.Done() {
+			return nil, httpError(http.StatusConflict, "run %d is in progress", run.ID)
+		}
+	}
+	p, err := s.currentProject()
+	if err != nil {
+		return nil, err
+	}
+	// the project is loaded in the environment of the server
+	if req.Context != nil {
+		if err = CurrentContext(p).Diff(req.Context); err != nil {
+			return nil, httpError(http.StatusPreconditionFailed, "%v", err)
+		}
+	}
+	plan, err := req.Plan(p)
+	if err != nil {
+		return nil, httpError(http.StatusBadRequest, "%v", err)
+	}
+	for key, val := range s.Env {
+		plan.Env[key] = val
+	}
+	// targets are modified by the run, reload for later requests
+	s.project = nil
+
+	s.lastID++
+	run := newRun(s.lastID, req, plan)
+	s.runs = append(s.runs, run)
+	if len(s.runs) > maxRuns {
+		s.runs = s.runs[len(s.runs)-maxRuns:]
+	}
+	go run.execute()
+	return run, nil
+}
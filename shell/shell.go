@@ -44,12 +44,12 @@ func (a *Args) Add(args ...string) *Args {
 
 // ScriptFile returns the filename of script
 func ScriptFile(t *hm.Task) string {
-	return filepath.Join(t.Plan.WorkPath, t.Name()+".script")
+	return t.WorkFile(".script")
 }
 
 // LogFile returns the fullpath to log filename
 func LogFile(t *hm.Task) string {
-	return filepath.Join(t.Plan.WorkPath, t.Name()+".log")
+	return t.WorkFile(".log")
 }
 
 // BuildScript generates script file according to cmds/script in target
@@ -93,6 +93,7 @@ type Executor struct {
 	Stderr      bool
 	LogToTask   bool
 	LogFileName string
+	AppendLog   bool
 }
 
 // AddArgs appends more arguments
@@ -135,6 +136,12 @@ func (x *Executor) LogTo(filename string) *Executor {
 	return x
 }
 
+// Append appends output to the log file instead of truncating it
+func (x *Executor) Append() *Executor {
+	x.AppendLog = true
+	return x
+}
+
 // Run starts the executor
 func (x *Executor) Run(sigCh <-chan os.Signal) (err error) {
 	x.Task.Plan.Logf("%s Exec: %v\n", x.Task.Name(), x.Cmd.Args)
@@ -146,20 +153,24 @@ func (x *Executor) Run(sigCh <-chan os.Signal) (err error) {
 	} else if x.Stdout || x.Stderr {
 		logFn := LogFile(x.Task)
 		if x.LogFileName != "" {
-			logFn = filepath.Join(x.Task.Plan.WorkPath, x.LogFileName)
+			logFn = filepath.Join(x.Task.WorkPath(), x.LogFileName)
+		}
+		flags := syscall.O_WRONLY | syscall.O_CREAT | syscall.O_TRUNC
+		if x.AppendLog {
+			flags = syscall.O_WRONLY | syscall.O_CREAT | syscall.O_APPEND
 		}
 		var out *os.File
-		out, err = os.OpenFile(logFn,
-			syscall.O_WRONLY|syscall.O_CREAT|syscall.O_TRUNC,
-			0644)
+		out, err = os.OpenFile(logFn, flags, 0644)
 		if err != nil {
 			x.Task.Plan.Logf("%s Exec OpenLog %s Error: %v\n", x.Task.Name(), logFn, err)
 			return err
 		}
 		defer out.Close()
-		var w io.Writer = out
+		masked := x.Task.Plan.MaskWriter(out)
+		defer masked.Close()
+		var w io.Writer = masked
 		if x.LogToTask {
-			w = io.MultiWriter(out, x.Task)
+			w = io.MultiWriter(w, x.Task)
 		}
 		if x.Stdout {
 			x.Cmd.Stdout = w
@@ -203,6 +214,7 @@ func Exec(t *hm.Task, command string, args ...string) *Executor {
 		cmd.Env = append(cmd.Env, name+"="+value)
 	}
 	cmd.Env = append(cmd.Env, t.EnvVars()...)
+	cmd.Env = append(cmd.Env, t.SecretEnv()...)
 	cmd.Dir = filepath.Join(t.Project().BaseDir, t.Target.WorkingDir())
 	return &Executor{
 		Task:      t,
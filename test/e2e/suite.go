@@ -54,6 +54,22 @@ func waitHmake(project string, args ...string) *gexec.Session {
 	return session
 }
 
+// waitOutputHmake runs hmake outside CI environments, unless
+// specified in env, and returns the output
+func waitOutputHmake(env []string, project string, args ...string) (*gexec.Session, string) {
+	cmd := hmakeCmd(project, args...)
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "GITHUB_ACTIONS=") && !strings.HasPrefix(kv, "GITLAB_CI=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env, env...)
+	session, err := gexec.Start(cmd, GinkgoWriter, GinkgoWriter)
+	Expect(err).Should(Succeed())
+	session.Wait(15 * time.Minute)
+	return session, string(session.Out.Contents()) + string(session.Err.Contents())
+}
+
 func targetOutput(project, target string) string {
 	content, err := ioutil.ReadFile(filepath.Join(projectDir(project), ".hmake", target+".log"))
 	Expect(err).Should(Succeed())
@@ -125,8 +141,42 @@ var _ = Describe("docker", func() {
 		Eventually(waitHmake("docker-commit", "test", "-vR")).Should(gexec.Exit(0))
 	})
 
+	It("save and load", func() {
+		exec.Command("docker", "rmi", "hmake-test-save:latest").Run()
+		defer func() {
+			exec.Command("docker", "rmi", "hmake-test-save:latest").Run()
+		}()
+		Eventually(waitHmake("docker-save", "save", "-vR")).Should(gexec.Exit(0))
+		Expect(filepath.Join(projectDir("docker-save"), ".hmake", "saved.tar.gz")).Should(BeAnExistingFile())
+		Expect(exec.Command("docker", "rmi", "hmake-test-save:latest").Run()).Should(Succeed())
+		Eventually(waitHmake("docker-save", "verify", "-vR")).Should(gexec.Exit(0))
+	})
+
+	It("save loaded images without image", func() {
+		defer func() {
+			exec.Command("docker", "rmi", "hmake-test-save:latest").Run()
+		}()
+		Eventually(waitHmake("docker-save", "save", "-vR")).Should(gexec.Exit(0))
+		Expect(exec.Command("docker", "rmi", "hmake-test-save:latest").Run()).Should(Succeed())
+		resaved := filepath.Join(projectDir("docker-save"), ".hmake", "resaved.tar")
+		os.Remove(resaved)
+		Eventually(waitHmake("docker-save", "resave", "-vR")).Should(gexec.Exit(0))
+		Expect(resaved).Should(BeAnExistingFile())
+	})
+
+	It("push", func() {
+		defer func() {
+			exec.Command("docker", "rmi", "localhost:5000/hmake-test-push:latest").Run()
+		}()
+		Eventually(waitHmake("docker-push", "push", "-vR")).Should(gexec.Exit(0))
+		content, err := ioutil.ReadFile(filepath.Join(projectDir("docker-push"), ".hmake", "push.digests"))
+		Expect(err).Should(Succeed())
+		Expect(string(content)).Should(HavePrefix("localhost:5000/hmake-test-push:latest localhost:5000/hmake-test-push@sha256:"))
+	})
+
 	It("docker-compose", func() {
 		Eventually(waitHmake("docker-compose", "-vR")).Should(gexec.Exit(0))
+		Expect(filepath.Join(projectDir("docker-compose"), ".hmake", "compose.services.log")).Should(BeAnExistingFile())
 	})
 
 	Describe("command mode", func() {
@@ -145,6 +195,14 @@ var _ = Describe("docker", func() {
 			Eventually(waitHmake("docker", "-x", "true")).Should(gexec.Exit(0))
 		})
 
+		It("keeps exec container", func() {
+			Eventually(waitHmake("docker", "--keep", "-x", "touch", "/tmp/kept")).Should(gexec.Exit(0))
+			Eventually(waitHmake("docker", "--keep", "-x", "test", "-f", "/tmp/kept")).Should(gexec.Exit(0))
+			Eventually(waitHmake("docker", "--exec-stop")).Should(gexec.Exit(0))
+			Eventually(waitHmake("docker", "--keep", "-x", "test", "-f", "/tmp/kept")).Should(gexec.Exit(1))
+			Eventually(waitHmake("docker", "--exec-stop")).Should(gexec.Exit(0))
+		})
+
 		It("not impact target result", func() {
 			Eventually(waitHmake("docker", "exec", "-R")).Should(gexec.Exit(0))
 			// try to fail --exec, can't use "false" because of docker bug
@@ -170,3 +228,52 @@ var _ = Describe("docker", func() {
 		})
 	})
 })
+
+var _ = Describe("output", func() {
+	It("prints the output of each target as one block", func() {
+		session, out := waitOutputHmake(nil, "output", "-vR", "-p", "2", "--output=grouped", "first", "second")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(out).Should(MatchRegexp(`first-1\r?\nfirst-2`))
+		Expect(out).Should(MatchRegexp(`second-1\r?\nsecond-2`))
+	})
+
+	It("prints the output of abandoned targets as one block", func() {
+		session := execHmake("output", "-vR", "--output=grouped", "hang")
+		time.Sleep(time.Second)
+		session.Interrupt()
+		time.Sleep(300 * time.Millisecond)
+		session.Interrupt()
+		session.Wait(30 * time.Second)
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(string(session.Out.Contents())).Should(MatchRegexp(`hang-1\r?\nhang-2`))
+	})
+
+	It("prints the output of failed targets only", func() {
+		session, out := waitOutputHmake(nil, "output", "-vR", "--output=failed-only", "bad")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(out).Should(ContainSubstring("bad-out"))
+		Expect(out).ShouldNot(ContainSubstring("ok-out"))
+	})
+
+	It("prints groups in GitHub Actions", func() {
+		session, out := waitOutputHmake([]string{"GITHUB_ACTIONS=true"},
+			"output", "-vR", "--output=grouped", "ok")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(out).Should(MatchRegexp(`::group::ok .*\r?\nok-out\r?\n::endgroup::`))
+	})
+
+	It("prints sections in GitLab CI", func() {
+		session, out := waitOutputHmake([]string{"GITLAB_CI=true"},
+			"output", "-vR", "--output=grouped", "ok")
+		Eventually(session).Should(gexec.Exit(0))
+		Expect(out).Should(MatchRegexp(`section_start:\d+:hmake_ok\[collapsed=true\]`))
+		Expect(out).Should(ContainSubstring("ok-out"))
+		Expect(out).Should(MatchRegexp(`section_end:\d+:hmake_ok`))
+	})
+
+	It("rejects unknown output mode", func() {
+		session, out := waitOutputHmake(nil, "output", "--output=bogus", "ok")
+		Eventually(session).Should(gexec.Exit(1))
+		Expect(out).Should(ContainSubstring("unknown output mode bogus"))
+	})
+})
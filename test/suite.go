@@ -1,19 +1,27 @@
 package test
 
 import (
+	"bytes"
 	"encoding/json"
 	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	_ "github.com/evo-cloud/hmake/docker"
 	hm "github.com/evo-cloud/hmake/project"
+	"github.com/evo-cloud/hmake/server"
 	sh "github.com/evo-cloud/hmake/shell"
 )
 
@@ -112,6 +120,7 @@ var _ = BeforeSuite(func() {
 	Expect(FixturesDir).To(BeADirectory())
 	// register shell driver for testing
 	hm.RegisterExecDriver(sh.ExecDriverName, sh.Factory)
+	hm.RegisterExecDriverSchema(sh.ExecDriverName, hm.SchemaOf(&sh.Target{}))
 })
 
 var _ = Describe("HyperMake", func() {
@@ -187,6 +196,434 @@ var _ = Describe("HyperMake", func() {
 			Expect(proj.Targets["b"].Ext).Should(HaveKeyWithValue("key", "$[non-exist]"))
 		})
 
+		It("extends templates", func() {
+			proj := LoadFixtureProject("templates")
+			Expect(proj.Targets).ShouldNot(HaveKey("base"))
+			build := proj.Targets["build"]
+			Expect(build.Desc).To(Equal("build"))
+			Expect(build.Watches).To(Equal([]string{"src"}))
+			Expect(build.Ext).Should(HaveKeyWithValue("image", "builder:latest"))
+			Expect(build.Ext["env"]).To(Equal([]interface{}{"A=1"}))
+			Expect(build.Ext["cmds"]).To(Equal([]interface{}{"make"}))
+			t := proj.Targets["test-linux"]
+			Expect(t.After).To(Equal([]string{"build"}))
+			Expect(t.Watches).To(Equal([]string{"src", "test"}))
+			Expect(t.Ext).Should(HaveKeyWithValue("image", "tester:linux"))
+			Expect(t.Ext["env"]).To(Equal([]interface{}{"A=1", "B=2"}))
+			Expect(t.Ext["volumes"]).To(Equal([]interface{}{"/var/cache:/cache"}))
+			Expect(t.Ext["docker"]).Should(HaveKeyWithValue("user", "root"))
+			Expect(t.Ext["docker"]).Should(HaveKeyWithValue("net", "bridge"))
+			Expect(proj.Targets["test-darwin"].Ext).Should(HaveKeyWithValue("image", "tester:darwin"))
+			Expect(proj.Targets["test-linux"].Depends).Should(HaveKey("build"))
+		})
+
+		It("overrides always and command from templates", func() {
+			proj := LoadFixtureProject("templates", "override")
+			t := proj.Targets["inherit"]
+			Expect(t.Always).To(BeTrue())
+			Expect(t.Command).To(BeTrue())
+			t = proj.Targets["override"]
+			Expect(t.Always).To(BeFalse())
+			Expect(t.Command).To(BeFalse())
+		})
+
+		It("reports unknown templates", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("templates", "unknown"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("unknown template non-exist")))
+		})
+
+		It("reports cyclic templates", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("templates", "cyclic"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("cyclic templates")))
+		})
+
+		It("expand targets with matrix", func() {
+			proj := LoadFixtureProject("target-expand", "matrix")
+			Expect(proj.Targets).Should(HaveKey("build-linux-amd64"))
+			Expect(proj.Targets).Should(HaveKey("build-linux-arm64"))
+			Expect(proj.Targets).Should(HaveKey("build-darwin-amd64"))
+			Expect(proj.Targets).ShouldNot(HaveKey("build-darwin-arm64"))
+			Expect(proj.Targets).Should(HaveKey("build-windows-amd64"))
+			Expect(proj.Targets).Should(HaveKey("sub-linux-debug"))
+			Expect(proj.Targets).Should(HaveKey("sub-darwin-release"))
+			t := proj.Targets["build-linux-arm64"]
+			Expect(t.Vars).Should(Equal(map[string]string{"os": "linux", "arch": "arm64"}))
+			Expect(t.Ext["env"]).Should(Equal([]interface{}{"GOOS=linux", "GOARCH=arm64"}))
+			Expect(t.Ext["docker"]).Should(HaveKeyWithValue("volumes", []interface{}{"cache-linux:/cache"}))
+			Expect(proj.Targets["test-darwin"].Depends).Should(HaveLen(1))
+			Expect(proj.Targets["test-darwin"].Depends).Should(HaveKey("build-darwin-amd64"))
+			env := hm.NewTask(proj.Plan(), proj.Targets["sub-linux-debug"]).EnvVars()
+			Expect(env).Should(ContainElement("HMAKE_VAR_OS=linux"))
+			Expect(env).Should(ContainElement("HMAKE_VAR_FLAVOR=debug"))
+		})
+
+		It("expand targets with undefined matrix", func() {
+			_, err := hm.LoadFile(Fixtures("target-expand", "bad-name"), "matrix.hmake", false)
+			Expect(err).Should(MatchError(ContainSubstring("matrix os not defined")))
+		})
+
+		It("applies conditions", func() {
+			proj := LoadFixtureProject("conditions")
+			Expect(proj.Targets).Should(HaveKey("native"))
+			t := proj.Targets["native"]
+			if runtime.GOOS == "darwin" {
+				Expect(t.Ext).Should(HaveKeyWithValue("image", "builder:darwin"))
+				Expect(t.Ext).Should(HaveKeyWithValue("env", ContainElement("CC=clang")))
+			} else {
+				Expect(t.Ext).Should(HaveKeyWithValue("image", "builder:latest"))
+				Expect(t.Ext).Should(HaveKeyWithValue("env", ContainElement("CC=gcc")))
+			}
+			if runtime.GOOS != "windows" {
+				Expect(proj.Targets).ShouldNot(HaveKey("windows-only"))
+				Expect(proj.DisabledTargets).Should(HaveKey("windows-only"))
+				Expect(proj.DisabledTargets["windows-only"].Disabled).Should(ContainSubstring("HMAKE_OS"))
+			}
+			Expect(proj.DisabledTargets).Should(HaveKey("docs"))
+			Expect(proj.DisabledTargets).Should(HaveKey("release"))
+			Expect(proj.DisabledTargetNames()).Should(ContainElement("docs"))
+
+			err := proj.Plan().Require("docs")
+			Expect(err).Should(MatchError(ContainSubstring("target docs is disabled: if: settings.docs.enabled")))
+
+			Expect(proj.MergeSettingsFlat(map[string]interface{}{
+				"docs.enabled": true,
+				"skip-release": false,
+			})).Should(Succeed())
+			Expect(proj.Finalize()).Should(Succeed())
+			Expect(proj.Targets).Should(HaveKey("docs"))
+			Expect(proj.Targets).Should(HaveKey("release"))
+		})
+
+		It("evaluates conditions again when finalized", func() {
+			proj := LoadFixtureProject("conditions")
+			t := proj.Targets["site"]
+			Expect(t.Ext).Should(HaveKeyWithValue("image", "builder:latest"))
+			Expect(t.Ext).ShouldNot(HaveKey("env"))
+
+			Expect(proj.MergeSettingsFlat(map[string]interface{}{"docs.enabled": true})).Should(Succeed())
+			Expect(proj.Finalize()).Should(Succeed())
+			t = proj.Targets["site"]
+			Expect(t.Ext).Should(HaveKeyWithValue("image", "builder:docs"))
+			Expect(t.Ext).Should(HaveKeyWithValue("env", ConsistOf("DOCS=1")))
+
+			Expect(proj.MergeSettingsFlat(map[string]interface{}{"docs.enabled": false})).Should(Succeed())
+			Expect(proj.Finalize()).Should(Succeed())
+			t = proj.Targets["site"]
+			Expect(t.Ext).Should(HaveKeyWithValue("image", "builder:latest"))
+			Expect(t.Ext).ShouldNot(HaveKey("env"))
+			Expect(proj.DisabledTargets).Should(HaveKey("docs"))
+		})
+
+		It("reports dependency on disabled target", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("conditions", "bad-dep"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("after optional which is disabled")))
+		})
+
+		It("reports invalid conditions", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("conditions", "bad-expr"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("unknown identifier unknown")))
+		})
+
+		It("validates properties", func() {
+			var msgs []string
+			for _, d := range hm.ValidateFile(Fixtures("validate"), hm.RootFile, sh.ExecDriverName) {
+				msgs = append(msgs, d.String())
+			}
+			Expect(msgs).Should(ConsistOf(
+				"HyperMake:8:9: target build: unknown property watch, did you mean watches?",
+				"HyperMake:10:17: target build: always expects boolean, got string",
+				"HyperMake:15:16: target test: after expects list, got string",
+				"HyperMake:16:22: target test: exec-driver: unknown exec-driver nope",
+				`HyperMake:21:13: target lint: if: invalid condition "HMAKE_OS ==": unexpected end of expression`,
+				"HyperMake:25:15: target lint: unknown property when[0].consol, did you mean console?",
+				"HyperMake:29:1: file: unknown property setings, did you mean settings?",
+			))
+		})
+
+		It("validates files failed to load", func() {
+			proj, err := hm.LocateProjectFrom(Fixtures("validate", "mismatch"), hm.RootFile)
+			Expect(err).Should(HaveOccurred())
+			Expect(proj).ShouldNot(BeNil())
+			var msgs []string
+			for _, d := range proj.Validate() {
+				msgs = append(msgs, d.String())
+			}
+			Expect(msgs).Should(ConsistOf("HyperMake:9:13: target build: watches expects list, got dictionary"))
+
+			proj, err = hm.LocateProjectFrom(Fixtures("validate", "mismatch-sub"), hm.RootFile)
+			Expect(err).Should(Succeed())
+			Expect(proj.Resolve()).ShouldNot(Succeed())
+			msgs = nil
+			for _, d := range proj.Validate() {
+				msgs = append(msgs, d.String())
+			}
+			Expect(msgs).Should(ConsistOf(filepath.Join("lib", "HyperMake") + ":9:13: target build: watches expects list, got dictionary"))
+		})
+
+		It("validates project without problems", func() {
+			proj := LoadFixtureProject("secrets")
+			Expect(proj.Validate()).Should(BeEmpty())
+		})
+
+		It("loads sub-projects", func() {
+			proj := LoadFixtureProject("subprojects")
+			Expect(proj.SubProjectNames()).Should(Equal([]string{"api", "common"}))
+			Expect(proj.TargetNames()).Should(Equal([]string{
+				"all", "api:build", "api:prepare", "common:build",
+			}))
+			t := proj.Targets["api:build"]
+			Expect(t.LocalName()).Should(Equal("build"))
+			Expect(t.Project.Name).Should(Equal("api"))
+			Expect(t.Depends).Should(HaveKey("api:prepare"))
+			Expect(t.Depends).Should(HaveKey("common:build"))
+			Expect(proj.Targets["all"].Depends).Should(HaveKey("common:build"))
+
+			set := map[string]interface{}{}
+			Expect(t.Project.GetSettings(&set)).Should(Succeed())
+			Expect(set).Should(HaveKeyWithValue("greeting", "hello"))
+			Expect(set).Should(HaveKeyWithValue("owner", "api"))
+
+			task := hm.NewTask(proj.Plan(), t)
+			Expect(task.WorkFile(".log")).Should(Equal(
+				Fixtures("subprojects", "services", "api", hm.WorkFolder, "build.log")))
+			Expect(task.EnvVars()).Should(ContainElement("HMAKE_PROJECT_NAME=api"))
+
+			name, err := proj.QualifyName("//services/api:build")
+			Expect(err).Should(Succeed())
+			Expect(name).Should(Equal("api:build"))
+			_, err = proj.QualifyName("//services/none:build")
+			Expect(err).Should(MatchError(ContainSubstring("project not found")))
+		})
+
+		It("reports cyclic sub-projects", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("subprojects", "cyclic"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("cyclic projects")))
+		})
+
+		It("upgrades files in hypermake.v0", func() {
+			proj := LoadFixtureProject("format")
+			Expect(proj.Files[0].Format).Should(Equal(hm.Format))
+			Expect(proj.Targets["shell"].Command).Should(BeTrue())
+			Expect(proj.Targets["build"].Command).Should(BeFalse())
+			Expect(proj.Targets["build"].Ext).Should(HaveKeyWithValue("src-dir", "/go/src/example"))
+			Expect(proj.Targets["services"].Ext["compose"]).Should(HaveKeyWithValue("force-recreate", true))
+			Expect(proj.MasterFile.Settings["docker"]).Should(HaveKeyWithValue("src-dir", "/go/src/example"))
+		})
+
+		It("loads files in hypermake.v1", func() {
+			f, err := hm.LoadFile(Fixtures("format"), "HyperMake.v1", false)
+			Expect(err).Should(Succeed())
+			Expect(f.Targets["shell"].Command).Should(BeTrue())
+			Expect(f.Targets["build"].Ext).Should(HaveKeyWithValue("src-dir", "/go/src/example"))
+			Expect(hm.ValidateFile(Fixtures("format"), "HyperMake.v1", "")).Should(BeEmpty())
+		})
+
+		It("migrates files to hypermake.v1", func() {
+			content, diags, err := hm.MigrateFile(Fixtures("format"), hm.RootFile)
+			Expect(err).Should(Succeed())
+			expected, err := ioutil.ReadFile(Fixtures("format", "HyperMake.v1"))
+			Expect(err).Should(Succeed())
+			Expect(string(content)).Should(Equal(string(expected)))
+			var msgs []string
+			for _, d := range diags {
+				Expect(d.Deprecated).Should(BeTrue())
+				msgs = append(msgs, d.String())
+			}
+			Expect(msgs).Should(ConsistOf(
+				"HyperMake:11:9: target build: src-volume is deprecated, use src-dir instead",
+				"HyperMake:17:13: target services: compose.recreate: force is deprecated, use compose.force-recreate: true instead",
+				"HyperMake:20:15: target services: src-volume is deprecated, use src-dir instead",
+				"HyperMake:23:1: commands is deprecated, use targets with command: true instead",
+				"HyperMake:33:9: settings: src-volume is deprecated, use src-dir instead",
+			))
+			Expect(hm.ValidateFile(Fixtures("format"), hm.RootFile, "")).Should(HaveLen(len(diags)))
+
+			content, _, err = hm.MigrateFile(Fixtures("format"), "HyperMake.v1")
+			Expect(err).Should(Succeed())
+			Expect(content).Should(BeNil())
+		})
+
+		It("renames commands conflicting with targets in hypermake.v0", func() {
+			f, err := hm.LoadFile(Fixtures("format"), "conflict.v0", false)
+			Expect(err).Should(Succeed())
+			Expect(f.Targets["test"].Command).Should(BeFalse())
+			Expect(f.Targets["test-command"].Command).Should(BeTrue())
+			var msgs []string
+			for _, d := range hm.ValidateFile(Fixtures("format"), "conflict.v0", "") {
+				msgs = append(msgs, d.String())
+			}
+			Expect(msgs).Should(ContainElement(
+				"conflict.v0:11:5: command test conflicts with target test, renamed to test-command, run hmake migrate to update the file"))
+			content, _, err := hm.MigrateFile(Fixtures("format"), "conflict.v0")
+			Expect(err).Should(Succeed())
+			Expect(string(content)).Should(ContainSubstring("    test-command:\n        command: true\n"))
+		})
+
+		It("replaces deprecated settings from configuration and command line", func() {
+			config := &hm.Config{}
+			config.AddLayer("user", "", map[string]interface{}{
+				"settings": map[string]interface{}{
+					"docker": map[string]interface{}{
+						"compose": map[string]interface{}{"recreate": "force"},
+					},
+				},
+			})
+			proj := LoadFixtureProject("subprojects")
+			Expect(proj.ApplyConfig(config)).Should(Succeed())
+			Expect(proj.MergeSettingsFlat(map[string]interface{}{
+				"docker.src-volume": "/src",
+			})).Should(Succeed())
+			docker := map[string]interface{}{}
+			Expect(proj.GetSettingsIn("docker", &docker)).Should(Succeed())
+			Expect(docker).Should(HaveKeyWithValue("src-dir", "/src"))
+			Expect(docker).ShouldNot(HaveKey("src-volume"))
+			Expect(docker["compose"]).Should(HaveKeyWithValue("force-recreate", true))
+			var msgs []string
+			for _, d := range proj.Validate() {
+				if d.Deprecated {
+					msgs = append(msgs, d.String())
+				}
+			}
+			Expect(msgs).Should(ConsistOf(
+				"user: docker.compose.recreate: force is deprecated, use docker.compose.force-recreate: true instead",
+				"command line: docker.src-volume is deprecated, use docker.src-dir instead",
+			))
+		})
+
+		It("parses arguments of commands", func() {
+			proj := LoadFixtureProject("args")
+			t := proj.Targets["deploy"]
+			Expect(t.Signature()).Should(Equal("<env> [--replicas=VALUE] [--dry-run] [hosts...]"))
+			Expect(proj.Targets["build"].Signature()).Should(BeEmpty())
+
+			parse := func(args ...string) (map[string]string, error) {
+				t.Args = args
+				return t.ParseArgs()
+			}
+			Expect(parse("prod")).Should(Equal(map[string]string{
+				"env": "prod", "replicas": "1", "dry-run": "false", "hosts": "",
+			}))
+			Expect(parse("staging", "--replicas=3", "--dry-run=yes", "h1", "h2")).Should(Equal(map[string]string{
+				"env": "staging", "replicas": "3", "dry-run": "true", "hosts": "h1 h2",
+			}))
+			Expect(parse("--dry-run", "--env=prod", "h1", "--hosts=h2")).Should(Equal(map[string]string{
+				"env": "prod", "replicas": "1", "dry-run": "true", "hosts": "h2 h1",
+			}))
+			Expect(parse("--env=prod", "--no-dry-run", "--", "--h1")).Should(Equal(map[string]string{
+				"env": "prod", "replicas": "1", "dry-run": "false", "hosts": "--h1",
+			}))
+			_, err := parse()
+			Expect(err).Should(MatchError(ContainSubstring("argument env is required")))
+			_, err = parse("test")
+			Expect(err).Should(MatchError(ContainSubstring("argument env expects one of staging, prod")))
+			_, err = parse("prod", "--replicas=two")
+			Expect(err).Should(MatchError(ContainSubstring("argument replicas expects integer")))
+			_, err = parse("--region=us", "prod")
+			Expect(err).Should(MatchError(ContainSubstring("unknown argument --region")))
+
+			t.Args = []string{"prod", "--help"}
+			Expect(t.WantsHelp()).Should(BeTrue())
+		})
+
+		It("passes arguments to commands", func() {
+			proj := LoadFixtureProject("args")
+			t := proj.Targets["deploy"]
+			t.Args = []string{"prod", "--replicas=2", "h1", "h2"}
+			Expect(t.ApplyArgs()).Should(Succeed())
+			Expect(t.Ext["cmds"]).Should(Equal([]interface{}{"echo deploy prod x2 h1 h2"}))
+			task := hm.NewTask(proj.Plan(), t)
+			Expect(task.EnvVars()).Should(ContainElement("HMAKE_ARG_ENV=prod"))
+			Expect(task.EnvVars()).Should(ContainElement("HMAKE_ARG_DRY_RUN=false"))
+			Expect(task.EnvVars()).Should(ContainElement("HMAKE_ARG_HOSTS=h1 h2"))
+		})
+
+		It("reports invalid declarations of arguments", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("args", "bad"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("args only allowed in commands")))
+			Expect(err).Should(MatchError(ContainSubstring("only the last argument can be variadic")))
+			Expect(err).Should(MatchError(ContainSubstring("default: argument count expects integer")))
+		})
+
+		Context("Config", func() {
+			var sysConfig, userConfig string
+
+			BeforeEach(func() {
+				sysConfig, userConfig = hm.SystemConfigFile, hm.UserConfigFile
+				hm.SystemConfigFile = Fixtures("config", "system.yaml")
+				hm.UserConfigFile = Fixtures("config", "user.yaml")
+			})
+
+			AfterEach(func() {
+				hm.SystemConfigFile, hm.UserConfigFile = sysConfig, userConfig
+			})
+
+			It("layers user-level configuration over system-level", func() {
+				config, err := hm.LoadConfig()
+				Expect(err).Should(Succeed())
+				Expect(config.Options()).Should(Equal(map[string]interface{}{
+					"parallel": 8, "emoji": true,
+				}))
+				entry := config.Get("settings.docker.image")
+				Expect(entry.Value).Should(Equal("builder:user"))
+				Expect(entry.Origin).Should(Equal("user:" + hm.UserConfigFile))
+				Expect(config.Get("settings.docker.src-dir").Layer.Name).Should(Equal("system"))
+				Expect(config.Get("settings.docker.none")).Should(BeNil())
+
+				var keys []string
+				for _, entry := range config.List() {
+					keys = append(keys, entry.Key+"@"+entry.Layer.Name)
+				}
+				Expect(keys).Should(Equal([]string{
+					"options.emoji@system", "options.parallel@user",
+					"settings.docker.image@user", "settings.docker.src-dir@system",
+					"settings.greeting@system",
+				}))
+
+				proj := LoadFixtureProject("subprojects")
+				Expect(proj.ApplyConfig(config)).Should(Succeed())
+				set := map[string]interface{}{}
+				Expect(proj.GetSettings(&set)).Should(Succeed())
+				Expect(set).Should(HaveKeyWithValue("greeting", "hello"))
+				Expect(set["docker"]).Should(HaveKeyWithValue("image", "builder:user"))
+			})
+
+			It("leaves out broken configuration files", func() {
+				hm.UserConfigFile = Fixtures("config", "broken.yaml")
+				config, err := hm.LoadConfig()
+				Expect(err).Should(MatchError(ContainSubstring("broken.yaml: unknown section setings")))
+				Expect(config.Layers).Should(HaveLen(1))
+				Expect(config.Get("settings.docker.image").Layer.Name).Should(Equal("system"))
+			})
+
+			It("sets values in configuration file", func() {
+				tmpDir, err := ioutil.TempDir("", "hmake-config")
+				Expect(err).Should(Succeed())
+				defer os.RemoveAll(tmpDir)
+				data, err := ioutil.ReadFile(hm.UserConfigFile)
+				Expect(err).Should(Succeed())
+				hm.UserConfigFile = filepath.Join(tmpDir, "hmake", hm.ConfigFileName)
+				Expect(os.MkdirAll(filepath.Dir(hm.UserConfigFile), 0755)).Should(Succeed())
+				Expect(ioutil.WriteFile(hm.UserConfigFile, data, 0644)).Should(Succeed())
+
+				Expect(hm.SetConfigValue(hm.UserConfigFile, "options.parallel", "4")).Should(Succeed())
+				Expect(hm.SetConfigValue(hm.UserConfigFile, "settings.docker.pull", "true")).Should(Succeed())
+				Expect(hm.SetConfigValue(hm.UserConfigFile, "docker.pull", "true")).ShouldNot(Succeed())
+				data, err = ioutil.ReadFile(hm.UserConfigFile)
+				Expect(err).Should(Succeed())
+				Expect(string(data)).Should(ContainSubstring("# personal preferences"))
+
+				config, err := hm.LoadConfig()
+				Expect(err).Should(Succeed())
+				Expect(config.Get("options.parallel").Value).Should(Equal(4))
+				Expect(config.Get("settings.docker.pull").Value).Should(Equal(true))
+				Expect(config.Get("settings.docker.image").Value).Should(Equal("builder:user"))
+
+				newFile := filepath.Join(tmpDir, "new", hm.ConfigFileName)
+				Expect(hm.SetConfigValue(newFile, "settings.exec-driver", "shell")).Should(Succeed())
+				Expect(newFile).Should(BeARegularFile())
+			})
+		})
+
 		It("expand targets with duplicated name", func() {
 			proj := &hm.Project{BaseDir: Fixtures("target-expand", "dup-target")}
 			_, err := proj.Load("HyperMake")
@@ -239,6 +676,15 @@ var _ = Describe("HyperMake", func() {
 			Expect(proj.TargetNames()).To(Equal([]string{"t0", "t1", "t2", "t3"}))
 		})
 
+		It("collects targets without dependencies", func() {
+			proj := &hm.Project{BaseDir: Samples()}
+			Expect(proj.Load("dep-undefined.hmake")).ShouldNot(BeNil())
+			Expect(proj.Resolve()).Should(Succeed())
+			Expect(proj.CollectTargets()).Should(Succeed())
+			Expect(proj.TargetNames()).To(Equal([]string{"t0"}))
+			Expect(proj.Targets["t0"].Depends).To(BeEmpty())
+		})
+
 		It("matches target names", func() {
 			proj := LoadFixtureProject("project1")
 			names, err := proj.TargetNamesMatch("t?")
@@ -258,6 +704,209 @@ var _ = Describe("HyperMake", func() {
 			Expect(err).To(HaveOccurred())
 		})
 
+		It("selects targets by tags", func() {
+			proj := LoadFixtureProject("tags")
+			Expect(proj.TagNames()).To(Equal([]string{
+				"go", "lint", "slow-darwin", "slow-linux", "test",
+			}))
+			Expect(proj.Targets["lint-go"].Tags).To(Equal([]string{"go", "lint"}))
+			Expect(proj.Targets["test-go-linux"].Tags).To(Equal([]string{"go", "test", "slow-linux"}))
+			names, err := proj.TargetNamesMatch("@lint")
+			Expect(err).Should(Succeed())
+			Expect(names).To(Equal([]string{"lint-go", "lint-sh", "tools:lint-tools"}))
+			names, err = proj.TargetNamesMatch("@go+!@test")
+			Expect(err).Should(Succeed())
+			Expect(names).To(Equal([]string{"build", "lint-go"}))
+			names, err = proj.TargetNamesMatch("tools:!@lint")
+			Expect(err).Should(Succeed())
+			Expect(names).To(Equal([]string{"tools:lint"}))
+			_, err = proj.TargetNamesMatch("@go+lint")
+			Expect(err).To(HaveOccurred())
+			_, err = proj.TargetNamesMatch("@")
+			Expect(err).To(HaveOccurred())
+			_, err = proj.TargetNamesMatch("@go+!@tests")
+			Expect(err).Should(MatchError("tag tests is not defined on any target: @go+!@tests"))
+			_, err = proj.TargetNamesMatch("tools:@go")
+			Expect(err).Should(MatchError(ContainSubstring("tag go is not defined")))
+
+			Expect(proj.Targets["lint"].Depends).To(HaveLen(3))
+			Expect(proj.Targets["tools:lint"].Depends).To(HaveLen(1))
+			Expect(proj.Targets["tools:lint"].Depends).To(HaveKey("tools:lint-tools"))
+			Expect(proj.Targets["fast-go"].Depends).To(HaveLen(3))
+			Expect(proj.Targets["fast-go"].Depends).NotTo(HaveKey("test-go-darwin"))
+
+			requires, err := proj.SelectTargets([]string{"@test"})
+			Expect(err).Should(Succeed())
+			Expect(requires).To(ConsistOf("test-go-darwin", "test-go-linux"))
+		})
+
+		It("never selects the target itself or commands with negated tags", func() {
+			proj := LoadFixtureProject("tags", "negate")
+			Expect(proj.Targets["fast"].Depends).To(HaveLen(2))
+			Expect(proj.Targets["fast"].Depends).To(HaveKey("build"))
+			Expect(proj.Targets["fast"].Depends).To(HaveKey("lint"))
+			requires, err := proj.SelectTargets([]string{"!@slow"})
+			Expect(err).Should(Succeed())
+			Expect(requires).To(ConsistOf("build", "lint", "fast"))
+			requires, err = proj.SelectTargets([]string{"@tools"})
+			Expect(err).Should(Succeed())
+			Expect(requires).To(Equal([]string{"shell"}))
+		})
+
+		It("selects targets affected by changes", func() {
+			proj := LoadFixtureProject("changes")
+			Expect(proj.SelectChanged([]string{"all"}, []string{"src/main.go"})).
+				To(Equal([]string{"build", "test"}))
+			Expect(proj.SelectChanged([]string{"all"}, []string{"src/main_test.go"})).
+				To(Equal([]string{"test"}))
+			Expect(proj.SelectChanged([]string{"all"}, []string{"lib/foo.c"})).
+				To(Equal([]string{"build", "lib:build", "test"}))
+			Expect(proj.SelectChanged([]string{"build"}, []string{"src/gen/x.txt"})).
+				To(Equal([]string{"build", "gen"}))
+			Expect(proj.SelectChanged([]string{"all"}, []string{"docs/a/b.md"})).
+				To(Equal([]string{"docs"}))
+			Expect(proj.SelectChanged([]string{"test"}, []string{"docs/a/b.md", "README.md"})).
+				To(BeEmpty())
+			Expect(proj.SelectChanged([]string{"all"}, []string{"HyperMake"})).
+				To(Equal([]string{"build", "docs", "gen", "test"}))
+		})
+
+		It("finds files changed since git revision", func() {
+			tmpDir, err := ioutil.TempDir("", "hmake-changes")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(tmpDir)
+			git := func(args ...string) {
+				cmd := exec.Command("git", append([]string{
+					"-c", "user.name=hmake", "-c", "user.email=hmake@localhost",
+				}, args...)...)
+				cmd.Dir = tmpDir
+				out, err := cmd.CombinedOutput()
+				Expect(err).Should(Succeed(), string(out))
+			}
+			write := func(name, content string) {
+				fn := filepath.Join(tmpDir, name)
+				Expect(os.MkdirAll(filepath.Dir(fn), 0755)).Should(Succeed())
+				Expect(ioutil.WriteFile(fn, []byte(content), 0644)).Should(Succeed())
+			}
+			write("HyperMake", "---\nformat: hypermake.v1\nname: changes\n")
+			write("src/a.go", "a")
+			write("src/b.go", "b")
+			git("init", "-q")
+			git("add", "-A")
+			git("commit", "-q", "-m", "initial")
+			write("src/a.go", "a1")
+			git("commit", "-q", "-a", "-m", "change")
+			write("src/b.go", "b1")
+			write("docs/new.md", "new")
+
+			proj := &hm.Project{BaseDir: tmpDir}
+			paths, err := proj.GitChangedFiles("HEAD~")
+			Expect(err).Should(Succeed())
+			Expect(paths).To(Equal([]string{"docs/new.md", "src/a.go", "src/b.go"}))
+			_, err = proj.GitChangedFiles("no-such-rev")
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("scaffolds projects by detected type", func() {
+			tmpDir, err := ioutil.TempDir("", "hmake-init")
+			Expect(err).Should(Succeed())
+			defer os.RemoveAll(tmpDir)
+			baseDir := filepath.Join(tmpDir, "my app")
+			Expect(os.MkdirAll(baseDir, 0755)).Should(Succeed())
+			Expect(hm.DetectProjectType(baseDir)).To(BeEmpty())
+			Expect(ioutil.WriteFile(filepath.Join(baseDir, "go.mod"), []byte("module app\n"), 0644)).Should(Succeed())
+			Expect(hm.DetectProjectType(baseDir)).To(Equal("go"))
+
+			write := func(files map[string][]byte) {
+				for name, content := range files {
+					fn := filepath.Join(baseDir, name)
+					Expect(os.MkdirAll(filepath.Dir(fn), 0755)).Should(Succeed())
+					Expect(ioutil.WriteFile(fn, content, 0644)).Should(Succeed())
+				}
+			}
+			files, err := hm.Scaffold(baseDir, "go", false, "")
+			Expect(err).Should(Succeed())
+			Expect(files).To(HaveLen(2))
+			Expect(string(files[filepath.Join("hack", "builder", "Dockerfile")])).To(HavePrefix("FROM golang:"))
+			write(files)
+			proj, err := hm.LoadProjectFrom(baseDir, hm.RootFile)
+			Expect(err).Should(Succeed())
+			Expect(proj.Name).To(Equal("my-app"))
+			Expect(proj.Validate()).Should(BeEmpty())
+			Expect(proj.TargetNames()).To(Equal([]string{"build", "builder", "lint", "test", "vendor"}))
+			Expect(proj.Targets["build"].After).To(Equal([]string{"vendor"}))
+			formatted, err := hm.FormatFile(baseDir, hm.RootFile)
+			Expect(err).Should(Succeed())
+			Expect(string(formatted)).To(Equal(string(files[hm.RootFile])))
+			var docker map[string]interface{}
+			Expect(proj.GetSettingsIn("docker", &docker)).Should(Succeed())
+			Expect(docker["image"]).To(Equal("my-app-builder:latest"))
+
+			files, err = hm.Scaffold(baseDir, "make", true, "")
+			Expect(err).Should(Succeed())
+			write(files)
+			proj, err = hm.LoadProjectFrom(baseDir, hm.RootFile)
+			Expect(err).Should(Succeed())
+			Expect(proj.TargetNames()).To(Equal([]string{"build", "test", "toolchain"}))
+			Expect(proj.Targets["test"].After).To(ContainElement("build"))
+
+			_, err = hm.Scaffold(baseDir, "cobol", false, "")
+			Expect(err).Should(MatchError(ContainSubstring("unknown project type")))
+		})
+
+		It("scaffolds projects with local templates", func() {
+			files, err := hm.Scaffold("/src/app", "go", false, Fixtures("templates"))
+			Expect(err).Should(Succeed())
+			Expect(files).To(HaveLen(2))
+			Expect(string(files[filepath.Join("hack", "ci.sh")])).To(ContainSubstring("hmake -R app"))
+			Expect(string(files[hm.RootFile])).To(ContainSubstring("image: app-builder:latest"))
+			Expect(string(files[hm.RootFile])).To(ContainSubstring("- go build ./..."))
+
+			// falls back to built-in templates if not found locally
+			files, err = hm.Scaffold("/src/app", "node", false, Fixtures("templates"))
+			Expect(err).Should(Succeed())
+			Expect(string(files[hm.RootFile])).To(ContainSubstring("- npm ci"))
+
+			// custom types are supported by local templates
+			files, err = hm.Scaffold("/src/app", "custom", true, Fixtures("templates"))
+			Expect(err).Should(Succeed())
+			Expect(string(files[hm.RootFile])).To(HavePrefix("#hmake-wrapper app-builder:latest\n"))
+			_, err = hm.Scaffold("/src/app", "custom", false, Fixtures("templates"))
+			Expect(err).Should(MatchError(ContainSubstring("unknown project type")))
+		})
+
+		It("formats project files", func() {
+			formatted, err := ioutil.ReadFile(Fixtures("fmt", "formatted.hmake"))
+			Expect(err).Should(Succeed())
+			content, err := hm.FormatFile(Fixtures("fmt"), "HyperMake")
+			Expect(err).Should(Succeed())
+			Expect(string(content)).To(Equal(string(formatted)))
+			content, err = hm.FormatFile(Fixtures("fmt"), "formatted.hmake")
+			Expect(err).Should(Succeed())
+			Expect(string(content)).To(Equal(string(formatted)))
+			content, err = hm.FormatFile(Fixtures("fmt"), "lint.hmake")
+			Expect(err).Should(Succeed())
+			Expect(hm.UnifiedDiff("lint.hmake", content, content)).To(BeEmpty())
+		})
+
+		It("shows differences in unified format", func() {
+			orig := []byte("a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n")
+			updated := []byte("a\nB\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\nm")
+			Expect(hm.UnifiedDiff("x", orig, updated)).To(Equal(
+				"--- a/x\n+++ b/x\n" +
+					"@@ -1,5 +1,5 @@\n a\n-b\n+B\n c\n d\n e\n" +
+					"@@ -10,3 +10,4 @@\n j\n k\n l\n+m\n\\ No newline at end of file\n"))
+			Expect(hm.UnifiedDiff("x", nil, []byte("a\n"))).To(Equal("--- a/x\n+++ b/x\n@@ -0,0 +1 @@\n+a\n"))
+		})
+
+		It("reports invalid tags", func() {
+			proj := &hm.Project{BaseDir: Samples()}
+			Expect(proj.Load("bad-tags.hmake")).ShouldNot(BeNil())
+			Expect(proj.Resolve()).Should(Succeed())
+			Expect(proj.Finalize()).
+				Should(MatchError(ContainSubstring("invalid tag")))
+		})
+
 		It("includes", func() {
 			proj := LoadProject(Samples(), "includes.hmake")
 			Expect(proj.Files).Should(HaveLen(6))
@@ -292,6 +941,13 @@ var _ = Describe("HyperMake", func() {
 			Expect(set.Dict.Key1).To(Equal("inc-a"))
 		})
 
+		It("lists flat keys of settings", func() {
+			proj := LoadProject(Samples(), "includes.hmake")
+			Expect(proj.MasterFile.Settings.FlatKeys()).To(Equal([]string{
+				"dict.key", "dict.key1", "toplevel", "toplevel1",
+			}))
+		})
+
 		It("merges settings from flat map", func() {
 			proj := LoadFixtureProject("project0")
 
@@ -380,6 +1036,37 @@ var _ = Describe("HyperMake", func() {
 			Expect(t.Ext).To(HaveKeyWithValue("script", "#!/bin/sh\necho Hello"))
 		})
 
+		It("wrapper-mode with multiple targets", func() {
+			proj := LoadFixtureProject("wrapper", "multi-target")
+			Expect(proj.WrapperTarget()).Should(BeNil())
+			Expect(proj.TargetNames()).Should(Equal([]string{"build", "deps", "lint", "report", "toolchain"}))
+			var settings map[string]interface{}
+			Expect(proj.GetSettings(&settings)).Should(Succeed())
+			Expect(settings).To(HaveKeyWithValue("default-targets", []string{"deps", "build", "lint", "report"}))
+			Expect(settings).To(HaveKeyWithValue("exec-target", "deps"))
+
+			t := proj.Targets["build"]
+			Expect(t.Always).Should(BeFalse())
+			Expect(t.Watches).Should(Equal([]string{"**/*.go"}))
+			Expect(t.Depends).Should(HaveKey("deps"))
+			Expect(t.Depends).Should(HaveKey("toolchain"))
+			Expect(t.Ext).To(HaveKeyWithValue("image", "golang:1.20"))
+			Expect(t.Ext).To(HaveKeyWithValue("script",
+				"#!/bin/sh\nset -e\nexport CGO_ENABLED=0\n\ngo build ./..."))
+			Expect(proj.Targets["deps"].Watches).Should(Equal([]string{"go.mod", "go.sum"}))
+			Expect(proj.Targets["lint"].Ext).To(HaveKeyWithValue("image", "golangci/golangci-lint"))
+			t = proj.Targets["report"]
+			Expect(t.Depends).Should(HaveKey("build"))
+			Expect(t.Depends).Should(HaveKey("lint"))
+			Expect(t.Ext).To(HaveKeyWithValue("script", "#!/usr/bin/env python\nprint(\"done\")"))
+			Expect(proj.Validate()).Should(BeEmpty())
+		})
+
+		It("wrapper-mode with invalid target section", func() {
+			_, err := hm.LoadProjectFrom(Fixtures("wrapper", "bad-target"), hm.RootFile)
+			Expect(err).Should(MatchError(ContainSubstring("unknown key needs")))
+		})
+
 		It("wrapper-mode with explicit script interpreter", func() {
 			proj := LoadFixtureProject("wrapper", "explicit-interpreter")
 			Expect(proj.Targets).To(HaveKey("build"))
@@ -747,6 +1434,182 @@ var _ = Describe("HyperMake", func() {
 			Expect(taskResults["abort0"]).To(Equal(hm.Failure))
 		})
 
+		It("fails if the project is locked", func() {
+			proj := LoadFixtureProject("serve")
+			os.MkdirAll(proj.WorkPath(), 0755)
+			defer os.RemoveAll(proj.WorkPath())
+			lock, err := hm.TryLock(proj.LockFile())
+			Expect(err).Should(Succeed())
+			plan := proj.Plan()
+			Expect(plan.Require("prepare")).Should(Succeed())
+			err = plan.Execute(nil)
+			Expect(err).Should(MatchError(ContainSubstring("another hmake is running in the project")))
+			Expect(err).Should(MatchError(ContainSubstring("PID " + strconv.Itoa(os.Getpid()))))
+			Expect(lock.Unlock()).Should(Succeed())
+			Expect(hm.ReadLockHolder(proj.LockFile())).To(BeNil())
+
+			plan = proj.Plan()
+			Expect(plan.Require("prepare")).Should(Succeed())
+			Expect(plan.Execute(nil)).Should(Succeed())
+		})
+
+		It("waits for targets locked by another process", func() {
+			proj := LoadFixtureProject("serve")
+			os.MkdirAll(proj.WorkPath(), 0755)
+			defer os.RemoveAll(proj.WorkPath())
+			// target mode doesn't lock the project
+			projLock, err := hm.TryLock(proj.LockFile())
+			Expect(err).Should(Succeed())
+			defer projLock.Unlock()
+			lock, err := hm.TryLock(filepath.Join(proj.WorkPath(), "prepare.target.lock"))
+			Expect(err).Should(Succeed())
+
+			plan := proj.Plan()
+			plan.LockMode = hm.LockTarget
+			Expect(plan.Require("build")).Should(Succeed())
+			var events []string
+			plan.OnEvent(func(event interface{}) {
+				switch evt := event.(type) {
+				case *hm.EvtTaskLockWait:
+					Expect(evt.Holder).NotTo(BeNil())
+					Expect(evt.Holder.PID).To(Equal(os.Getpid()))
+					events = append(events, "wait "+evt.Task.Name())
+					go func() {
+						time.Sleep(hm.LockRetryInterval)
+						lock.Unlock()
+					}()
+				case *hm.EvtTaskFinish:
+					events = append(events, "finish "+evt.Task.Name())
+				}
+			})
+			Expect(plan.Execute(nil)).Should(Succeed())
+			Expect(events).To(Equal([]string{"wait prepare", "finish prepare", "finish build"}))
+		})
+
+		It("aborts a single task", func() {
+			proj := LoadFixtureProject("serve")
+			os.RemoveAll(proj.WorkPath())
+			defer os.RemoveAll(proj.WorkPath())
+			plan := proj.Plan()
+			plan.MaxConcurrency = -1
+			Expect(plan.Require("slow", "build")).Should(Succeed())
+			results := make(map[string]hm.TaskResult)
+			plan.OnEvent(func(event interface{}) {
+				switch evt := event.(type) {
+				case *hm.EvtTaskStart:
+					if evt.Task.Name() == "slow" {
+						plan.AbortTask("slow")
+					}
+				case *hm.EvtTaskFinish:
+					results[evt.Task.Name()] = evt.Task.Result
+				}
+			})
+			Expect(plan.Execute(nil)).ShouldNot(Succeed())
+			Expect(results["slow"]).To(Equal(hm.Failure))
+			Expect(results["build"]).To(Equal(hm.Success))
+
+			history := proj.History()
+			Expect(history).To(HaveKey("prepare"))
+			Expect(history).To(HaveKey("build"))
+			Expect(history).NotTo(HaveKey("slow"))
+		})
+
+		buildClean := func() *hm.Project {
+			proj := LoadFixtureProject("clean")
+			plan := proj.Plan()
+			Expect(plan.Require("use", "other")).Should(Succeed())
+			Expect(plan.Execute(nil)).Should(Succeed())
+			return proj
+		}
+
+		removeClean := func() {
+			for _, fn := range []string{hm.WorkFolder, "out", "use.bin", "other.txt", "..other"} {
+				os.RemoveAll(Fixtures("clean", fn))
+			}
+		}
+
+		cleanItems := func(items []*hm.CleanItem) (names []string) {
+			for _, item := range items {
+				names = append(names, item.Task.Name()+" "+item.String())
+			}
+			return
+		}
+
+		It("never cleans the project itself or anything outside", func() {
+			defer removeClean()
+			proj := buildClean()
+			Expect(ioutil.WriteFile(Fixtures("clean", "..other"), []byte("other"), 0644)).Should(Succeed())
+			proj.Targets["other"].Artifacts = []string{".", "..", "../clean", "..other"}
+			items := proj.Plan().CleanItems([]string{"other"}, false)
+			Expect(cleanItems(items)).To(Equal([]string{
+				"other file ..other",
+				"other file .hmake/other.success",
+				"other file .hmake/other.script",
+				"other file .hmake/other.log",
+			}))
+		})
+
+		It("cleans artifacts and state of targets", func() {
+			defer removeClean()
+			proj := buildClean()
+			plan := proj.Plan()
+			plan.DryRun = true
+			items := plan.CleanItems([]string{"gen"}, false)
+			Expect(cleanItems(items)).To(Equal([]string{
+				"gen file out/a.txt",
+				"gen file out/b.txt",
+				"gen file .hmake/gen.success",
+				"gen file .hmake/gen.script",
+				"gen file .hmake/gen.log",
+			}))
+			var reported []string
+			Expect(plan.Clean(items, func(item *hm.CleanItem, err error) {
+				Expect(err).Should(Succeed())
+				reported = append(reported, item.Name)
+			})).Should(Succeed())
+			Expect(reported).To(HaveLen(5))
+			Expect(Fixtures("clean", "out", "a.txt")).To(BeAnExistingFile())
+
+			plan = proj.Plan()
+			Expect(plan.Clean(plan.CleanItems([]string{"gen"}, false), func(*hm.CleanItem, error) {})).Should(Succeed())
+			Expect(Fixtures("clean", "out", "a.txt")).NotTo(BeAnExistingFile())
+			Expect(Fixtures("clean", hm.WorkFolder, "gen.success")).NotTo(BeAnExistingFile())
+			Expect(Fixtures("clean", hm.WorkFolder, "use.success")).To(BeAnExistingFile())
+			Expect(Fixtures("clean", "use.bin")).To(BeAnExistingFile())
+
+			plan = proj.Plan()
+			Expect(plan.Clean(plan.CleanItems(nil, false), func(*hm.CleanItem, error) {})).Should(Succeed())
+			Expect(Fixtures("clean", "use.bin")).NotTo(BeAnExistingFile())
+			Expect(Fixtures("clean", "other.txt")).NotTo(BeAnExistingFile())
+			Expect(proj.Plan().CleanItems(nil, false)).To(BeEmpty())
+		})
+
+		It("cleans dependents of targets", func() {
+			defer removeClean()
+			proj := buildClean()
+			plan := proj.Plan()
+			var targets []string
+			for _, item := range plan.CleanItems([]string{"gen"}, true) {
+				if len(targets) == 0 || targets[len(targets)-1] != item.Task.Name() {
+					targets = append(targets, item.Task.Name())
+				}
+			}
+			Expect(targets).To(Equal([]string{"gen", "use"}))
+		})
+
+		It("skips targets being executed when cleaning", func() {
+			defer removeClean()
+			proj := buildClean()
+			lock, err := hm.TryLock(filepath.Join(proj.WorkPath(), "other.target.lock"))
+			Expect(err).Should(Succeed())
+			defer lock.Unlock()
+			plan := proj.Plan()
+			err = plan.Clean(plan.CleanItems(nil, false), func(*hm.CleanItem, error) {})
+			Expect(err).Should(MatchError(ContainSubstring("other: ")))
+			Expect(Fixtures("clean", "other.txt")).To(BeAnExistingFile())
+			Expect(Fixtures("clean", "use.bin")).NotTo(BeAnExistingFile())
+		})
+
 		It("skips transit targets when all dependencies are skipped", func() {
 			proj := LoadFixtureProject("skip-transit-targets")
 			plan := proj.Plan()
@@ -783,6 +1646,75 @@ var _ = Describe("HyperMake", func() {
 			Expect(taskResults["all"]).To(Equal(hm.Success))
 		})
 
+		It("masks secrets", func() {
+			os.Setenv("HMAKE_TEST_SECRET_TOKEN", "s3cr3t-value")
+			defer os.Unsetenv("HMAKE_TEST_SECRET_TOKEN")
+			proj := LoadFixtureProject("secrets")
+			plan := proj.Plan()
+			plan.DebugLog = true
+			plan.Require("show")
+			var output string
+			plan.OnEvent(func(event interface{}) {
+				if evt, ok := event.(*hm.EvtTaskOutput); ok {
+					output += string(evt.Output)
+				}
+			})
+			Expect(plan.Execute(nil)).Should(Succeed())
+			Expect(output).Should(ContainSubstring("token=" + hm.SecretMask))
+			Expect(output).ShouldNot(ContainSubstring("s3cr3t-value"))
+			content, err := ioutil.ReadFile(filepath.Join(plan.WorkPath, "show.log"))
+			Expect(err).Should(Succeed())
+			Expect(string(content)).Should(ContainSubstring("token=" + hm.SecretMask))
+			content, err = ioutil.ReadFile(proj.DebugLogFile())
+			Expect(err).Should(Succeed())
+			Expect(string(content)).ShouldNot(ContainSubstring("s3cr3t-value"))
+		})
+
+		It("masks secrets split across writes", func() {
+			os.Setenv("HMAKE_TEST_SECRET_TOKEN", "s3cr3t-value")
+			defer os.Unsetenv("HMAKE_TEST_SECRET_TOKEN")
+			proj := LoadFixtureProject("secrets")
+			plan := proj.Plan()
+			plan.Require("show")
+			Expect(plan.Execute(nil)).Should(Succeed())
+
+			var buf bytes.Buffer
+			w := plan.MaskWriter(&buf)
+			w.Write([]byte("token=s3cr"))
+			w.Write([]byte("3t-value s3"))
+			Expect(buf.String()).To(Equal("token=" + hm.SecretMask + " "))
+			Expect(w.Close()).Should(Succeed())
+			Expect(buf.String()).To(Equal("token=" + hm.SecretMask + " s3"))
+
+			var output string
+			plan.OnEvent(func(event interface{}) {
+				if evt, ok := event.(*hm.EvtTaskOutput); ok {
+					output += string(evt.Output)
+				}
+			})
+			task := plan.Tasks["show"]
+			task.Write([]byte("token=s3cr3"))
+			task.Write([]byte("t-value\n"))
+			Expect(output).To(Equal("token=" + hm.SecretMask + "\n"))
+		})
+
+		It("fails with undefined secrets", func() {
+			plan := LoadFixtureProject("secrets").Plan()
+			plan.Require("undefined")
+			Expect(plan.Execute(nil)).Should(MatchError(ContainSubstring("secret UNDEFINED not defined")))
+		})
+
+		It("executes targets in sub-projects", func() {
+			plan := LoadFixtureProject("subprojects").Plan()
+			Expect(plan.Require("all")).Should(Succeed())
+			Expect(plan.Execute(nil)).Should(Succeed())
+			content, err := ioutil.ReadFile(Fixtures("subprojects", "services", "api", "prepared"))
+			Expect(err).Should(Succeed())
+			Expect(strings.TrimSpace(string(content))).Should(Equal("api"))
+			Expect(Fixtures("subprojects", "services", "api", hm.WorkFolder, "build.success")).Should(BeAnExistingFile())
+			Expect(Fixtures("subprojects", "libs", "common", hm.WorkFolder, "build.log")).Should(BeAnExistingFile())
+		})
+
 		It("always build target with property always set to true", func() {
 			proj := LoadFixtureProject("always-target")
 			plan := proj.Plan()
@@ -822,4 +1754,159 @@ var _ = Describe("HyperMake", func() {
 			Expect(taskResults["all"]).To(Equal(hm.Skipped))
 		})
 	})
+
+	Describe("Server", func() {
+		var (
+			projDir string
+			client  *server.Client
+			ln      net.Listener
+		)
+
+		BeforeEach(func() {
+			var err error
+			projDir, err = ioutil.TempDir("", "hmake-serve")
+			Expect(err).Should(Succeed())
+			content, err := ioutil.ReadFile(Fixtures("serve", hm.RootFile))
+			Expect(err).Should(Succeed())
+			Expect(ioutil.WriteFile(filepath.Join(projDir, hm.RootFile), content, 0644)).Should(Succeed())
+			srv := server.NewServer(func() (*hm.Project, error) {
+				return hm.LoadProjectFrom(projDir, hm.RootFile)
+			})
+			socket := filepath.Join(projDir, hm.SocketFileName)
+			ln, err = net.Listen("unix", socket)
+			Expect(err).Should(Succeed())
+			go http.Serve(ln, srv)
+			client, err = server.Dial(socket)
+			Expect(err).Should(Succeed())
+		})
+
+		AfterEach(func() {
+			ln.Close()
+			os.RemoveAll(projDir)
+		})
+
+		It("lists targets and reloads the changed project", func() {
+			targets, err := client.Targets()
+			Expect(err).Should(Succeed())
+			Expect(targets).To(HaveLen(3))
+			Expect(targets[0].Name).To(Equal("build"))
+			Expect(targets[0].Depends).To(Equal([]string{"prepare"}))
+
+			g, err := client.Graph()
+			Expect(err).Should(Succeed())
+			Expect(g.Nodes).To(HaveLen(3))
+			Expect(g.Edges).To(HaveLen(1))
+			Expect(*g.Edges[0]).To(Equal(server.Edge{From: "build", To: "prepare"}))
+
+			fn := filepath.Join(projDir, hm.RootFile)
+			content, err := ioutil.ReadFile(fn)
+			Expect(err).Should(Succeed())
+			content = []byte(strings.Replace(string(content), "settings:",
+				"    test:\n        after: [build]\n\nsettings:", 1))
+			Expect(ioutil.WriteFile(fn, content, 0644)).Should(Succeed())
+			later := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(fn, later, later)).Should(Succeed())
+			targets, err = client.Targets()
+			Expect(err).Should(Succeed())
+			Expect(targets).To(HaveLen(4))
+			Expect(targets[3].Name).To(Equal("test"))
+
+			Expect(ioutil.WriteFile(fn, []byte("invalid: ["), 0644)).Should(Succeed())
+			Expect(os.Chtimes(fn, later.Add(time.Minute), later.Add(time.Minute))).Should(Succeed())
+			_, err = client.Targets()
+			Expect(err).ShouldNot(Succeed())
+			info, err := client.Project()
+			Expect(err).Should(Succeed())
+			Expect(info.Error).NotTo(BeEmpty())
+		})
+
+		It("runs targets and streams events", func() {
+			run, err := client.Start(&server.RunRequest{})
+			Expect(err).Should(Succeed())
+			Expect(run.Targets).To(Equal([]string{"build"}))
+			var events []string
+			var output string
+			Expect(client.Events(run.ID, func(e *server.Event) {
+				switch e.Event {
+				case server.EventStart, server.EventFinish:
+					events = append(events, e.Event+" "+e.Target)
+				case server.EventOutput:
+					output += string(e.Output)
+				case server.EventDone:
+					Expect(e.Error).To(BeEmpty())
+				}
+			})).Should(Succeed())
+			Expect(events).To(Equal([]string{"start prepare", "finish prepare", "start build", "finish build"}))
+			Expect(output).To(Equal("preparing\nbuilding\n"))
+
+			run, err = client.Run(run.ID)
+			Expect(err).Should(Succeed())
+			Expect(run.State).To(Equal(server.RunSucceeded))
+			Expect(run.Summary).To(HaveLen(2))
+			sum, err := client.Summary()
+			Expect(err).Should(Succeed())
+			Expect(sum.ByTarget("build").Result).To(Equal(hm.Success))
+			log, err := client.Log("prepare")
+			Expect(err).Should(Succeed())
+			Expect(string(log)).To(ContainSubstring("preparing"))
+
+			_, err = client.Start(&server.RunRequest{Args: []string{"unknown"}})
+			Expect(err).Should(MatchError(ContainSubstring("unknown")))
+		})
+
+		It("rejects runs loaded in different context", func() {
+			ctx := &server.LoadContext{RootFile: hm.RootFile, Env: append(os.Environ(), "HMAKE_TEST_CONTEXT=1")}
+			_, err := client.Start(&server.RunRequest{Context: ctx})
+			Expect(err).Should(BeAssignableToTypeOf(&server.MismatchError{}))
+			Expect(err).Should(MatchError("environment variables differ: HMAKE_TEST_CONTEXT"))
+			ctx = &server.LoadContext{RootFile: "Build.hmake", Env: os.Environ()}
+			_, err = client.Start(&server.RunRequest{Context: ctx})
+			Expect(err).Should(MatchError(ContainSubstring("project file is HyperMake, not Build.hmake")))
+
+			ctx = &server.LoadContext{RootFile: hm.RootFile, Env: append(os.Environ(), "SHLVL=9")}
+			run, err := client.Start(&server.RunRequest{Context: ctx})
+			Expect(err).Should(Succeed())
+			Expect(client.Events(run.ID, func(*server.Event) {})).Should(Succeed())
+		})
+
+		It("requires the token if set", func() {
+			srv := server.NewServer(func() (*hm.Project, error) {
+				return hm.LoadProjectFrom(projDir, hm.RootFile)
+			})
+			srv.Token = "secret"
+			ts := httptest.NewServer(srv)
+			defer ts.Close()
+			resp, err := http.Get(ts.URL + server.APIPrefix + "project")
+			Expect(err).Should(Succeed())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusUnauthorized))
+			req, err := http.NewRequest(http.MethodGet, ts.URL+server.APIPrefix+"project", nil)
+			Expect(err).Should(Succeed())
+			req.Header.Set("Authorization", "Bearer secret")
+			resp, err = http.DefaultClient.Do(req)
+			Expect(err).Should(Succeed())
+			resp.Body.Close()
+			Expect(resp.StatusCode).To(Equal(http.StatusOK))
+		})
+
+		It("aborts a run", func() {
+			run, err := client.Start(&server.RunRequest{Args: []string{"slow"}})
+			Expect(err).Should(Succeed())
+			_, err = client.Start(&server.RunRequest{Args: []string{"build"}})
+			Expect(err).Should(MatchError(ContainSubstring("in progress")))
+			var result hm.TaskResult
+			Expect(client.Events(run.ID, func(e *server.Event) {
+				switch e.Event {
+				case server.EventStart:
+					Expect(client.Abort(run.ID)).Should(Succeed())
+				case server.EventFinish:
+					result = e.Result
+				}
+			})).Should(Succeed())
+			Expect(result).To(Equal(hm.Failure))
+			run, err = client.Run(run.ID)
+			Expect(err).Should(Succeed())
+			Expect(run.State).To(Equal(server.RunFailed))
+		})
+	})
 })
@@ -0,0 +1,37 @@
+// +build linux darwin
+
+package main
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+func ioctlTermios(f *os.File, req uintptr, t *syscall.Termios) error {
+	_, _, e := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(unsafe.Pointer(t)))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// rawInput disables line buffering and echo of the terminal, so keys are
+// read immediately, signals like Ctrl-C are still generated. The returned
+// function restores the terminal
+func rawInput(f *os.File) (func(), error) {
+	var saved syscall.Termios
+	if err := ioctlTermios(f, ioctlGetTermios, &saved); err != nil {
+		return nil, err
+	}
+	raw := saved
+	raw.Lflag &^= syscall.ICANON | syscall.ECHO
+	raw.Cc[syscall.VMIN] = 1
+	raw.Cc[syscall.VTIME] = 0
+	if err := ioctlTermios(f, ioctlSetTermios, &raw); err != nil {
+		return nil, err
+	}
+	return func() {
+		ioctlTermios(f, ioctlSetTermios, &saved)
+	}, nil
+}
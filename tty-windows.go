@@ -0,0 +1,13 @@
+// +build windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+)
+
+// rawInput is not supported, the dashboard is disabled
+func rawInput(f *os.File) (func(), error) {
+	return nil, fmt.Errorf("raw terminal input not supported")
+}